@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/config"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+const usage = `usage:
+  chirpy [flags]                     start the server
+  chirpy [flags] role <email> <role> set a user's role to user, moderator or admin
+  chirpy [flags] config print        show the settings in effect, secrets redacted
+
+Every setting is a flag named after its key in the config file, such as
+-server.port, and -config names the YAML config file to read.`
+
+// runCommand runs a one-off command instead of starting the server
+func runCommand(cfg config.Config, args []string) error {
+	switch args[0] {
+	case "role":
+		if len(args) != 3 {
+			return errors.New(usage)
+		}
+		return setRole(cfg.Database.Path, args[1], args[2])
+	case "config":
+		if len(args) != 2 || args[1] != "print" {
+			return errors.New(usage)
+		}
+		return cfg.Print(os.Stdout)
+	default:
+		return errors.New(usage)
+	}
+}
+
+// setRole is how the first admin is made, before anyone can use the API
+func setRole(dbPath, email, role string) error {
+	if !auth.ValidRole(role) {
+		return fmt.Errorf("unknown role %q, must be one of user, moderator or admin", role)
+	}
+
+	db, err := database.NewDB(dbPath, false)
+	if err != nil {
+		return err
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("no user with email %s", email)
+	}
+
+	_, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		u.Role = role
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s now has the %s role\n", user.Email, role)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+)
+
+// flowStore keeps state between the requests of a multi-step flow, such as
+// a WebAuthn ceremony or an OAuth redirect. Flows are short-lived, so they
+// are kept in memory rather than on disk.
+type flowStore[T any] struct {
+	mux   *sync.Mutex
+	ttl   time.Duration
+	flows map[string]pendingFlow[T]
+}
+
+type pendingFlow[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+func newFlowStore[T any](ttl time.Duration) *flowStore[T] {
+	return &flowStore[T]{
+		mux:   &sync.Mutex{},
+		ttl:   ttl,
+		flows: make(map[string]pendingFlow[T]),
+	}
+}
+
+// start saves value and returns the ID the client must send back
+func (s *flowStore[T]) start(value T) (string, error) {
+	id, _, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.flows[id] = pendingFlow[T]{value: value, expiresAt: time.Now().Add(s.ttl)}
+
+	return id, nil
+}
+
+// finish removes and returns a flow so it can only be completed once
+func (s *flowStore[T]) finish(id string) (T, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	flow, ok := s.flows[id]
+	delete(s.flows, id)
+	if !ok || time.Now().After(flow.expiresAt) {
+		var zero T
+		return zero, errors.New("unknown or expired flow")
+	}
+	return flow.value, nil
+}
+
+// prune forgets flows that expired without being finished
+func (s *flowStore[T]) prune(now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for id, flow := range s.flows {
+		if now.After(flow.expiresAt) {
+			delete(s.flows, id)
+		}
+	}
+}
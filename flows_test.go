@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowStoreFinishesOnce(t *testing.T) {
+	store := newFlowStore[string](time.Minute)
+	id, err := store.start("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := store.finish(id)
+	if err != nil || value != "state" {
+		t.Fatalf("finish = %q, %v; want the saved state", value, err)
+	}
+	_, err = store.finish(id)
+	if err == nil {
+		t.Error("flow was finished twice")
+	}
+}
+
+func TestFlowStorePrune(t *testing.T) {
+	store := newFlowStore[string](time.Minute)
+	for range 3 {
+		_, err := store.start("state")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	store.prune(now)
+	if len(store.flows) != 3 {
+		t.Fatalf("pruned %d flows that haven't expired", 3-len(store.flows))
+	}
+
+	store.prune(now.Add(2 * time.Minute))
+	if len(store.flows) != 0 {
+		t.Errorf("kept %d expired flows", len(store.flows))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+)
+
+// What happens to a deleted user's chirps
+const (
+	deletedChirpsDelete    = "delete"
+	deletedChirpsAnonymize = "anonymize"
+)
+
+var errDeletionNotScheduled = errors.New("account is not scheduled for deletion")
+
+// DeleteUserMeHandler schedules the account for deletion once the grace
+// period is over and signs the user out everywhere. Signing in again and
+// calling PostUserRestoreHandler cancels it.
+func (cfg *apiConfig) DeleteUserMeHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	// Users who only sign in with a provider have no password to confirm
+	if user.Password != "" {
+		if wait := cfg.loginLockout(r, user.Email); wait > 0 {
+			respondWithLockout(w, wait)
+			return
+		}
+		ok, _ := cfg.verifyPassword(r.Context(), user.Password, params.CurrentPassword)
+		if !ok {
+			cfg.loginFailed(r, user.Email)
+			respondWithFieldErrors(w, map[string][]string{"current_password": {"is incorrect"}})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	user, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		if u.DeletionScheduledAt.IsZero() {
+			u.DeletionScheduledAt = now.Add(cfg.deletionGrace)
+		}
+		u.SessionsRevokedAt = now
+		return nil
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy account will be deleted",
+		Body: fmt.Sprintf("Your Chirpy account and its data will be permanently deleted on %s.\n\n"+
+			"Changed your mind? Sign in before then and restore your account.\n",
+			user.DeletionScheduledAt.Format(time.RFC1123)),
+	}
+	// The request is over by the time the mail goes out, so keep only its
+	// values, such as the trace, and not its cancellation
+	ctx := context.WithoutCancel(r.Context())
+	cfg.goBackground(func() {
+		err := cfg.mailer.Send(ctx, msg)
+		if err != nil {
+			slog.ErrorContext(ctx, "send deletion mail", "user_id", user.Id, "error", err)
+		}
+	})
+
+	type deletionResponse struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}
+
+	respondWithJSON(w, 202, deletionResponse{
+		DeletionScheduledAt: user.DeletionScheduledAt,
+	})
+}
+
+// PostUserRestoreHandler cancels a scheduled deletion
+func (cfg *apiConfig) PostUserRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	_, err = cfg.db.WithContext(r.Context()).UpdateUserFunc(user.Id, func(u *database.User) error {
+		if u.DeletionScheduledAt.IsZero() {
+			return errDeletionNotScheduled
+		}
+		u.DeletionScheduledAt = time.Time{}
+		return nil
+	})
+	if errors.Is(err, errDeletionNotScheduled) {
+		respondWithError(w, 409, "Account is not scheduled for deletion")
+		return
+	}
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// startAccountPurge deletes accounts whose grace period is over and data
+// exports that have expired, every interval until done is closed
+func (cfg *apiConfig) startAccountPurge(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			cfg.purgeAccounts(time.Now().UTC())
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (cfg *apiConfig) purgeAccounts(now time.Time) {
+	ctx, span := startJob("purge_accounts")
+	defer span.End()
+	db := cfg.db.WithContext(ctx)
+
+	exports, err := db.GetDataExports(nil)
+	if err != nil {
+		slog.Error("purge accounts", "error", err)
+		return
+	}
+	for _, export := range exports {
+		if now.After(export.ExpiresAt) {
+			cfg.removeDataExport(ctx, export)
+		}
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		slog.Error("purge accounts", "error", err)
+		return
+	}
+	for _, user := range users {
+		if user.DeletionScheduledAt.IsZero() || now.Before(user.DeletionScheduledAt) {
+			continue
+		}
+
+		// Files only go once the records are, so a user who restored their
+		// account in the meantime keeps them
+		exports, media, err := db.DeleteUser(user.Id, now, cfg.deletedChirps == deletedChirpsAnonymize)
+		if errors.Is(err, database.ErrDeletionNotDue) {
+			continue
+		}
+		if err != nil {
+			slog.Error("purge account", "user_id", user.Id, "error", err)
+			continue
+		}
+		for _, export := range exports {
+			removeExportFile(export)
+		}
+		removeMediaFiles(media)
+		slog.Info("purged account", "user_id", user.Id)
+	}
+}
+
+// removeDataExport deletes an export's archive and its record
+func (cfg *apiConfig) removeDataExport(ctx context.Context, export database.DataExport) {
+	if !removeExportFile(export) {
+		return
+	}
+
+	err := cfg.db.WithContext(ctx).DeleteDataExport(export.Id)
+	if err != nil {
+		slog.Error("remove data export", "export_id", export.Id, "error", err)
+	}
+}
+
+// removeExportFile deletes an export's archive, if it has one, and reports
+// whether it's gone
+func removeExportFile(export database.DataExport) bool {
+	if export.Path == "" {
+		return true
+	}
+	err := os.Remove(export.Path)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("remove data export", "export_id", export.Id, "error", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+)
+
+// scheduleDeletion sets the user's deletion to fall due at at
+func scheduleDeletion(t *testing.T, cfg *apiConfig, userId int, at time.Time) {
+	t.Helper()
+
+	_, err := cfg.db.UpdateUserFunc(userId, func(user *database.User) error {
+		user.DeletionScheduledAt = at
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestFile creates a file with some content, failing the test if it
+// can't
+func writeTestFile(t *testing.T, path string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte("data"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurgeAccounts(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.exportDir = t.TempDir()
+	now := time.Now().UTC()
+
+	due, _ := createTestUser(t, cfg, "due@example.com")
+	scheduleDeletion(t, cfg, due.Id, now.Add(-time.Minute))
+	notDue, _ := createTestUser(t, cfg, "later@example.com")
+	scheduleDeletion(t, cfg, notDue.Id, now.Add(time.Hour))
+
+	exportPath := filepath.Join(cfg.exportDir, "export.zip")
+	writeTestFile(t, exportPath)
+	_, err := cfg.db.SaveDataExport(database.DataExport{
+		Id:          "export",
+		UserId:      due.Id,
+		Status:      database.ExportReady,
+		Path:        exportPath,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaPath := filepath.Join(cfg.mediaDir, "upload.png")
+	writeTestFile(t, mediaPath)
+	_, err = cfg.db.CreateMedia(database.Media{Id: "upload", UserId: due.Id, Size: 4, Path: mediaPath}, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.purgeAccounts(now)
+
+	if _, err := cfg.db.GetUser(due.Id); err == nil {
+		t.Error("account due for deletion was kept")
+	}
+	if _, err := cfg.db.GetUser(notDue.Id); err != nil {
+		t.Errorf("account not yet due was deleted: %v", err)
+	}
+	for _, path := range []string{exportPath, mediaPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was kept: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestDeleteUserAfterRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	now := time.Now().UTC()
+	user, _ := createTestUser(t, cfg, "user@example.com")
+
+	// The purge saw the deletion was due, but the user restored their
+	// account before it got to them
+	scheduleDeletion(t, cfg, user.Id, now.Add(-time.Minute))
+	scheduleDeletion(t, cfg, user.Id, time.Time{})
+
+	_, _, err := cfg.db.DeleteUser(user.Id, now, false)
+	if err != database.ErrDeletionNotDue {
+		t.Fatalf("DeleteUser = %v, want ErrDeletionNotDue", err)
+	}
+	if _, err := cfg.db.GetUser(user.Id); err != nil {
+		t.Errorf("restored account was deleted: %v", err)
+	}
+}
+
+func TestFailUnfinishedExports(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.exportDir = t.TempDir()
+	cfg.exportInterval = time.Hour
+	user, _ := createTestUser(t, cfg, "user@example.com")
+
+	// The server stopped while the export was being written
+	now := time.Now().UTC()
+	_, started, err := cfg.db.StartDataExport(database.DataExport{
+		Id:          "unfinished",
+		UserId:      user.Id,
+		Status:      database.ExportPending,
+		RequestedAt: now,
+	}, cfg.exportInterval)
+	if err != nil || !started {
+		t.Fatalf("start export: %v, %v", started, err)
+	}
+	partial := filepath.Join(cfg.exportDir, "unfinished.zip")
+	writeTestFile(t, partial)
+
+	err = cfg.failUnfinishedExports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := cfg.db.GetLatestDataExport(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Status != database.ExportFailed {
+		t.Errorf("export has status %q, want %q", export.Status, database.ExportFailed)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial archive was kept: %v", err)
+	}
+
+	// The user can ask again straight away
+	_, started, err = cfg.db.StartDataExport(database.DataExport{
+		Id:          "retry",
+		UserId:      user.Id,
+		Status:      database.ExportPending,
+		RequestedAt: now,
+	}, cfg.exportInterval)
+	if err != nil || !started {
+		t.Errorf("new export after a failed one: started = %v, %v", started, err)
+	}
+}
+
+func TestDeleteUserMeAndRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.mailer = mail.LogMailer{}
+	cfg.deletionGrace = 24 * time.Hour
+	user, token := createTestUser(t, cfg, "user@example.com")
+	setTestPassword(t, cfg, user, "the password")
+
+	status := serveJSON(t, cfg.DeleteUserMeHandler, http.MethodDelete, "/api/users/me", token, map[string]string{
+		"current_password": "wrong password",
+	}, nil)
+	if status != 400 {
+		t.Fatalf("wrong password status = %d, want 400", status)
+	}
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.DeletionScheduledAt.IsZero() {
+		t.Fatal("deletion was scheduled without the right password")
+	}
+
+	var scheduled struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}
+	before := time.Now().UTC()
+	status = serveJSON(t, cfg.DeleteUserMeHandler, http.MethodDelete, "/api/users/me", token, map[string]string{
+		"current_password": "the password",
+	}, &scheduled)
+	if status != 202 {
+		t.Fatalf("status = %d, want 202", status)
+	}
+	cfg.background.Wait()
+
+	saved, err = cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.DeletionScheduledAt.Equal(scheduled.DeletionScheduledAt) || saved.DeletionScheduledAt.Before(before.Add(cfg.deletionGrace)) {
+		t.Errorf("deletion scheduled for %v, responded %v, want a grace period from now", saved.DeletionScheduledAt, scheduled.DeletionScheduledAt)
+	}
+	if saved.SessionsRevokedAt.IsZero() || !saved.IsChirpyRed {
+		t.Errorf("saved user = %+v, want sessions revoked and nothing else lost", saved)
+	}
+	// As if the user signs in again a little later
+	_, err = cfg.db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		u.SessionsRevokedAt = u.SessionsRevokedAt.Add(-time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = cfg.tokens.Issue(auth.TokenAccess, strconv.Itoa(user.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = serveJSON(t, cfg.PostUserRestoreHandler, http.MethodPost, "/api/users/me/restore", token, nil, nil)
+	if status != 204 {
+		t.Fatalf("restore status = %d, want 204", status)
+	}
+	saved, err = cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.DeletionScheduledAt.IsZero() {
+		t.Error("deletion is still scheduled after restoring")
+	}
+
+	status = serveJSON(t, cfg.PostUserRestoreHandler, http.MethodPost, "/api/users/me/restore", token, nil, nil)
+	if status != 409 {
+		t.Errorf("restore again status = %d, want 409", status)
+	}
+}
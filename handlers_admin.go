@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+type adminRoleKey struct{}
+
+// requireAdmin guards the admin router. Callers need either the admin token
+// as an Apikey or the access token of a user with the admin role. Routes
+// behind it still check the permission they need with requirePermission.
+func (cfg *apiConfig) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := ""
+		if apiKey, found := strings.CutPrefix(r.Header.Get("Authorization"), "Apikey "); found {
+			if cfg.adminToken == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminToken)) != 1 {
+				cfg.metrics.authFailed(authFailureAdmin)
+				respondWithError(w, 401, "Unauthorized")
+				return
+			}
+			role = auth.RoleAdmin
+		} else {
+			jwtToken, err := getBearerToken(r)
+			if err != nil {
+				respondWithError(w, 401, "Unauthorized")
+				return
+			}
+
+			user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+			if err != nil {
+				respondWithError(w, 401, "Unauthorized")
+				return
+			}
+			role = auth.EffectiveRole(user.Role)
+			if role != auth.RoleAdmin {
+				cfg.metrics.authFailed(authFailureForbidden)
+				respondWithError(w, 403, "Forbidden")
+				return
+			}
+		}
+
+		admin := r.WithContext(context.WithValue(r.Context(), adminRoleKey{}, role))
+		next.ServeHTTP(w, admin)
+		recordRoute(admin)
+	})
+}
+
+// requirePermission only lets callers whose role grants perm reach next.
+// It must sit behind requireAdmin, which finds the caller's role, and is how
+// routes are mapped to permissions in main.
+func (cfg *apiConfig) requirePermission(perm auth.Permission, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(adminRoleKey{}).(string)
+		if role == "" || !auth.RoleCan(role, perm) {
+			cfg.metrics.authFailed(authFailureForbidden)
+			respondWithError(w, 403, "Forbidden")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// resetHandler zeroes the metrics. In dev mode it can also wipe the
+// database when asked to with {"database": true}.
+func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Database bool `json:"database"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	if params.Database {
+		if !cfg.devMode {
+			respondWithError(w, 403, "The database can only be wiped in dev mode")
+			return
+		}
+		err = cfg.db.WithContext(r.Context()).Reset()
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+	}
+
+	cfg.metrics.resetHits()
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// PostAdminUnlockHandler lifts a sign in lockout on an account
+func (cfg *apiConfig) PostAdminUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Email == "" {
+		respondWithError(w, 400, "Email is required")
+		return
+	}
+
+	cfg.loginSucceeded(normalizeEmail(params.Email))
+
+	w.WriteHeader(204)
+}
+
+// PutUserRoleHandler assigns a role to a user
+func (cfg *apiConfig) PutUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || !auth.ValidRole(params.Role) {
+		respondWithFieldErrors(w, map[string][]string{"role": {"must be one of user, moderator or admin"}})
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+
+	user, err := db.GetUser(id)
+	if err != nil {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+
+	if user.Role == auth.RoleAdmin && params.Role != auth.RoleAdmin {
+		admins, err := countAdmins(db)
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+		if admins == 1 {
+			respondWithError(w, 409, "Can't remove the last admin")
+			return
+		}
+	}
+
+	user, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		u.Role = params.Role
+		return nil
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type roleResponse struct {
+		Id    int    `json:"id"`
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	respondWithJSON(w, 200, roleResponse{
+		Id:    user.Id,
+		Email: user.Email,
+		Role:  user.Role,
+	})
+}
+
+func countAdmins(db *database.DB) (int, error) {
+	users, err := db.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	admins := 0
+	for _, user := range users {
+		if user.Role == auth.RoleAdmin {
+			admins++
+		}
+	}
+	return admins, nil
+}
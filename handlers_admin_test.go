@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+func TestRequireAdminOnlyLetsAdminsIn(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.adminToken = "admin-token"
+
+	tokens := map[string]string{}
+	for _, role := range []string{auth.RoleUser, auth.RoleModerator, auth.RoleAdmin} {
+		user, token := createTestUser(t, cfg, role+"@example.com")
+		_, err := cfg.db.UpdateUserFunc(user.Id, func(u *database.User) error {
+			u.Role = role
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[role] = "Bearer " + token
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux := http.NewServeMux()
+	mux.Handle("POST /moderate", cfg.requirePermission(auth.PermDeleteAnyChirp, ok))
+	mux.Handle("GET /metrics", cfg.requirePermission(auth.PermViewMetrics, ok))
+	handler := cfg.requireAdmin(mux)
+
+	tests := []struct {
+		name          string
+		authorization string
+		method, path  string
+		want          int
+	}{
+		{"no credentials", "", "GET", "/metrics", http.StatusUnauthorized},
+		{"wrong admin token", "Apikey nope", "GET", "/metrics", http.StatusUnauthorized},
+		{"admin token", "Apikey admin-token", "GET", "/metrics", http.StatusOK},
+		{"admin", tokens[auth.RoleAdmin], "GET", "/metrics", http.StatusOK},
+		{"admin with permission", tokens[auth.RoleAdmin], "POST", "/moderate", http.StatusOK},
+		{"moderator with permission", tokens[auth.RoleModerator], "POST", "/moderate", http.StatusForbidden},
+		{"moderator without permission", tokens[auth.RoleModerator], "GET", "/metrics", http.StatusForbidden},
+		{"user", tokens[auth.RoleUser], "POST", "/moderate", http.StatusForbidden},
+		{"invalid token", "Bearer nope", "GET", "/metrics", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestResetWipesDatabaseOnlyInDevMode(t *testing.T) {
+	for _, devMode := range []bool{false, true} {
+		cfg := newTestConfig(t)
+		cfg.devMode = devMode
+		user, _ := createTestUser(t, cfg, "kept@example.com")
+
+		code := serveJSON(t, cfg.resetHandler, "POST", "/admin/reset", "", map[string]bool{"database": true}, nil)
+		_, err := cfg.db.GetUser(user.Id)
+		wiped := err != nil
+
+		if devMode && (code != http.StatusOK || !wiped) {
+			t.Errorf("dev mode: got status %d, wiped %v", code, wiped)
+		}
+		if !devMode && (code != http.StatusForbidden || wiped) {
+			t.Errorf("without dev mode: got status %d, wiped %v", code, wiped)
+		}
+	}
+}
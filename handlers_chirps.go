@@ -2,21 +2,25 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/carsongro/chirpy/internal/auth"
 	"github.com/carsongro/chirpy/internal/database"
-	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (cfg *apiConfig) GetChirpHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
 	chirps, err := db.GetChirps(nil)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
 
@@ -25,6 +29,7 @@ func (cfg *apiConfig) GetChirpHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 404, "chirp not found")
 		return
 	}
+	setSpanAttributes(r.Context(), attribute.Int("chirp.id", id))
 
 	var chirp database.Chirp
 	for _, dbChirp := range chirps {
@@ -37,7 +42,7 @@ func (cfg *apiConfig) GetChirpHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *apiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
 	var id *int
 	author_id, err := strconv.Atoi(r.URL.Query().Get("author_id"))
@@ -47,7 +52,7 @@ func (cfg *apiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
 
 	chirps, err := db.GetChirps(id)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
 
@@ -60,29 +65,99 @@ func (cfg *apiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *apiConfig) PostChirpHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
-	jwtToken := r.Header.Get("Authorization")
-	jwtToken, found := strings.CutPrefix(jwtToken, "Bearer ")
-	if !found {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	type userClaims struct {
-		jwt.RegisteredClaims
+	user, err := cfg.authenticateScoped(r.Context(), jwtToken, auth.ScopeChirpsWrite)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
 	}
-	var claims userClaims
-	token, err := jwt.ParseWithClaims(jwtToken, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	})
-	if err != nil || !token.Valid || claims.Issuer != "chirpy_access" {
+	authorId := user.Id
+
+	if !cfg.allowedUnverified(user, actionPostChirp) {
+		respondWithError(w, 403, "Verify your email to post chirps")
+		return
+	}
+
+	ents := cfg.entitlementsFor(user)
+
+	type parameters struct {
+		Body  string   `json:"body"`
+		Media []string `json:"media"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	if utf8.RuneCountInString(params.Body) > ents.MaxChirpLength {
+		respondWithError(w, 400, "Chirp is too long")
+		return
+	}
+
+	if len(params.Media) > ents.MaxAttachments {
+		respondWithFieldErrors(w, map[string][]string{"media": {fmt.Sprintf("can have at most %d attachments on your plan", ents.MaxAttachments)}})
+		return
+	}
+	for _, mediaId := range params.Media {
+		media, err := db.GetMedia(mediaId)
+		if err != nil || media.UserId != authorId {
+			respondWithFieldErrors(w, map[string][]string{"media": {fmt.Sprintf("%s is not one of your uploads", mediaId)}})
+			return
+		}
+	}
+
+	// Only chirps that would be posted count towards the limit
+	if wait := cfg.chirpLimiter.allow(strconv.Itoa(user.Id), ents.ChirpsPerMinute); wait > 0 {
+		respondWithRateLimit(w, wait)
+		return
+	}
+
+	newChirp, err := db.CreateChirp(cleanChirp(params.Body, cfg.bannedWords), authorId, params.Media)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	setSpanAttributes(r.Context(), attribute.Int("chirp.id", newChirp.Id))
+	cfg.emitEvent(r.Context(), eventChirpCreated, authorId, newChirp)
+
+	respondWithJSON(w, 201, newChirp)
+}
+
+// PutChirpHandler edits a chirp's body, for authors whose plan allows it
+func (cfg *apiConfig) PutChirpHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
-	authorId, err := strconv.Atoi(claims.Subject)
+
+	user, err := cfg.authenticateScoped(r.Context(), jwtToken, auth.ScopeChirpsWrite)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if !cfg.allowedUnverified(user, actionPostChirp) {
+		respondWithError(w, 403, "Verify your email to post chirps")
+		return
+	}
+
+	ents := cfg.entitlementsFor(user)
+	if !ents.EditChirps {
+		respondWithError(w, 403, "Your plan doesn't include editing chirps")
 		return
 	}
 
@@ -94,22 +169,47 @@ func (cfg *apiConfig) PostChirpHandler(w http.ResponseWriter, r *http.Request) {
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "chirp not found")
 		return
 	}
+	setSpanAttributes(r.Context(), attribute.Int("chirp.id", id))
 
-	if len(params.Body) > 140 {
+	chirp, err := db.GetChirp(id)
+	if err != nil {
+		respondWithError(w, 404, "chirp not found")
+		return
+	}
+	if chirp.AuthorId != user.Id {
+		respondWithError(w, 403, "Unauthorized")
+		return
+	}
+
+	if utf8.RuneCountInString(params.Body) > ents.MaxChirpLength {
 		respondWithError(w, 400, "Chirp is too long")
 		return
 	}
 
-	badWords := map[string]bool{
-		"kerfuffle": true,
-		"sharbert":  true,
-		"fornax":    true,
+	now := time.Now().UTC()
+	chirp.Body = cleanChirp(params.Body, cfg.bannedWords)
+	chirp.EditedAt = &now
+	chirp, err = db.UpdateChirp(chirp)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
 	}
 
-	words := strings.Split(params.Body, " ")
+	respondWithJSON(w, 200, chirp)
+}
+
+// cleanChirp censors words that aren't allowed on Chirpy
+func cleanChirp(body string, badWords map[string]bool) string {
+	words := strings.Split(body, " ")
 
 	for i, word := range words {
 		if badWords[strings.ToLower(word)] {
@@ -117,47 +217,32 @@ func (cfg *apiConfig) PostChirpHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	cleanedBody := strings.Join(words, " ")
-
-	newChirp, err := db.CreateChirp(cleanedBody, authorId)
-	if err != nil {
-		respondWithError(w, 500, "Something went wrong: ")
-		return
-	}
-
-	respondWithJSON(w, 201, newChirp)
+	return strings.Join(words, " ")
 }
 
 func (cfg *apiConfig) DeleteChirpHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
-	jwtToken := r.Header.Get("Authorization")
-	jwtToken, found := strings.CutPrefix(jwtToken, "Bearer ")
-	if !found {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	type userClaims struct {
-		jwt.RegisteredClaims
-	}
-	var claims userClaims
-	token, err := jwt.ParseWithClaims(jwtToken, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	})
-	if err != nil || !token.Valid || claims.Issuer != "chirpy_access" {
+	user, err := cfg.authenticateScoped(r.Context(), jwtToken, auth.ScopeChirpsWrite)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
-	authorId, err := strconv.Atoi(claims.Subject)
-	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+
+	if !cfg.allowedUnverified(user, actionDeleteChirp) {
+		respondWithError(w, 403, "Verify your email to delete chirps")
 		return
 	}
 
 	chirps, err := db.GetChirps(nil)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
 
@@ -166,6 +251,7 @@ func (cfg *apiConfig) DeleteChirpHandler(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, 404, "chirp not found")
 		return
 	}
+	setSpanAttributes(r.Context(), attribute.Int("chirp.id", id))
 
 	var chirp database.Chirp
 	for _, dbChirp := range chirps {
@@ -174,15 +260,23 @@ func (cfg *apiConfig) DeleteChirpHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	if chirp.AuthorId != authorId {
+	if chirp.Id == 0 {
+		respondWithError(w, 404, "chirp not found")
+		return
+	}
+
+	// Moderators can take down anyone's chirps
+	if chirp.AuthorId != user.Id && !auth.RoleCan(user.Role, auth.PermDeleteAnyChirp) {
 		respondWithError(w, 403, "Unauthorized")
 		return
 	}
 
 	err = db.DeleteChirp(id)
 	if err != nil {
-		respondWithJSON(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
+		return
 	}
+	cfg.emitEvent(r.Context(), eventChirpDeleted, chirp.AuthorId, chirpDeletedData{Id: chirp.Id, AuthorId: chirp.AuthorId})
 
 	respondWithJSON(w, 200, "")
 }
@@ -202,3 +296,17 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 		Error: msg,
 	})
 }
+
+// respondWithFieldErrors reports problems with specific request fields,
+// keyed by the JSON name of the field
+func respondWithFieldErrors(w http.ResponseWriter, fields map[string][]string) {
+	type errorResponse struct {
+		Error  string              `json:"error"`
+		Fields map[string][]string `json:"fields"`
+	}
+
+	respondWithJSON(w, 400, errorResponse{
+		Error:  "Invalid request",
+		Fields: fields,
+	})
+}
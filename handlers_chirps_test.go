@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/entitlements"
+)
+
+func TestPostChirpRateLimitSkipsRejectedChirps(t *testing.T) {
+	cfg := newTestConfig(t)
+	free := cfg.plans[database.PlanFree]
+	free.ChirpsPerMinute = 2
+	cfg.plans[database.PlanFree] = free
+	_, token := createTestUser(t, cfg, "chirper@example.com")
+
+	tooLong := map[string]any{"body": strings.Repeat("a", free.MaxChirpLength+1)}
+	for range 3 {
+		code := serveJSON(t, cfg.PostChirpHandler, "POST", "/api/chirps", token, tooLong, nil)
+		if code != http.StatusBadRequest {
+			t.Fatalf("chirp that is too long: got status %d", code)
+		}
+	}
+
+	chirp := map[string]any{"body": "hello"}
+	for i, want := range []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests} {
+		code := serveJSON(t, cfg.PostChirpHandler, "POST", "/api/chirps", token, chirp, nil)
+		if code != want {
+			t.Errorf("chirp %d: got status %d, want %d", i+1, code, want)
+		}
+	}
+}
+
+func TestChirpEntitlementsFromFile(t *testing.T) {
+	cfg := newTestConfig(t)
+	path := filepath.Join(t.TempDir(), "entitlements.json")
+	err := os.WriteFile(path, []byte(`{"free": {"max_chirp_length": 20}, "red": {"edit_chirps": false}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.plans, err = entitlements.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	free, freeToken := createTestUser(t, cfg, "free@example.com")
+	red, redToken := createTestUser(t, cfg, "red@example.com")
+	_, err = cfg.db.UpdateUserFunc(red.Id, func(u *database.User) error {
+		u.IsChirpyRed = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := serveJSON(t, cfg.PostChirpHandler, http.MethodPost, "/api/chirps", freeToken, map[string]any{"body": strings.Repeat("a", 21)}, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("free chirp over the configured limit: got status %d, want 400", status)
+	}
+	status = serveJSON(t, cfg.PostChirpHandler, http.MethodPost, "/api/chirps", freeToken, map[string]any{"body": strings.Repeat("a", 20)}, nil)
+	if status != http.StatusCreated {
+		t.Errorf("free chirp at the configured limit: got status %d, want 201", status)
+	}
+
+	// Red keeps the defaults the file doesn't change
+	var chirp database.Chirp
+	status = serveJSON(t, cfg.PostChirpHandler, http.MethodPost, "/api/chirps", redToken, map[string]any{"body": strings.Repeat("a", 500)}, &chirp)
+	if status != http.StatusCreated {
+		t.Fatalf("red chirp within the default limit: got status %d, want 201", status)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/chirps/"+strconv.Itoa(chirp.Id), strings.NewReader(`{"body":"edited"}`))
+	req.SetPathValue("chirpID", strconv.Itoa(chirp.Id))
+	req.Header.Set("Authorization", "Bearer "+redToken)
+	rec := httptest.NewRecorder()
+	cfg.PutChirpHandler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("edit with editing turned off: got status %d, want 403", rec.Code)
+	}
+
+	chirps, err := cfg.db.GetChirps(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Fatalf("saved %d chirps, want 2", len(chirps))
+	}
+	for _, saved := range chirps {
+		if saved.AuthorId == free.Id && len(saved.Body) != 20 {
+			t.Errorf("free chirp body has %d characters, want 20", len(saved.Body))
+		}
+		if saved.AuthorId == red.Id && (saved.Body != chirp.Body || saved.EditedAt != nil) {
+			t.Error("red chirp was edited")
+		}
+	}
+}
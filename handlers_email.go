@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+)
+
+// Actions that can be restricted to users with a verified email
+const (
+	actionPostChirp   = "post_chirp"
+	actionDeleteChirp = "delete_chirp"
+)
+
+// normalizeEmail lower-cases email so addresses that differ only in case
+// belong to the same account
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// validEmail reports whether email is a bare address like "user@example.com"
+func validEmail(email string) bool {
+	address, err := netmail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// allowedUnverified reports whether user may perform action. Users with a
+// verified email may do anything.
+func (cfg *apiConfig) allowedUnverified(user database.User, action string) bool {
+	return user.EmailVerified || !cfg.verifiedOnly[action]
+}
+
+// sendEmailVerification mails a verification token for email to the user.
+// The mail is sent in the background; failures are logged.
+func (cfg *apiConfig) sendEmailVerification(ctx context.Context, user database.User, email string) error {
+	token, tokenHash, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.db.WithContext(ctx).CreateEmailVerification(user.Id, email, tokenHash, time.Now().UTC().Add(cfg.emailVerificationTTL))
+	if err != nil {
+		return err
+	}
+
+	msg := mail.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email",
+		Body: fmt.Sprintf("Please confirm that this address belongs to your Chirpy account.\n\n"+
+			"Your verification token is: %s\n\n"+
+			"It expires in %s. If this wasn't you, you can ignore this email.\n",
+			token, cfg.emailVerificationTTL),
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	cfg.goBackground(func() {
+		err := cfg.mailer.Send(ctx, msg)
+		if err != nil {
+			slog.ErrorContext(ctx, "send verification mail", "user_id", user.Id, "error", err)
+		}
+	})
+
+	return nil
+}
+
+func (cfg *apiConfig) PostEmailVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Token == "" {
+		respondWithError(w, 400, "Token is required")
+		return
+	}
+
+	user, err := db.ConfirmEmail(auth.HashOpaqueToken(params.Token))
+	if err != nil {
+		respondWithError(w, 400, "Invalid or expired verification token")
+		return
+	}
+
+	type userResponse struct {
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+
+	respondWithJSON(w, 200, userResponse{
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	})
+}
+
+func (cfg *apiConfig) PostEmailVerifyResendHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	email := user.PendingEmail
+	if email == "" {
+		if user.EmailVerified {
+			respondWithError(w, 409, "Email is already verified")
+			return
+		}
+		email = user.Email
+	}
+
+	err = cfg.sendEmailVerification(r.Context(), user, email)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(202)
+}
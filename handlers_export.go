@@ -0,0 +1,498 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+)
+
+type dataExportResponse struct {
+	Id          string     `json:"id"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requested_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+func newDataExportResponse(export database.DataExport) dataExportResponse {
+	response := dataExportResponse{
+		Id:          export.Id,
+		Status:      export.Status,
+		RequestedAt: export.RequestedAt,
+		ExpiresAt:   export.ExpiresAt,
+	}
+	if export.Status == database.ExportReady {
+		response.CompletedAt = &export.CompletedAt
+		response.DownloadURL = "/api/users/me/export/download"
+	}
+	return response
+}
+
+// PostDataExportHandler starts building an archive of the user's data in
+// the background. Poll GetDataExportHandler until it is ready. Users can
+// ask for one export per interval, and each replaces the one before.
+func (cfg *apiConfig) PostDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	export, started, err := db.StartDataExport(database.DataExport{
+		Id:          hex.EncodeToString(id),
+		UserId:      user.Id,
+		Status:      database.ExportPending,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(cfg.exportTTL),
+	}, cfg.exportInterval)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	if !started && export.Status == database.ExportPending {
+		respondWithJSON(w, 202, newDataExportResponse(export))
+		return
+	}
+	if !started {
+		respondWithRateLimit(w, export.RequestedAt.Add(cfg.exportInterval).Sub(now))
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	cfg.goBackground(func() { cfg.buildDataExport(ctx, export) })
+
+	respondWithJSON(w, 202, newDataExportResponse(export))
+}
+
+// GetDataExportHandler reports on the user's most recent export
+func (cfg *apiConfig) GetDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	export, err := cfg.db.WithContext(r.Context()).GetLatestDataExport(user.Id)
+	if err != nil {
+		respondWithError(w, 404, "No export has been requested")
+		return
+	}
+
+	respondWithJSON(w, 200, newDataExportResponse(export))
+}
+
+// GetDataExportDownloadHandler serves the user's most recent finished export
+func (cfg *apiConfig) GetDataExportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	export, err := cfg.db.WithContext(r.Context()).GetLatestDataExport(user.Id)
+	if err != nil || export.Status != database.ExportReady || time.Now().After(export.ExpiresAt) {
+		respondWithError(w, 404, "No export is ready")
+		return
+	}
+
+	f, err := os.Open(export.Path)
+	if err != nil {
+		respondWithError(w, 404, "No export is ready")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%s.zip"`, export.CompletedAt.Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// A large archive on a slow connection can take longer than the
+	// server's write timeout
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.WarnContext(r.Context(), "clear write deadline", "error", err)
+	}
+	http.ServeContent(w, r, "", export.CompletedAt, f)
+}
+
+// failUnfinishedExports fails the exports that were still being built when
+// the server last stopped, which would otherwise keep their users from
+// asking for another until they expire
+func (cfg *apiConfig) failUnfinishedExports() error {
+	failed, err := cfg.db.FailPendingDataExports()
+	if err != nil {
+		return err
+	}
+
+	for _, export := range failed {
+		err := os.Remove(filepath.Join(cfg.exportDir, export.Id+".zip"))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("remove unfinished data export", "export_id", export.Id, "error", err)
+		}
+	}
+	if len(failed) > 0 {
+		slog.Warn("failed unfinished data exports", "count", len(failed))
+	}
+	return nil
+}
+
+// buildDataExport writes the archive for export and marks it ready, or
+// failed if anything goes wrong
+func (cfg *apiConfig) buildDataExport(ctx context.Context, export database.DataExport) {
+	ctx, span := tracer.Start(ctx, "export.build")
+	defer span.End()
+	db := cfg.db.WithContext(ctx)
+	path := filepath.Join(cfg.exportDir, export.Id+".zip")
+
+	err := cfg.writeDataExport(ctx, export.UserId, path)
+	if err != nil {
+		slog.Error("build data export", "export_id", export.Id, "error", err)
+		os.Remove(path)
+		export.Status = database.ExportFailed
+		_, err = db.SaveDataExport(export)
+		if err != nil {
+			slog.Error("build data export", "export_id", export.Id, "error", err)
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	export.Status = database.ExportReady
+	export.Path = path
+	export.CompletedAt = now
+	export.ExpiresAt = now.Add(cfg.exportTTL)
+	_, err = db.SaveDataExport(export)
+	if err != nil {
+		// The user was most likely deleted while the export was running
+		slog.Error("build data export", "export_id", export.Id, "error", err)
+		os.Remove(path)
+		return
+	}
+
+	earlier, err := db.GetDataExports(&export.UserId)
+	if err != nil {
+		slog.Error("build data export", "export_id", export.Id, "error", err)
+	}
+	for _, old := range earlier {
+		if old.Id != export.Id {
+			cfg.removeDataExport(ctx, old)
+		}
+	}
+
+	user, err := db.GetUser(export.UserId)
+	if err != nil {
+		return
+	}
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy data export is ready",
+		Body: fmt.Sprintf("The copy of your Chirpy data you asked for is ready to download "+
+			"from /api/users/me/export/download until %s.\n",
+			export.ExpiresAt.Format(time.RFC1123)),
+	}
+	err = cfg.mailer.Send(ctx, msg)
+	if err != nil {
+		slog.Error("send export mail", "user_id", user.Id, "error", err)
+	}
+}
+
+// exportSession is anything that lets someone act as the user: passkeys,
+// personal access tokens, apps they authorized and linked identities
+type exportSession struct {
+	Type       string     `json:"type"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// writeDataExport gathers everything stored about a user, except secrets
+// like password hashes, into a zip of JSON and CSV files and the files they
+// uploaded
+func (cfg *apiConfig) writeDataExport(ctx context.Context, userId int, path string) error {
+	db := cfg.db.WithContext(ctx)
+
+	user, err := db.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	chirps, err := db.GetChirps(&userId)
+	if err != nil {
+		return err
+	}
+	uploads, err := db.GetUserMedia(userId)
+	if err != nil {
+		return err
+	}
+	sessions, err := cfg.exportSessions(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	type exportProfile struct {
+		Id                  int        `json:"id"`
+		Email               string     `json:"email"`
+		PendingEmail        string     `json:"pending_email,omitempty"`
+		EmailVerified       bool       `json:"email_verified"`
+		IsChirpyRed         bool       `json:"is_chirpy_red"`
+		Plan                string     `json:"plan"`
+		PlanStatus          string     `json:"plan_status,omitempty"`
+		PlanPeriodEnd       *time.Time `json:"plan_period_end,omitempty"`
+		TwoFactorEnabled    bool       `json:"two_factor_enabled"`
+		SessionsRevokedAt   *time.Time `json:"sessions_revoked_at,omitempty"`
+		DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	}
+
+	profile := exportProfile{
+		Id:               user.Id,
+		Email:            user.Email,
+		PendingEmail:     user.PendingEmail,
+		EmailVerified:    user.EmailVerified,
+		IsChirpyRed:      user.IsChirpyRed,
+		TwoFactorEnabled: user.TOTPEnabled,
+	}
+	subscription := newSubscriptionResponse(user)
+	profile.Plan = subscription.Plan
+	profile.PlanStatus = subscription.Status
+	profile.PlanPeriodEnd = subscription.CurrentPeriodEnd
+	if !user.SessionsRevokedAt.IsZero() {
+		profile.SessionsRevokedAt = &user.SessionsRevokedAt
+	}
+	if !user.DeletionScheduledAt.IsZero() {
+		profile.DeletionScheduledAt = &user.DeletionScheduledAt
+	}
+
+	profileRows := [][]string{
+		{"field", "value"},
+		{"id", strconv.Itoa(profile.Id)},
+		{"email", profile.Email},
+		{"pending_email", profile.PendingEmail},
+		{"email_verified", strconv.FormatBool(profile.EmailVerified)},
+		{"is_chirpy_red", strconv.FormatBool(profile.IsChirpyRed)},
+		{"plan", profile.Plan},
+		{"plan_status", profile.PlanStatus},
+		{"plan_period_end", formatOptionalTime(profile.PlanPeriodEnd)},
+		{"two_factor_enabled", strconv.FormatBool(profile.TwoFactorEnabled)},
+		{"sessions_revoked_at", formatOptionalTime(profile.SessionsRevokedAt)},
+		{"deletion_scheduled_at", formatOptionalTime(profile.DeletionScheduledAt)},
+	}
+
+	chirpRows := [][]string{{"id", "body"}}
+	for _, chirp := range chirps {
+		chirpRows = append(chirpRows, []string{strconv.Itoa(chirp.Id), chirp.Body})
+	}
+
+	type exportMedia struct {
+		File        string    `json:"file"`
+		ContentType string    `json:"content_type"`
+		Size        int64     `json:"size"`
+		CreatedAt   time.Time `json:"created_at"`
+	}
+
+	media := make([]exportMedia, 0, len(uploads))
+	mediaRows := [][]string{{"file", "content_type", "size", "created_at"}}
+	for _, upload := range uploads {
+		file := exportMedia{
+			File:        "media/" + filepath.Base(upload.Path),
+			ContentType: upload.ContentType,
+			Size:        upload.Size,
+			CreatedAt:   upload.CreatedAt,
+		}
+		media = append(media, file)
+		mediaRows = append(mediaRows, []string{
+			file.File,
+			file.ContentType,
+			strconv.FormatInt(file.Size, 10),
+			file.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	sessionRows := [][]string{{"type", "name", "scopes", "created_at", "last_used_at", "expires_at"}}
+	for _, session := range sessions {
+		scopes, _ := json.Marshal(session.Scopes)
+		sessionRows = append(sessionRows, []string{
+			session.Type,
+			session.Name,
+			string(scopes),
+			session.CreatedAt.Format(time.RFC3339),
+			formatOptionalTime(session.LastUsedAt),
+			formatOptionalTime(session.ExpiresAt),
+		})
+	}
+
+	err = os.MkdirAll(cfg.exportDir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive := zip.NewWriter(f)
+	files := []struct {
+		name string
+		json any
+		csv  [][]string
+	}{
+		{"profile", profile, profileRows},
+		{"chirps", chirps, chirpRows},
+		{"sessions", sessions, sessionRows},
+		{"media", media, mediaRows},
+	}
+	for _, file := range files {
+		jsonFile, err := archive.Create(file.name + ".json")
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(jsonFile)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.json)
+		if err != nil {
+			return err
+		}
+
+		csvFile, err := archive.Create(file.name + ".csv")
+		if err != nil {
+			return err
+		}
+		err = csv.NewWriter(csvFile).WriteAll(file.csv)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, upload := range uploads {
+		err = copyToArchive(archive, media[i].File, upload.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (cfg *apiConfig) exportSessions(ctx context.Context, userId int) ([]exportSession, error) {
+	db := cfg.db.WithContext(ctx)
+	sessions := []exportSession{}
+
+	passkeys, err := db.GetPasskeys(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, passkey := range passkeys {
+		session := exportSession{Type: "passkey", Name: passkey.Name, CreatedAt: passkey.CreatedAt}
+		if !passkey.LastUsedAt.IsZero() {
+			session.LastUsedAt = &passkey.LastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+
+	tokens, err := db.GetPersonalTokens(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		session := exportSession{Type: "personal_token", Name: token.Name, Scopes: token.Scopes, CreatedAt: token.CreatedAt, ExpiresAt: &token.ExpiresAt}
+		if !token.LastUsedAt.IsZero() {
+			session.LastUsedAt = &token.LastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+
+	grants, err := db.GetOAuthGrants(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, grant := range grants {
+		name := grant.ClientId
+		if client, err := db.GetOAuthClient(grant.ClientId); err == nil {
+			name = client.Name
+		}
+		sessions = append(sessions, exportSession{Type: "authorized_app", Name: name, Scopes: grant.Scopes, CreatedAt: grant.AuthorizedAt})
+	}
+
+	identities, err := db.GetIdentities(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		sessions = append(sessions, exportSession{Type: "linked_identity", Name: identity.Provider + ": " + identity.Email, CreatedAt: identity.CreatedAt})
+	}
+
+	return sessions, nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// copyToArchive adds the file at path to archive as name
+func copyToArchive(archive *zip.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+)
+
+func TestDataExportBuiltInBackground(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.mailer = mail.LogMailer{}
+	cfg.exportDir = t.TempDir()
+	cfg.exportTTL = time.Hour
+	cfg.exportInterval = time.Hour
+	user, token := createTestUser(t, cfg, "user@example.com")
+
+	status := serveJSON(t, cfg.PostDataExportHandler, http.MethodPost, "/api/users/me/export", token, nil, nil)
+	if status != 202 {
+		t.Fatalf("status = %d, want 202", status)
+	}
+
+	// Shutdown waits for the build the same way
+	cfg.background.Wait()
+
+	export, err := cfg.db.GetLatestDataExport(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Status != database.ExportReady {
+		t.Fatalf("export is %s once background work is done, want %s", export.Status, database.ExportReady)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/me/export/download", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.GetDataExportDownloadHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("download status = %d, want 200", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("Content-Type = %q, want application/zip", rec.Header().Get("Content-Type"))
+	}
+}
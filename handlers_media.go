@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// mediaTypes are the kinds of file that can be attached to chirps, by the
+// content type sniffed from the upload
+var mediaTypes = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// PostMediaHandler uploads an image, sent as the raw request body, to attach
+// to chirps. Plans without attachments can't upload at all, and the others
+// limit how often users upload and how much they can store. Uploads that
+// are never attached are removed by startMediaSweep.
+func (cfg *apiConfig) PostMediaHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.authenticateScoped(r.Context(), jwtToken, auth.ScopeChirpsWrite)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	ents := cfg.entitlementsFor(user)
+	if ents.MaxAttachments < 1 {
+		respondWithError(w, 403, "Your plan doesn't include media attachments")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ents.MaxAttachmentBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, 413, "File is too large")
+		return
+	}
+	if err != nil || len(data) == 0 {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := mediaTypes[contentType]
+	if !ok {
+		respondWithError(w, 415, "Only GIF, JPEG, PNG and WebP images can be attached")
+		return
+	}
+
+	if wait := cfg.mediaLimiter.allow(strconv.Itoa(user.Id), ents.UploadsPerHour); wait > 0 {
+		respondWithRateLimit(w, wait)
+		return
+	}
+
+	id, _, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	err = os.MkdirAll(cfg.mediaDir, 0700)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	path := filepath.Join(cfg.mediaDir, id+ext)
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	media, err := db.CreateMedia(database.Media{
+		Id:          id,
+		UserId:      user.Id,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Path:        path,
+		CreatedAt:   time.Now().UTC(),
+	}, ents.MaxStorageBytes)
+	if errors.Is(err, database.ErrStorageQuota) {
+		os.Remove(path)
+		respondWithError(w, 403, fmt.Sprintf("Uploads are limited to %d MB in total on your plan", ents.MaxStorageBytes>>20))
+		return
+	}
+	if err != nil {
+		os.Remove(path)
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type mediaResponse struct {
+		Id          string `json:"id"`
+		URL         string `json:"url"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+
+	respondWithJSON(w, 201, mediaResponse{
+		Id:          media.Id,
+		URL:         "/api/media/" + media.Id,
+		ContentType: media.ContentType,
+		Size:        media.Size,
+	})
+}
+
+// GetMediaHandler serves an uploaded file. Like chirps, uploads are public.
+func (cfg *apiConfig) GetMediaHandler(w http.ResponseWriter, r *http.Request) {
+	media, err := cfg.db.WithContext(r.Context()).GetMedia(r.PathValue("mediaID"))
+	if err != nil {
+		respondWithError(w, 404, "Media not found")
+		return
+	}
+
+	f, err := os.Open(media.Path)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "open media", "media_id", media.Id, "error", err)
+		respondWithError(w, 404, "Media not found")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", media.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	http.ServeContent(w, r, "", media.CreatedAt, f)
+}
+
+// startMediaSweep removes uploads that no chirp has used for ttl after they
+// were uploaded, every interval until done is closed
+func (cfg *apiConfig) startMediaSweep(interval, ttl time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			cfg.sweepMedia(time.Now().UTC().Add(-ttl))
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (cfg *apiConfig) sweepMedia(cutoff time.Time) {
+	ctx, span := startJob("sweep_media")
+	defer span.End()
+
+	orphans, err := cfg.db.WithContext(ctx).DeleteOrphanedMedia(cutoff)
+	if err != nil {
+		slog.Error("sweep media", "error", err)
+		return
+	}
+
+	for _, media := range orphans {
+		err := os.Remove(media.Path)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("sweep media", "media_id", media.Id, "error", err)
+		}
+	}
+	if len(orphans) > 0 {
+		slog.Info("removed unused media", "count", len(orphans))
+	}
+}
+
+// removeMediaFiles deletes the files of uploads whose records are gone
+func removeMediaFiles(uploads []database.Media) {
+	for _, media := range uploads {
+		err := os.Remove(media.Path)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("remove media", "media_id", media.Id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// newMediaTestUser returns a Red user's access token, with Red limited to
+// three uploads an hour of at most 100 bytes in total
+func newMediaTestUser(t *testing.T, cfg *apiConfig) (database.User, string) {
+	t.Helper()
+
+	red := cfg.plans[database.PlanRed]
+	red.MaxAttachmentBytes = 60
+	red.MaxStorageBytes = 100
+	red.UploadsPerHour = 3
+	cfg.plans[database.PlanRed] = red
+
+	user, token := createTestUser(t, cfg, "media@example.com")
+	user.IsChirpyRed = true
+	user, err := cfg.db.UpdateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+func uploadPNG(cfg *apiConfig, token string, size int) int {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, size-8)...)
+	req := httptest.NewRequest("POST", "/api/media", bytes.NewReader(png))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.PostMediaHandler(rec, req)
+	return rec.Code
+}
+
+func TestPostMediaStorageQuota(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, token := newMediaTestUser(t, cfg)
+
+	for i, want := range []int{http.StatusCreated, http.StatusForbidden} {
+		if code := uploadPNG(cfg, token, 60); code != want {
+			t.Errorf("upload %d: got status %d, want %d", i+1, code, want)
+		}
+	}
+	if code := uploadPNG(cfg, token, 40); code != http.StatusCreated {
+		t.Errorf("upload that fits: got status %d, want %d", code, http.StatusCreated)
+	}
+
+	entries, err := os.ReadDir(cfg.mediaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files in the media directory, want 2", len(entries))
+	}
+}
+
+func TestPostMediaRateLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, token := newMediaTestUser(t, cfg)
+
+	// Rejected uploads don't count towards the limit
+	if code := uploadPNG(cfg, token, 61); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized upload: got status %d", code)
+	}
+	for i, want := range []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests} {
+		if code := uploadPNG(cfg, token, 10); code != want {
+			t.Errorf("upload %d: got status %d, want %d", i+1, code, want)
+		}
+	}
+}
+
+func TestSweepMediaKeepsAttachedUploads(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := newMediaTestUser(t, cfg)
+
+	for range 2 {
+		if code := uploadPNG(cfg, token, 10); code != http.StatusCreated {
+			t.Fatalf("upload: got status %d", code)
+		}
+	}
+	uploads, err := cfg.db.GetUserMedia(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached, orphan := uploads[0], uploads[1]
+	_, err = cfg.db.CreateChirp("look", user.Id, []string{attached.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.sweepMedia(time.Now().UTC().Add(-time.Hour))
+	if _, err := cfg.db.GetMedia(orphan.Id); err != nil {
+		t.Error("a recent upload was swept before it could be attached")
+	}
+
+	cfg.sweepMedia(time.Now().UTC().Add(time.Hour))
+	if _, err := cfg.db.GetMedia(attached.Id); err != nil {
+		t.Error("an attached upload was swept")
+	}
+	if _, err := os.Stat(attached.Path); err != nil {
+		t.Errorf("an attached upload's file was removed: %v", err)
+	}
+	if _, err := cfg.db.GetMedia(orphan.Id); err == nil {
+		t.Error("an unused upload was kept")
+	}
+	if _, err := os.Stat(orphan.Path); !os.IsNotExist(err) {
+		t.Errorf("an unused upload's file was kept: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+const totpIssuer = "Chirpy"
+
+var (
+	errInvalidSecondFactor = errors.New("invalid or already used code")
+	errMFAEnabled          = errors.New("two-factor authentication is already enabled")
+	errMFANotEnrolled      = errors.New("two-factor enrollment hasn't been started")
+)
+
+// respondWithMFAChallenge answers a correct password for a user with 2FA
+// enabled. The challenge token is exchanged at /api/login/2fa.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User) {
+	mfaToken, err := cfg.tokens.Issue(auth.TokenMFA, strconv.Itoa(user.Id))
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	type challengeResponse struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+
+	respondWithJSON(w, 200, challengeResponse{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+}
+
+// verifySecondFactor checks a TOTP code or, failing that, a recovery code.
+// Used TOTP steps and recovery codes are persisted so they can't be replayed.
+func (cfg *apiConfig) verifySecondFactor(ctx context.Context, user database.User, code, recoveryCode string) bool {
+	// Checking and consuming the code in one locked update means two
+	// requests racing with the same code can't both succeed
+	_, err := cfg.db.WithContext(ctx).UpdateUserFunc(user.Id, func(user *database.User) error {
+		if code != "" {
+			step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastCounter)
+			if !ok {
+				return errInvalidSecondFactor
+			}
+			user.TOTPLastCounter = step
+			return nil
+		}
+
+		if recoveryCode != "" {
+			hash := auth.HashRecoveryCode(recoveryCode)
+			for i, stored := range user.RecoveryCodes {
+				if stored == hash {
+					user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+					return nil
+				}
+			}
+		}
+
+		return errInvalidSecondFactor
+	})
+	return err == nil
+}
+
+func (cfg *apiConfig) PostLoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), params.MFAToken, auth.TokenMFA)
+	if err != nil || !user.TOTPEnabled {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if wait := cfg.loginLockout(r, user.Email); wait > 0 {
+		respondWithLockout(w, wait)
+		return
+	}
+
+	if !cfg.verifySecondFactor(r.Context(), user, params.Code, params.RecoveryCode) {
+		cfg.loginFailed(r, user.Email)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	cfg.loginSucceeded(user.Email)
+	cfg.respondWithSession(w, user)
+}
+
+func (cfg *apiConfig) PostMFAEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if user.TOTPEnabled {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// The secret stays inactive until a code from it is confirmed
+	_, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		if u.TOTPEnabled {
+			return errMFAEnabled
+		}
+		u.TOTPSecret = secret
+		u.TOTPLastCounter = 0
+		return nil
+	})
+	if errors.Is(err, errMFAEnabled) {
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type enrollResponse struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+
+	respondWithJSON(w, 200, enrollResponse{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(totpIssuer, user.Email, secret),
+	})
+}
+
+func (cfg *apiConfig) PostMFAConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Code is required")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	codes, hashes, err := auth.GenerateRecoveryCodes(10)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// The code is checked against the secret as stored, in case enrollment
+	// was started again in the meantime
+	_, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		if u.TOTPEnabled {
+			return errMFAEnabled
+		}
+		if u.TOTPSecret == "" {
+			return errMFANotEnrolled
+		}
+
+		step, ok := auth.ValidateTOTP(u.TOTPSecret, params.Code, time.Now(), u.TOTPLastCounter)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+
+		u.TOTPEnabled = true
+		u.TOTPLastCounter = step
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	switch {
+	case errors.Is(err, errMFAEnabled):
+		respondWithError(w, 409, "Two-factor authentication is already enabled")
+		return
+	case errors.Is(err, errMFANotEnrolled):
+		respondWithError(w, 400, "Start enrollment first")
+		return
+	case errors.Is(err, errInvalidSecondFactor):
+		respondWithError(w, 400, "Invalid code")
+		return
+	case err != nil:
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type confirmResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	respondWithJSON(w, 200, confirmResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+func (cfg *apiConfig) PostMFADisableHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Code is required")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if !user.TOTPEnabled {
+		respondWithError(w, 409, "Two-factor authentication is not enabled")
+		return
+	}
+
+	if !cfg.verifySecondFactor(r.Context(), user, params.Code, params.RecoveryCode) {
+		respondWithError(w, 403, "Invalid code")
+		return
+	}
+
+	_, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPLastCounter = 0
+		u.RecoveryCodes = nil
+		return nil
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// totpCode is what an authenticator app shows for secret at t
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+// enableTestMFA enrolls and confirms two-factor authentication for the
+// user token belongs to, returning the secret and recovery codes
+func enableTestMFA(t *testing.T, cfg *apiConfig, token string) (string, []string) {
+	t.Helper()
+
+	var enrolled struct {
+		Secret string `json:"secret"`
+	}
+	status := serveJSON(t, cfg.PostMFAEnrollHandler, http.MethodPost, "/api/users/2fa/enroll", token, nil, &enrolled)
+	if status != 200 {
+		t.Fatalf("enroll status = %d, want 200", status)
+	}
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status = serveJSON(t, cfg.PostMFAConfirmHandler, http.MethodPost, "/api/users/2fa/confirm", token, map[string]string{
+		"code": totpCode(t, enrolled.Secret, time.Now()),
+	}, &confirmed)
+	if status != 200 {
+		t.Fatalf("confirm status = %d, want 200", status)
+	}
+	return enrolled.Secret, confirmed.RecoveryCodes
+}
+
+func TestMFAEnrollAndConfirm(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "user@example.com")
+
+	var enrolled struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	status := serveJSON(t, cfg.PostMFAEnrollHandler, http.MethodPost, "/api/users/2fa/enroll", token, nil, &enrolled)
+	if status != 200 {
+		t.Fatalf("enroll status = %d, want 200", status)
+	}
+	if enrolled.Secret == "" || enrolled.OTPAuthURI == "" {
+		t.Fatalf("enroll response = %+v", enrolled)
+	}
+
+	status = serveJSON(t, cfg.PostMFAConfirmHandler, http.MethodPost, "/api/users/2fa/confirm", token, map[string]string{"code": "000000"}, nil)
+	if status != 400 {
+		t.Errorf("wrong code status = %d, want 400", status)
+	}
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.TOTPEnabled || saved.TOTPSecret != enrolled.Secret {
+		t.Fatalf("after a wrong code: enabled %v, want the secret stored but inactive", saved.TOTPEnabled)
+	}
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status = serveJSON(t, cfg.PostMFAConfirmHandler, http.MethodPost, "/api/users/2fa/confirm", token, map[string]string{
+		"code": totpCode(t, enrolled.Secret, time.Now()),
+	}, &confirmed)
+	if status != 200 {
+		t.Fatalf("confirm status = %d, want 200", status)
+	}
+	if len(confirmed.RecoveryCodes) != 10 {
+		t.Errorf("got %d recovery codes, want 10", len(confirmed.RecoveryCodes))
+	}
+
+	saved, err = cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.TOTPEnabled || saved.TOTPLastCounter == 0 || len(saved.RecoveryCodes) != 10 {
+		t.Errorf("saved user = %+v, want two-factor enabled with the code's step used", saved)
+	}
+	if saved.Email != user.Email || !saved.EmailVerified {
+		t.Errorf("saved user = %+v, want only two-factor fields changed", saved)
+	}
+
+	// Enrolling again would replace the active secret
+	status = serveJSON(t, cfg.PostMFAEnrollHandler, http.MethodPost, "/api/users/2fa/enroll", token, nil, nil)
+	if status != 409 {
+		t.Errorf("enroll again status = %d, want 409", status)
+	}
+}
+
+func TestLoginMFA(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "user@example.com")
+	setTestPassword(t, cfg, user, "the password")
+	secret, recoveryCodes := enableTestMFA(t, cfg, token)
+
+	login := func(t *testing.T) string {
+		t.Helper()
+		var challenge struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}
+		status := serveJSON(t, cfg.PostLoginHandler, http.MethodPost, "/api/login", "", map[string]string{
+			"email":    "user@example.com",
+			"password": "the password",
+		}, &challenge)
+		if status != 200 || !challenge.MFARequired || challenge.MFAToken == "" {
+			t.Fatalf("login = %d %+v, want a two-factor challenge", status, challenge)
+		}
+		return challenge.MFAToken
+	}
+	secondFactor := func(t *testing.T, mfaToken, code, recoveryCode string) int {
+		t.Helper()
+		var session struct {
+			Token string `json:"token"`
+		}
+		status := serveJSON(t, cfg.PostLoginMFAHandler, http.MethodPost, "/api/login/2fa", "", map[string]string{
+			"mfa_token":     mfaToken,
+			"code":          code,
+			"recovery_code": recoveryCode,
+		}, &session)
+		if status == 200 && session.Token == "" {
+			t.Error("signed in without a token")
+		}
+		return status
+	}
+
+	if status := secondFactor(t, login(t), "000000", ""); status != 401 {
+		t.Errorf("wrong code status = %d, want 401", status)
+	}
+
+	// The code used to confirm enrollment can't be replayed
+	if status := secondFactor(t, login(t), totpCode(t, secret, time.Now()), ""); status != 401 {
+		t.Errorf("reused confirmation code status = %d, want 401", status)
+	}
+
+	// The next step's code is accepted once, allowing for clock drift
+	next := totpCode(t, secret, time.Now().Add(30*time.Second))
+	if status := secondFactor(t, login(t), next, ""); status != 200 {
+		t.Errorf("next code status = %d, want 200", status)
+	}
+	if status := secondFactor(t, login(t), next, ""); status != 401 {
+		t.Errorf("reused code status = %d, want 401", status)
+	}
+
+	if status := secondFactor(t, login(t), "", recoveryCodes[0]); status != 200 {
+		t.Errorf("recovery code status = %d, want 200", status)
+	}
+	if status := secondFactor(t, login(t), "", recoveryCodes[0]); status != 401 {
+		t.Errorf("reused recovery code status = %d, want 401", status)
+	}
+
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.RecoveryCodes) != len(recoveryCodes)-1 {
+		t.Errorf("%d recovery codes left, want %d", len(saved.RecoveryCodes), len(recoveryCodes)-1)
+	}
+}
+
+func TestMFADisable(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "user@example.com")
+	_, recoveryCodes := enableTestMFA(t, cfg, token)
+
+	status := serveJSON(t, cfg.PostMFADisableHandler, http.MethodPost, "/api/users/2fa/disable", token, map[string]string{"code": "000000"}, nil)
+	if status != 403 {
+		t.Errorf("wrong code status = %d, want 403", status)
+	}
+
+	status = serveJSON(t, cfg.PostMFADisableHandler, http.MethodPost, "/api/users/2fa/disable", token, map[string]string{
+		"recovery_code": recoveryCodes[0],
+	}, nil)
+	if status != 204 {
+		t.Fatalf("status = %d, want 204", status)
+	}
+
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.TOTPEnabled || saved.TOTPSecret != "" || saved.TOTPLastCounter != 0 || len(saved.RecoveryCodes) != 0 {
+		t.Errorf("saved user = %+v, want two-factor cleared", saved)
+	}
+}
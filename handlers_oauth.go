@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// authCode is the state behind an authorization code until the client
+// redeems it at the token endpoint
+type authCode struct {
+	userId        int
+	clientId      string
+	redirectURI   string
+	scopes        []string
+	codeChallenge string
+}
+
+// authorizeRequest holds the parameters of an authorization request, shared
+// by the redirect endpoint and the consent screen's API call
+type authorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientId            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// validRedirectURI accepts absolute https URIs, or http on the loopback
+// interface for native and development apps
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	host := u.Hostname()
+	return u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1")
+}
+
+// redirectWithParams appends params to a registered redirect URI
+func redirectWithParams(redirectURI string, params url.Values) string {
+	u, _ := url.Parse(redirectURI)
+	query := u.Query()
+	for key, values := range params {
+		for _, value := range values {
+			if value != "" {
+				query.Add(key, value)
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// checkAuthorizeRequest validates the client and redirect URI, which must
+// be trusted before any error can be sent to the redirect URI, and then the
+// rest of the request. It returns the client, the requested scopes and an
+// OAuth error code for errors that should go back to the client.
+func (cfg *apiConfig) checkAuthorizeRequest(ctx context.Context, req authorizeRequest) (database.OAuthClient, []string, string, bool) {
+	client, err := cfg.db.WithContext(ctx).GetOAuthClient(req.ClientId)
+	if err != nil || !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return database.OAuthClient{}, nil, "", false
+	}
+
+	if req.ResponseType != "code" {
+		return client, nil, "unsupported_response_type", true
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return client, nil, "invalid_request", true
+	}
+
+	scopes, err := auth.ParseScopes(req.Scope)
+	if err != nil || len(scopes) == 0 {
+		return client, nil, "invalid_scope", true
+	}
+
+	return client, scopes, "", true
+}
+
+func (cfg *apiConfig) GetOAuthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := authorizeRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientId:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+
+	_, _, oauthErr, trusted := cfg.checkAuthorizeRequest(r.Context(), req)
+	if !trusted {
+		respondWithError(w, 400, "Unknown client or redirect_uri")
+		return
+	}
+	if oauthErr != "" {
+		http.Redirect(w, r, redirectWithParams(req.RedirectURI, url.Values{
+			"error": {oauthErr},
+			"state": {req.State},
+		}), http.StatusFound)
+		return
+	}
+
+	// The consent screen signs the user in and calls PostOAuthAuthorizeHandler
+	http.Redirect(w, r, "/app/oauth/consent.html?"+query.Encode(), http.StatusFound)
+}
+
+func (cfg *apiConfig) PostOAuthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		authorizeRequest
+		Approve bool `json:"approve"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	client, scopes, oauthErr, trusted := cfg.checkAuthorizeRequest(r.Context(), params.authorizeRequest)
+	if !trusted {
+		respondWithError(w, 400, "Unknown client or redirect_uri")
+		return
+	}
+
+	type authorizeResponse struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+
+	if oauthErr == "" && !params.Approve {
+		oauthErr = "access_denied"
+	}
+	if oauthErr != "" {
+		respondWithJSON(w, 200, authorizeResponse{
+			RedirectTo: redirectWithParams(params.RedirectURI, url.Values{
+				"error": {oauthErr},
+				"state": {params.State},
+			}),
+		})
+		return
+	}
+
+	_, err = db.SaveOAuthGrant(user.Id, client.Id, scopes)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	code, err := cfg.authCodes.start(authCode{
+		userId:        user.Id,
+		clientId:      client.Id,
+		redirectURI:   params.RedirectURI,
+		scopes:        scopes,
+		codeChallenge: params.CodeChallenge,
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, 200, authorizeResponse{
+		RedirectTo: redirectWithParams(params.RedirectURI, url.Values{
+			"code":  {code},
+			"state": {params.State},
+		}),
+	})
+}
+
+// respondWithOAuthError writes an RFC 6749 token endpoint error
+func respondWithOAuthError(w http.ResponseWriter, code int, oauthErr, description string) {
+	type errorResponse struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, errorResponse{
+		Error:            oauthErr,
+		ErrorDescription: description,
+	})
+}
+
+// authenticateClient checks the client credentials sent to the token
+// endpoint. Public clients only identify themselves.
+func (cfg *apiConfig) authenticateClient(r *http.Request) (database.OAuthClient, bool) {
+	clientId, secret, ok := r.BasicAuth()
+	if ok {
+		clientId, _ = url.QueryUnescape(clientId)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientId = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := cfg.db.WithContext(r.Context()).GetOAuthClient(clientId)
+	if err != nil {
+		return database.OAuthClient{}, false
+	}
+
+	if client.Confidential {
+		hash := auth.HashOpaqueToken(secret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(client.SecretHash)) != 1 {
+			return database.OAuthClient{}, false
+		}
+	}
+
+	return client, true
+}
+
+func (cfg *apiConfig) PostOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "")
+		return
+	}
+
+	client, ok := cfg.authenticateClient(r)
+	if !ok {
+		respondWithOAuthError(w, 401, "invalid_client", "")
+		return
+	}
+
+	var userId int
+	var scopes []string
+	var refreshToken string
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := cfg.authCodes.finish(r.PostForm.Get("code"))
+		if err != nil || code.clientId != client.Id || code.redirectURI != r.PostForm.Get("redirect_uri") {
+			respondWithOAuthError(w, 400, "invalid_grant", "")
+			return
+		}
+
+		verifier := r.PostForm.Get("code_verifier")
+		if subtle.ConstantTimeCompare([]byte(auth.PKCEChallenge(verifier)), []byte(code.codeChallenge)) != 1 {
+			respondWithOAuthError(w, 400, "invalid_grant", "PKCE verification failed")
+			return
+		}
+
+		userId = code.userId
+		scopes = code.scopes
+
+	case "refresh_token":
+		refreshToken = r.PostForm.Get("refresh_token")
+		user, claims, err := cfg.loadTokenUser(r.Context(), refreshToken, auth.TokenRefresh)
+		if err != nil || claims.ClientID != client.Id || cfg.checkGrant(r.Context(), user.Id, claims) != nil {
+			respondWithOAuthError(w, 400, "invalid_grant", "")
+			return
+		}
+
+		revokedTokens, err := cfg.db.WithContext(r.Context()).GetRevokedTokens()
+		if err != nil {
+			recordRequestError(r, err)
+			respondWithOAuthError(w, 500, "server_error", "")
+			return
+		}
+		if _, ok := revokedTokens[refreshToken]; ok {
+			respondWithOAuthError(w, 400, "invalid_grant", "")
+			return
+		}
+
+		userId = user.Id
+		scopes = strings.Fields(claims.Scope)
+
+	default:
+		respondWithOAuthError(w, 400, "unsupported_grant_type", "")
+		return
+	}
+
+	subject := strconv.Itoa(userId)
+	accessToken, err := cfg.tokens.IssueForClient(auth.TokenAccess, subject, client.Id, scopes)
+	if err != nil {
+		recordRequestError(r, err)
+		respondWithOAuthError(w, 500, "server_error", "")
+		return
+	}
+	if refreshToken == "" {
+		refreshToken, err = cfg.tokens.IssueForClient(auth.TokenRefresh, subject, client.Id, scopes)
+		if err != nil {
+			recordRequestError(r, err)
+			respondWithOAuthError(w, 500, "server_error", "")
+			return
+		}
+	}
+
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, 200, tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(cfg.tokens.Policy().AccessTTL / time.Second),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
+
+// PostOAuthRevokeHandler lets a client revoke a refresh token it was
+// issued (RFC 7009). Tokens that are invalid or belong to another client
+// are ignored, so the response doesn't say which tokens exist.
+func (cfg *apiConfig) PostOAuthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("token") == "" {
+		respondWithOAuthError(w, 400, "invalid_request", "")
+		return
+	}
+
+	client, ok := cfg.authenticateClient(r)
+	if !ok {
+		respondWithOAuthError(w, 401, "invalid_client", "")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	_, claims, err := cfg.tokens.Parse(token, auth.TokenRefresh)
+	if err != nil {
+		// Access tokens are short lived and can't be revoked one by one
+		_, claims, err = cfg.tokens.Parse(token, auth.TokenAccess)
+		if err == nil && claims.ClientID == client.Id {
+			respondWithOAuthError(w, 400, "unsupported_token_type", "")
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+
+	if claims.ClientID == client.Id {
+		err = cfg.db.WithContext(r.Context()).UpdateRevokedTokens(token)
+		if err != nil {
+			recordRequestError(r, err)
+			respondWithOAuthError(w, 500, "server_error", "")
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+type oauthClientResponse struct {
+	ClientId     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newOAuthClientResponse(client database.OAuthClient) oauthClientResponse {
+	return oauthClientResponse{
+		ClientId:     client.Id,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Confidential: client.Confidential,
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+func (cfg *apiConfig) PostOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if params.Name == "" || len(params.RedirectURIs) == 0 {
+		respondWithError(w, 400, "Name and at least one redirect URI are required")
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondWithError(w, 400, "Invalid redirect URI: "+uri)
+			return
+		}
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	var secret, secretHash string
+	if params.Confidential {
+		secret, secretHash, err = auth.MakeOpaqueToken()
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+	}
+
+	client, err := db.CreateOAuthClient(database.OAuthClient{
+		Id:           hex.EncodeToString(id),
+		SecretHash:   secretHash,
+		OwnerId:      user.Id,
+		Name:         params.Name,
+		RedirectURIs: params.RedirectURIs,
+		Confidential: params.Confidential,
+		CreatedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// The secret is only ever shown here
+	response := newOAuthClientResponse(client)
+	response.ClientSecret = secret
+	respondWithJSON(w, 201, response)
+}
+
+func (cfg *apiConfig) GetOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	clients, err := db.GetOAuthClients(user.Id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	response := make([]oauthClientResponse, 0, len(clients))
+	for _, client := range clients {
+		response = append(response, newOAuthClientResponse(client))
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+// GetOAuthClientHandler returns the public details of an app, for the
+// consent screen
+func (cfg *apiConfig) GetOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := cfg.db.WithContext(r.Context()).GetOAuthClient(r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, 404, "Client not found")
+		return
+	}
+
+	type publicClientResponse struct {
+		ClientId string `json:"client_id"`
+		Name     string `json:"name"`
+	}
+
+	respondWithJSON(w, 200, publicClientResponse{
+		ClientId: client.Id,
+		Name:     client.Name,
+	})
+}
+
+func (cfg *apiConfig) DeleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).DeleteOAuthClient(user.Id, r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, 404, "Client not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) GetOAuthAuthorizationsHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	grants, err := db.GetOAuthGrants(user.Id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type authorizationResponse struct {
+		ClientId     string    `json:"client_id"`
+		Name         string    `json:"name"`
+		Scopes       []string  `json:"scopes"`
+		AuthorizedAt time.Time `json:"authorized_at"`
+	}
+
+	response := make([]authorizationResponse, 0, len(grants))
+	for _, grant := range grants {
+		client, err := db.GetOAuthClient(grant.ClientId)
+		if err != nil {
+			continue
+		}
+		response = append(response, authorizationResponse{
+			ClientId:     client.Id,
+			Name:         client.Name,
+			Scopes:       grant.Scopes,
+			AuthorizedAt: grant.AuthorizedAt,
+		})
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) DeleteOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).DeleteOAuthGrant(user.Id, r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, 404, "Authorization not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// serveForm posts form to handler as a public client would
+func serveForm(handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/oauth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestOAuthRevokeRefreshToken(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "revoke@example.com")
+	for _, id := range []string{"app", "other"} {
+		_, err := cfg.db.CreateOAuthClient(database.OAuthClient{Id: id, Name: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cfg.db.SaveOAuthGrant(user.Id, id, []string{auth.ScopeChirpsRead})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subject := strconv.Itoa(user.Id)
+	refreshToken, err := cfg.tokens.IssueForClient(auth.TokenRefresh, subject, "app", []string{auth.ScopeChirpsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := cfg.tokens.IssueForClient(auth.TokenAccess, subject, "app", []string{auth.ScopeChirpsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}, "client_id": {"app"}}
+
+	// Another client can't revoke the token, and isn't told it exists
+	rec := serveForm(cfg.PostOAuthRevokeHandler, url.Values{"token": {refreshToken}, "client_id": {"other"}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("revoke by another client: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	rec = serveForm(cfg.PostOAuthTokenHandler, refresh)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serveForm(cfg.PostOAuthRevokeHandler, url.Values{"token": {accessToken}, "client_id": {"app"}})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "unsupported_token_type") {
+		t.Errorf("revoke access token: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serveForm(cfg.PostOAuthRevokeHandler, url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}, "client_id": {"app"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveForm(cfg.PostOAuthTokenHandler, refresh)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("refresh with a revoked token: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// Revoking a token that is already revoked, or was never valid, succeeds
+	for _, token := range []string{refreshToken, "not-a-token"} {
+		rec = serveForm(cfg.PostOAuthRevokeHandler, url.Values{"token": {token}, "client_id": {"app"}})
+		if rec.Code != http.StatusOK {
+			t.Errorf("revoke %q: got status %d, want %d", token, rec.Code, http.StatusOK)
+		}
+	}
+
+	rec = serveForm(cfg.PostOAuthRevokeHandler, url.Values{"token": {refreshToken}, "client_id": {"unknown"}})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoke by an unknown client: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
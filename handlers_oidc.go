@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// oidcFlow is the state kept between redirecting to a provider and the
+// provider redirecting back
+type oidcFlow struct {
+	provider     string
+	nonce        string
+	codeVerifier string
+	browserHash  string
+}
+
+// oidcFlowTTL is how long a user has to sign in with the provider
+const oidcFlowTTL = 10 * time.Minute
+
+// oidcBrowserCookie ties a sign in to the browser that started it, so an
+// attacker can't complete their own sign in in someone else's browser
+const oidcBrowserCookie = "chirpy_oidc"
+
+var errUnverifiedAccount = errors.New("an unverified account already uses this email")
+
+func (cfg *apiConfig) GetOIDCStartHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, 404, "Unknown provider")
+		return
+	}
+
+	nonce, _, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	verifier, challenge, err := auth.NewPKCE()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	browser, browserHash, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	state, err := cfg.oidcFlows.start(oidcFlow{
+		provider:     provider.Name(),
+		nonce:        nonce,
+		codeVerifier: verifier,
+		browserHash:  browserHash,
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc provider", "provider", provider.Name(), "error", err)
+		respondWithError(w, 502, "Provider unavailable")
+		return
+	}
+
+	// Lax still sends the cookie on the provider's top-level redirect back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcBrowserCookie,
+		Value:    browser,
+		Path:     "/api/oauth/",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (cfg *apiConfig) GetOIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, 404, "Unknown provider")
+		return
+	}
+
+	query := r.URL.Query()
+	flow, err := cfg.oidcFlows.finish(query.Get("state"))
+	if err != nil || flow.provider != provider.Name() {
+		respondWithError(w, 400, "Unknown or expired sign in")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcBrowserCookie,
+		Path:     "/api/oauth/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	browser, err := r.Cookie(oidcBrowserCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(auth.HashOpaqueToken(browser.Value)), []byte(flow.browserHash)) != 1 {
+		respondWithError(w, 400, "Sign in was started in a different browser")
+		return
+	}
+
+	if query.Get("error") != "" {
+		respondWithError(w, 401, "Sign in was cancelled")
+		return
+	}
+
+	idToken, err := provider.Exchange(r.Context(), query.Get("code"), flow.codeVerifier)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc provider", "provider", provider.Name(), "error", err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	claims, err := provider.VerifyIDToken(r.Context(), idToken, flow.nonce)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc provider", "provider", provider.Name(), "error", err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.userForIdentity(r.Context(), provider.Name(), claims)
+	if errors.Is(err, errUnverifiedAccount) {
+		respondWithError(w, 409, "Verify your email or sign in with your password first")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if user.TOTPEnabled {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
+
+	cfg.respondWithSession(w, user)
+}
+
+// userForIdentity finds the user linked to an external identity. Unknown
+// identities are linked by verified email to an existing user, or get a
+// new user if nobody has the email yet.
+func (cfg *apiConfig) userForIdentity(ctx context.Context, provider string, claims auth.IDTokenClaims) (database.User, error) {
+	db := cfg.db.WithContext(ctx)
+
+	identity, err := db.GetIdentity(provider, claims.Subject)
+	if err == nil {
+		return db.GetUser(identity.UserId)
+	}
+
+	claims.Email = normalizeEmail(claims.Email)
+	if !claims.EmailVerified || !validEmail(claims.Email) {
+		return database.User{}, errors.New("provider did not supply a verified email")
+	}
+
+	user, err := db.GetUserByEmail(claims.Email)
+	if err == nil {
+		// Linking to an account whose email was never proven would let
+		// whoever registered it take over the provider's account
+		if !user.EmailVerified {
+			return database.User{}, errUnverifiedAccount
+		}
+	} else {
+		// Users created this way have no password until they reset one
+		user, err = db.CreateUser(claims.Email, "")
+		if err != nil {
+			return database.User{}, err
+		}
+		user, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+			u.EmailVerified = true
+			return nil
+		})
+		if err != nil {
+			return database.User{}, err
+		}
+		cfg.emitEvent(ctx, eventUserCreated, user.Id, userEventData{Id: user.Id, Email: user.Email})
+	}
+
+	_, err = db.LinkIdentity(provider, claims.Subject, user.Id, claims.Email)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/auth/oidctest"
+)
+
+// newOIDCTestServer serves the OIDC routes of cfg with a provider called
+// "test" backed by mock
+func newOIDCTestServer(t *testing.T, cfg *apiConfig, mock *oidctest.Provider) *http.ServeMux {
+	t.Helper()
+
+	provider, err := auth.NewOIDCProvider(auth.OIDCConfig{
+		Name:         "test",
+		IssuerURL:    mock.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://localhost:8080/api/oauth/test/callback",
+	}, mock.Server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.oidcProviders = map[string]*auth.OIDCProvider{"test": provider}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oauth/{provider}/start", cfg.GetOIDCStartHandler)
+	mux.HandleFunc("GET /api/oauth/{provider}/callback", cfg.GetOIDCCallbackHandler)
+	return mux
+}
+
+// startOIDCSignIn starts a sign in and lets the provider sign the user in.
+// It returns the callback URL the provider redirected to and the cookie the
+// start handler set.
+func startOIDCSignIn(t *testing.T, mux *http.ServeMux, mock *oidctest.Provider) (string, *http.Cookie) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/oauth/test/start", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("start: got status %d", rec.Code)
+	}
+
+	var browser *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcBrowserCookie {
+			browser = cookie
+		}
+	}
+	if browser == nil || !browser.HttpOnly || browser.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("start: got cookie %+v, want an HttpOnly SameSite=Lax %s cookie", browser, oidcBrowserCookie)
+	}
+
+	client := mock.Server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	res, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d", res.StatusCode)
+	}
+
+	return res.Header.Get("Location"), browser
+}
+
+func finishOIDCSignIn(mux *http.ServeMux, callbackURL string, browser *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", callbackURL, nil)
+	if browser != nil {
+		req.AddCookie(browser)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOIDCSignInCreatesVerifiedUser(t *testing.T) {
+	cfg := newTestConfig(t)
+	mock := oidctest.NewProvider(t)
+	mux := newOIDCTestServer(t, cfg, mock)
+
+	callbackURL, browser := startOIDCSignIn(t, mux, mock)
+	rec := finishOIDCSignIn(mux, callbackURL, browser)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	user, err := cfg.db.GetUserByEmail(mock.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Error("user signed in with a verified provider email is not verified")
+	}
+	identity, err := cfg.db.GetIdentity("test", mock.Subject)
+	if err != nil || identity.UserId != user.Id {
+		t.Errorf("identity was not linked to user %d: %+v, %v", user.Id, identity, err)
+	}
+}
+
+func TestOIDCCallbackRequiresStartingBrowser(t *testing.T) {
+	cfg := newTestConfig(t)
+	mock := oidctest.NewProvider(t)
+	mux := newOIDCTestServer(t, cfg, mock)
+
+	// An attacker starts a sign in and hands the callback URL to a victim,
+	// whose browser has no cookie, or the cookie of another sign in
+	callbackURL, _ := startOIDCSignIn(t, mux, mock)
+	rec := finishOIDCSignIn(mux, callbackURL, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("without cookie: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	callbackURL, _ = startOIDCSignIn(t, mux, mock)
+	_, otherBrowser := startOIDCSignIn(t, mux, mock)
+	rec = finishOIDCSignIn(mux, callbackURL, otherBrowser)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("with another sign in's cookie: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCCallbackRejectsReplayedState(t *testing.T) {
+	cfg := newTestConfig(t)
+	mock := oidctest.NewProvider(t)
+	mux := newOIDCTestServer(t, cfg, mock)
+
+	callbackURL, browser := startOIDCSignIn(t, mux, mock)
+	rec := finishOIDCSignIn(mux, callbackURL, browser)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = finishOIDCSignIn(mux, callbackURL, browser)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCSignInDoesNotLinkUnverifiedAccount(t *testing.T) {
+	cfg := newTestConfig(t)
+	mock := oidctest.NewProvider(t)
+	mux := newOIDCTestServer(t, cfg, mock)
+
+	// Someone registered the victim's email with a password but never
+	// proved they own it
+	_, err := cfg.db.CreateUser(mock.Email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callbackURL, browser := startOIDCSignIn(t, mux, mock)
+	rec := finishOIDCSignIn(mux, callbackURL, browser)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// passkeyUser adapts a user and their passkeys to webauthn.User
+type passkeyUser struct {
+	user     database.User
+	passkeys []database.Passkey
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.Id))
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Email
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, passkey := range u.passkeys {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(passkey.Transports))
+		for _, transport := range passkey.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              passkey.CredentialId,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    passkey.UserPresent,
+				UserVerified:   passkey.UserVerified,
+				BackupEligible: passkey.BackupEligible,
+				BackupState:    passkey.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+// loadPasskeyUser loads a user together with their registered passkeys
+func (cfg *apiConfig) loadPasskeyUser(ctx context.Context, user database.User) (passkeyUser, error) {
+	passkeys, err := cfg.db.WithContext(ctx).GetPasskeys(user.Id)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+	return passkeyUser{user: user, passkeys: passkeys}, nil
+}
+
+// ceremony is the state kept between the begin and finish requests of a
+// WebAuthn ceremony
+type ceremony struct {
+	userId  int
+	session webauthn.SessionData
+}
+
+type passkeyResponse struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func newPasskeyResponse(passkey database.Passkey) passkeyResponse {
+	return passkeyResponse{
+		Id:         base64.RawURLEncoding.EncodeToString(passkey.CredentialId),
+		Name:       passkey.Name,
+		CreatedAt:  passkey.CreatedAt,
+		LastUsedAt: passkey.LastUsedAt,
+	}
+}
+
+func (cfg *apiConfig) PostPasskeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	pkUser, err := cfg.loadPasskeyUser(r.Context(), user)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(pkUser.passkeys))
+	for _, credential := range pkUser.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := cfg.webauthn.BeginRegistration(pkUser,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	sessionId, err := cfg.ceremonies.start(ceremony{userId: user.Id, session: *session})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type beginResponse struct {
+		SessionId string                       `json:"session_id"`
+		Options   *protocol.CredentialCreation `json:"options"`
+	}
+
+	respondWithJSON(w, 200, beginResponse{
+		SessionId: sessionId,
+		Options:   options,
+	})
+}
+
+func (cfg *apiConfig) PostPasskeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		SessionId  string          `json:"session_id"`
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	c, err := cfg.ceremonies.finish(params.SessionId)
+	if err != nil || c.userId != user.Id {
+		respondWithError(w, 400, "Unknown or expired registration")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(params.Credential)
+	if err != nil {
+		respondWithError(w, 400, "Invalid credential")
+		return
+	}
+
+	pkUser, err := cfg.loadPasskeyUser(r.Context(), user)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	credential, err := cfg.webauthn.CreateCredential(pkUser, c.session, parsed)
+	if err != nil {
+		respondWithError(w, 400, "Invalid credential")
+		return
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	name := params.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	passkey, err := db.CreatePasskey(database.Passkey{
+		CredentialId:    credential.ID,
+		UserId:          user.Id,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserPresent:     credential.Flags.UserPresent,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		CreatedAt:       time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, 409, "Passkey is already registered")
+		return
+	}
+
+	respondWithJSON(w, 201, newPasskeyResponse(passkey))
+}
+
+func (cfg *apiConfig) GetPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	passkeys, err := db.GetPasskeys(user.Id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	response := make([]passkeyResponse, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		response = append(response, newPasskeyResponse(passkey))
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	credentialId, err := base64.RawURLEncoding.DecodeString(r.PathValue("passkeyID"))
+	if err != nil {
+		respondWithError(w, 404, "Passkey not found")
+		return
+	}
+
+	err = db.DeletePasskey(user.Id, credentialId)
+	if err != nil {
+		respondWithError(w, 404, "Passkey not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) PostPasskeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	options, session, err := cfg.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	sessionId, err := cfg.ceremonies.start(ceremony{session: *session})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	type beginResponse struct {
+		SessionId string                        `json:"session_id"`
+		Options   *protocol.CredentialAssertion `json:"options"`
+	}
+
+	respondWithJSON(w, 200, beginResponse{
+		SessionId: sessionId,
+		Options:   options,
+	})
+}
+
+func (cfg *apiConfig) PostPasskeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		SessionId  string          `json:"session_id"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	c, err := cfg.ceremonies.finish(params.SessionId)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(params.Credential)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	// The authenticator tells us who is signing in through the user handle
+	findUser := func(rawId, userHandle []byte) (webauthn.User, error) {
+		id, err := strconv.Atoi(string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		user, err := db.GetUser(id)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.loadPasskeyUser(r.Context(), user)
+	}
+
+	found, credential, err := cfg.webauthn.ValidatePasskeyLogin(findUser, c.session, parsed)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	// A sign counter that didn't move forward suggests a cloned authenticator
+	if credential.Authenticator.CloneWarning {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	pkUser := found.(passkeyUser)
+	for _, passkey := range pkUser.passkeys {
+		if !bytes.Equal(passkey.CredentialId, credential.ID) {
+			continue
+		}
+		passkey.SignCount = credential.Authenticator.SignCount
+		passkey.BackupState = credential.Flags.BackupState
+		passkey.LastUsedAt = time.Now().UTC()
+		_, err = db.UpdatePasskey(passkey)
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+	}
+
+	cfg.respondWithSession(w, pkUser.user)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// softAuthenticator is a platform authenticator in software. It holds one
+// discoverable ES256 credential and answers ceremonies with "none"
+// attestation, the way a browser would relay them.
+type softAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	_, err = rand.Read(credentialId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{t: t, key: key, credentialId: credentialId}
+}
+
+type clientData struct {
+	Type      string                    `json:"type"`
+	Challenge protocol.URLEncodedBase64 `json:"challenge"`
+	Origin    string                    `json:"origin"`
+}
+
+// authenticatorData builds the data the authenticator signs over. Flags are
+// user present and user verified, plus attested credential data if
+// attestedCredential is not nil.
+func (a *softAuthenticator) authenticatorData(attestedCredential []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte("localhost"))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attestedCredential != nil {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attestedCredential...)
+}
+
+// create answers a registration ceremony
+func (a *softAuthenticator) create(options protocol.CredentialCreation) map[string]any {
+	a.t.Helper()
+
+	// The user ID arrives base64url encoded, as a browser would see it
+	userId, _ := options.Response.User.ID.(string)
+	userHandle, err := base64.RawURLEncoding.DecodeString(userId)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, publicKey...)
+
+	attestationObject, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    a.clientDataJSON("webauthn.create", options.Response.Challenge),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+			"transports":        []string{"internal"},
+		},
+	}
+}
+
+// get answers a discoverable login ceremony
+func (a *softAuthenticator) get(options protocol.CredentialAssertion) map[string]any {
+	a.t.Helper()
+
+	a.signCount++
+	authData := a.authenticatorData(nil)
+	clientDataJSON := a.clientDataJSON("webauthn.get", options.Response.Challenge)
+
+	rawClientData, err := base64.RawURLEncoding.DecodeString(clientDataJSON)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    clientDataJSON,
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+func (a *softAuthenticator) clientDataJSON(ceremonyType string, challenge protocol.URLEncodedBase64) string {
+	a.t.Helper()
+
+	data, err := json.Marshal(clientData{Type: ceremonyType, Challenge: challenge, Origin: testOrigin})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// registerPasskey runs a registration ceremony for the user token belongs to
+func registerPasskey(t *testing.T, cfg *apiConfig, token string, authenticator *softAuthenticator) passkeyResponse {
+	t.Helper()
+
+	var begin struct {
+		SessionId string                      `json:"session_id"`
+		Options   protocol.CredentialCreation `json:"options"`
+	}
+	code := serveJSON(t, cfg.PostPasskeyRegisterBeginHandler, "POST", "/api/users/passkeys/register/begin", token, nil, &begin)
+	if code != http.StatusOK {
+		t.Fatalf("register begin: got status %d", code)
+	}
+
+	var passkey passkeyResponse
+	code = serveJSON(t, cfg.PostPasskeyRegisterFinishHandler, "POST", "/api/users/passkeys/register/finish", token, map[string]any{
+		"session_id": begin.SessionId,
+		"name":       "Laptop",
+		"credential": authenticator.create(begin.Options),
+	}, &passkey)
+	if code != http.StatusCreated {
+		t.Fatalf("register finish: got status %d", code)
+	}
+	return passkey
+}
+
+// beginPasskeyLogin starts a discoverable login ceremony
+func beginPasskeyLogin(t *testing.T, cfg *apiConfig) (string, protocol.CredentialAssertion) {
+	t.Helper()
+
+	var begin struct {
+		SessionId string                       `json:"session_id"`
+		Options   protocol.CredentialAssertion `json:"options"`
+	}
+	code := serveJSON(t, cfg.PostPasskeyLoginBeginHandler, "POST", "/api/login/passkey/begin", "", nil, &begin)
+	if code != http.StatusOK {
+		t.Fatalf("login begin: got status %d", code)
+	}
+	return begin.SessionId, begin.Options
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, token := createTestUser(t, cfg, "passkey@example.com")
+	authenticator := newSoftAuthenticator(t)
+
+	passkey := registerPasskey(t, cfg, token, authenticator)
+	if passkey.Name != "Laptop" {
+		t.Errorf("got passkey name %q, want %q", passkey.Name, "Laptop")
+	}
+
+	sessionId, options := beginPasskeyLogin(t, cfg)
+	var session struct {
+		Id    int    `json:"id"`
+		Token string `json:"token"`
+	}
+	code := serveJSON(t, cfg.PostPasskeyLoginFinishHandler, "POST", "/api/login/passkey/finish", "", map[string]any{
+		"session_id": sessionId,
+		"credential": authenticator.get(options),
+	}, &session)
+	if code != http.StatusOK {
+		t.Fatalf("login finish: got status %d", code)
+	}
+	if session.Id != user.Id || session.Token == "" {
+		t.Errorf("got session for user %d, want a token for user %d", session.Id, user.Id)
+	}
+
+	stored, err := cfg.db.GetPasskeys(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].SignCount != authenticator.signCount {
+		t.Errorf("stored sign count was not updated: %+v", stored)
+	}
+}
+
+func TestPasskeyLoginRejectsReplayedSession(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, token := createTestUser(t, cfg, "passkey@example.com")
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, cfg, token, authenticator)
+
+	sessionId, options := beginPasskeyLogin(t, cfg)
+	body := map[string]any{
+		"session_id": sessionId,
+		"credential": authenticator.get(options),
+	}
+
+	code := serveJSON(t, cfg.PostPasskeyLoginFinishHandler, "POST", "/api/login/passkey/finish", "", body, nil)
+	if code != http.StatusOK {
+		t.Fatalf("first login: got status %d", code)
+	}
+	code = serveJSON(t, cfg.PostPasskeyLoginFinishHandler, "POST", "/api/login/passkey/finish", "", body, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("replayed login: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestPasskeyLoginRejectsClonedAuthenticator(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, token := createTestUser(t, cfg, "passkey@example.com")
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, cfg, token, authenticator)
+
+	sessionId, options := beginPasskeyLogin(t, cfg)
+	code := serveJSON(t, cfg.PostPasskeyLoginFinishHandler, "POST", "/api/login/passkey/finish", "", map[string]any{
+		"session_id": sessionId,
+		"credential": authenticator.get(options),
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("first login: got status %d", code)
+	}
+
+	// A copy of the key that didn't see the last sign in reuses its counter
+	authenticator.signCount--
+	sessionId, options = beginPasskeyLogin(t, cfg)
+	code = serveJSON(t, cfg.PostPasskeyLoginFinishHandler, "POST", "/api/login/passkey/finish", "", map[string]any{
+		"session_id": sessionId,
+		"credential": authenticator.get(options),
+	}, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("cloned authenticator: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestPasskeyRegisterRejectsWrongChallenge(t *testing.T) {
+	cfg := newTestConfig(t)
+	_, token := createTestUser(t, cfg, "passkey@example.com")
+	authenticator := newSoftAuthenticator(t)
+
+	var begin struct {
+		SessionId string                      `json:"session_id"`
+		Options   protocol.CredentialCreation `json:"options"`
+	}
+	code := serveJSON(t, cfg.PostPasskeyRegisterBeginHandler, "POST", "/api/users/passkeys/register/begin", token, nil, &begin)
+	if code != http.StatusOK {
+		t.Fatalf("register begin: got status %d", code)
+	}
+
+	begin.Options.Response.Challenge = protocol.URLEncodedBase64("not the challenge")
+	code = serveJSON(t, cfg.PostPasskeyRegisterFinishHandler, "POST", "/api/users/passkeys/register/finish", token, map[string]any{
+		"session_id": begin.SessionId,
+		"credential": authenticator.create(begin.Options),
+	}, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+)
+
+func (cfg *apiConfig) PostPasswordForgotHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Email == "" {
+		respondWithError(w, 400, "Email is required")
+		return
+	}
+
+	if wait := cfg.passwordResetIPs.allow(clientIP(r), cfg.passwordResetLimit); wait > 0 {
+		respondWithRateLimit(w, wait)
+		return
+	}
+
+	// Look the email up and write the reset in the background, so the
+	// response is the same, and takes as long, whether or not the email
+	// has an account
+	ctx := context.WithoutCancel(r.Context())
+	cfg.goBackground(func() {
+		err := cfg.sendPasswordReset(ctx, normalizeEmail(params.Email))
+		if err != nil {
+			slog.ErrorContext(ctx, "password reset", "error", err)
+		}
+	})
+
+	respondWithJSON(w, 202, "")
+}
+
+// sendPasswordReset mails a reset token to email if it has an account
+func (cfg *apiConfig) sendPasswordReset(ctx context.Context, email string) error {
+	db := cfg.db.WithContext(ctx)
+
+	// Unknown emails get nothing
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return nil
+	}
+
+	token, tokenHash, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.CreatePasswordReset(user.Id, tokenHash, time.Now().UTC().Add(cfg.passwordResetTTL))
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\n"+
+			"Your reset token is: %s\n\n"+
+			"It expires in %s and can only be used once. If this wasn't you, you can ignore this email.\n",
+			token, cfg.passwordResetTTL),
+	})
+}
+
+func (cfg *apiConfig) PostPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Token == "" || params.Password == "" {
+		respondWithError(w, 400, "Token and password are required")
+		return
+	}
+
+	// The password is checked before the token is used up, so a rejected
+	// password doesn't cost the user their reset link
+	tokenHash := auth.HashOpaqueToken(params.Token)
+	reset, err := db.GetPasswordReset(tokenHash)
+	if err != nil {
+		respondWithError(w, 400, "Invalid or expired reset token")
+		return
+	}
+
+	user, err := db.GetUser(reset.UserId)
+	if err != nil {
+		respondWithError(w, 400, "Invalid or expired reset token")
+		return
+	}
+
+	if problems := cfg.passwordProblems(params.Password, user.Email); len(problems) > 0 {
+		respondWithFieldErrors(w, map[string][]string{"password": problems})
+		return
+	}
+
+	hashedPassword, err := cfg.hashPassword(r.Context(), params.Password)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// Only one request gets to use the token
+	_, err = db.ConsumePasswordReset(tokenHash)
+	if err != nil {
+		respondWithError(w, 400, "Invalid or expired reset token")
+		return
+	}
+
+	_, err = db.UpdateUserFunc(user.Id, func(user *database.User) error {
+		user.Password = hashedPassword
+		user.SessionsRevokedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// Proving ownership of the email lifts any lockout on the account
+	cfg.loginSucceeded(user.Email)
+
+	w.WriteHeader(204)
+}
+
+// passwordProblems checks a new password against the password policy and
+// the breached password list
+func (cfg *apiConfig) passwordProblems(password, email string) []string {
+	problems := cfg.passwordPolicy.Check(password, email)
+	if len(problems) > 0 || cfg.breachList == nil {
+		return problems
+	}
+
+	breached, err := cfg.breachList.Contains(password)
+	if err != nil {
+		slog.Error("breached password check", "error", err)
+		return problems
+	}
+	if breached {
+		problems = append(problems, "has appeared in a data breach, choose another")
+	}
+	return problems
+}
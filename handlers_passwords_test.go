@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+)
+
+func TestPasswordReset(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.passwordPolicy = auth.DefaultPasswordPolicy()
+	user, _ := createTestUser(t, cfg, "user@example.com")
+
+	token, tokenHash, err := auth.MakeOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.CreatePasswordReset(user.Id, tokenHash, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type resetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	// A password the policy rejects leaves the link usable
+	status := serveJSON(t, cfg.PostPasswordResetHandler, http.MethodPost, "/api/password/reset", "", resetRequest{token, "short"}, nil)
+	if status != 400 {
+		t.Fatalf("weak password status = %d, want 400", status)
+	}
+	if _, err := cfg.db.GetPasswordReset(tokenHash); err != nil {
+		t.Fatalf("reset was used up by a rejected password: %v", err)
+	}
+
+	status = serveJSON(t, cfg.PostPasswordResetHandler, http.MethodPost, "/api/password/reset", "", resetRequest{token, "a much longer password"}, nil)
+	if status != 204 {
+		t.Fatalf("status = %d, want 204", status)
+	}
+
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cfg.passwords.Verify(saved.Password, "a much longer password"); !ok {
+		t.Error("password wasn't changed")
+	}
+	if saved.SessionsRevokedAt.IsZero() {
+		t.Error("sessions weren't revoked")
+	}
+
+	// The link only works once
+	status = serveJSON(t, cfg.PostPasswordResetHandler, http.MethodPost, "/api/password/reset", "", resetRequest{token, "another long password"}, nil)
+	if status != 400 {
+		t.Errorf("reused token status = %d, want 400", status)
+	}
+}
+
+func TestPasswordResetUnknownToken(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	status := serveJSON(t, cfg.PostPasswordResetHandler, http.MethodPost, "/api/password/reset", "", map[string]string{
+		"token":    "not-a-token",
+		"password": "a much longer password",
+	}, nil)
+	if status != 400 {
+		t.Errorf("status = %d, want 400", status)
+	}
+}
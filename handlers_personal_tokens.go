@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// Personal access tokens always expire, after a month unless asked otherwise
+const (
+	defaultPersonalTokenDays = 30
+	maxPersonalTokenDays     = 365
+)
+
+type personalTokenResponse struct {
+	Id         string     `json:"id"`
+	Token      string     `json:"token,omitempty"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newPersonalTokenResponse(token database.PersonalToken) personalTokenResponse {
+	response := personalTokenResponse{
+		Id:        token.Id,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+	if !token.LastUsedAt.IsZero() {
+		response.LastUsedAt = &token.LastUsedAt
+	}
+	return response
+}
+
+func (cfg *apiConfig) PostPersonalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	type parameters struct {
+		Name          string `json:"name"`
+		Scope         string `json:"scope"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	// Only a signed in user can mint tokens, never another token
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if params.Name == "" || len(params.Name) > 100 {
+		respondWithError(w, 400, "Name must be between 1 and 100 characters")
+		return
+	}
+
+	scopes, err := auth.ParseScopes(params.Scope)
+	if err != nil || len(scopes) == 0 {
+		respondWithError(w, 400, "Invalid scope")
+		return
+	}
+
+	if params.ExpiresInDays == 0 {
+		params.ExpiresInDays = defaultPersonalTokenDays
+	}
+	if params.ExpiresInDays < 0 || params.ExpiresInDays > maxPersonalTokenDays {
+		respondWithError(w, 400, "Tokens must expire within a year")
+		return
+	}
+
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	tokenString, hash, err := auth.MakePersonalToken()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	token, err := db.CreatePersonalToken(database.PersonalToken{
+		Id:        hex.EncodeToString(id),
+		TokenHash: hash,
+		UserId:    user.Id,
+		Name:      params.Name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, params.ExpiresInDays),
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// The token is only ever shown here
+	response := newPersonalTokenResponse(token)
+	response.Token = tokenString
+	respondWithJSON(w, 201, response)
+}
+
+func (cfg *apiConfig) GetPersonalTokensHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	tokens, err := db.GetPersonalTokens(user.Id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	response := make([]personalTokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		response = append(response, newPersonalTokenResponse(token))
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) DeletePersonalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).DeletePersonalToken(user.Id, r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, 404, "Token not found")
+		return
+	}
+
+	w.WriteHeader(204)
+}
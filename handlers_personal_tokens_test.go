@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/auth"
+)
+
+func TestPersonalTokenLifecycle(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, accessToken := createTestUser(t, cfg, "user@example.com")
+
+	var created personalTokenResponse
+	status := serveJSON(t, cfg.PostPersonalTokenHandler, http.MethodPost, "/api/users/tokens", accessToken, map[string]any{
+		"name":  "ci",
+		"scope": auth.ScopeChirpsWrite,
+	}, &created)
+	if status != 201 {
+		t.Fatalf("create status = %d, want 201", status)
+	}
+	if !auth.IsPersonalToken(created.Token) {
+		t.Fatalf("token = %q, want a personal access token", created.Token)
+	}
+	if created.LastUsedAt != nil {
+		t.Errorf("new token was last used at %v", created.LastUsedAt)
+	}
+
+	// Only the hash is kept
+	saved, err := cfg.db.GetPersonalToken(auth.HashOpaqueToken(created.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.UserId != user.Id || saved.TokenHash == created.Token {
+		t.Errorf("saved token = %+v", saved)
+	}
+
+	// A token can't mint another token
+	status = serveJSON(t, cfg.PostPersonalTokenHandler, http.MethodPost, "/api/users/tokens", created.Token, map[string]any{
+		"name":  "nested",
+		"scope": auth.ScopeChirpsWrite,
+	}, nil)
+	if status != 401 {
+		t.Errorf("create with a personal token status = %d, want 401", status)
+	}
+
+	_, err = cfg.authenticateScoped(context.Background(), created.Token, auth.ScopeProfile)
+	if err == nil {
+		t.Error("token was accepted for a scope it doesn't carry")
+	}
+	_, err = cfg.authenticateScoped(context.Background(), created.Token, auth.ScopeChirpsWrite)
+	if err != nil {
+		t.Fatalf("token was rejected: %v", err)
+	}
+
+	var listed []personalTokenResponse
+	status = serveJSON(t, cfg.GetPersonalTokensHandler, http.MethodGet, "/api/users/tokens", accessToken, nil, &listed)
+	if status != 200 {
+		t.Fatalf("list status = %d, want 200", status)
+	}
+	if len(listed) != 1 || listed[0].Id != created.Id {
+		t.Fatalf("listed %+v, want the new token", listed)
+	}
+	if listed[0].Token != "" {
+		t.Error("listing shows the token itself")
+	}
+	if listed[0].LastUsedAt == nil {
+		t.Error("use of the token wasn't recorded")
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/users/tokens/"+created.Id, nil)
+	req.SetPathValue("tokenID", created.Id)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rec := httptest.NewRecorder()
+	cfg.DeletePersonalTokenHandler(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("delete status = %d, want 204", rec.Code)
+	}
+
+	_, err = cfg.authenticateScoped(context.Background(), created.Token, auth.ScopeChirpsWrite)
+	if err == nil {
+		t.Error("deleted token was accepted")
+	}
+	status = serveJSON(t, cfg.GetPersonalTokensHandler, http.MethodGet, "/api/users/tokens", accessToken, nil, &listed)
+	if status != 200 || len(listed) != 0 {
+		t.Errorf("list after delete = %d %+v, want 200 and nothing", status, listed)
+	}
+}
+
+func TestPersonalTokenRejectsLongExpiry(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, accessToken := createTestUser(t, cfg, "user@example.com")
+
+	status := serveJSON(t, cfg.PostPersonalTokenHandler, http.MethodPost, "/api/users/tokens", accessToken, map[string]any{
+		"name":            "forever",
+		"scope":           auth.ScopeChirpsRead,
+		"expires_in_days": maxPersonalTokenDays + 1,
+	}, nil)
+	if status != 400 {
+		t.Errorf("status = %d, want 400", status)
+	}
+
+	tokens, err := cfg.db.GetPersonalTokens(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Errorf("saved %d tokens, want none", len(tokens))
+	}
+}
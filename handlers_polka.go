@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// maxWebhookBody is the largest webhook body read, since the whole body has
+// to be read before its signature can be checked
+const maxWebhookBody = 1 << 20
+
+const webhookSourcePolka = "polka"
+
+var errWebhookUserNotFound = errors.New("user not found")
+
+// PostPolkaWebhookHandler receives Polka events. Deliveries are signed, see
+// auth.WebhookVerifier, with the Polka-Timestamp and Polka-Signature headers.
+// Every event is logged by its ID and only acted on once, however often
+// Polka retries it. Events Chirpy doesn't handle are acknowledged so Polka
+// stops sending them.
+func (cfg *apiConfig) PostPolkaWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
+
+	if cfg.polkaWebhooks == nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	sentAt, err := cfg.polkaWebhooks.Verify(r.Header.Get("Polka-Timestamp"), r.Header.Get("Polka-Signature"), body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "polka webhook rejected", "error", err)
+		cfg.metrics.authFailed(authFailureWebhook)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	type parameters struct {
+		Id    string `json:"id"`
+		Event string `json:"event"`
+	}
+
+	params := parameters{}
+	err = json.Unmarshal(body, &params)
+	if err != nil || params.Id == "" {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	event, claimed, err := db.RecordWebhookEvent(database.WebhookEvent{
+		Id:         params.Id,
+		Source:     webhookSourcePolka,
+		Event:      params.Event,
+		Payload:    body,
+		SentAt:     sentAt.UTC(),
+		ReceivedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// Retries of an event that went through, or that another delivery is
+	// still working on, are acknowledged without acting on it again. Only
+	// an event that failed is given another go.
+	if !claimed {
+		w.WriteHeader(204)
+		return
+	}
+
+	_, err = cfg.processPolkaEvent(r.Context(), event)
+	if errors.Is(err, errWebhookUserNotFound) {
+		respondWithError(w, 404, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// processPolkaEvent acts on a logged event and records the outcome
+func (cfg *apiConfig) processPolkaEvent(ctx context.Context, event database.WebhookEvent) (database.WebhookEvent, error) {
+	db := cfg.db.WithContext(ctx)
+
+	var err error
+	switch event.Event {
+	case eventUserUpgraded, eventUserDowngraded, eventUserRenewed, eventUserPaymentFailed, eventUserRefunded:
+		err = cfg.applySubscriptionEvent(ctx, event)
+		event.Status = database.WebhookProcessed
+	default:
+		event.Status = database.WebhookIgnored
+	}
+
+	event.Attempts++
+	event.ProcessedAt = time.Now().UTC()
+	event.Error = ""
+	if errors.Is(err, errStaleSubscriptionEvent) {
+		event.Status = database.WebhookIgnored
+		event.Error = err.Error()
+		err = nil
+	}
+	if err != nil {
+		event.Status = database.WebhookFailed
+		event.Error = err.Error()
+	}
+
+	_, saveErr := db.UpdateWebhookEvent(event)
+	if saveErr != nil {
+		slog.Error("save webhook event", "event_id", event.Id, "error", saveErr)
+	}
+	return event, err
+}
+
+type webhookEventResponse struct {
+	Id          string          `json:"id"`
+	Source      string          `json:"source"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt *time.Time      `json:"processed_at"`
+}
+
+func newWebhookEventResponse(event database.WebhookEvent) webhookEventResponse {
+	response := webhookEventResponse{
+		Id:         event.Id,
+		Source:     event.Source,
+		Event:      event.Event,
+		Payload:    event.Payload,
+		Status:     event.Status,
+		Error:      event.Error,
+		Attempts:   event.Attempts,
+		ReceivedAt: event.ReceivedAt,
+	}
+	if !event.ProcessedAt.IsZero() {
+		response.ProcessedAt = &event.ProcessedAt
+	}
+	return response
+}
+
+// GetWebhookEventsHandler lists logged webhook events, newest first,
+// optionally only those with the status given in the query
+func (cfg *apiConfig) GetWebhookEventsHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := cfg.db.WithContext(r.Context()).GetWebhookEvents(r.URL.Query().Get("status"))
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	response := make([]webhookEventResponse, 0, len(events))
+	for _, event := range events {
+		response = append(response, newWebhookEventResponse(event))
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+// PostWebhookReplayHandler processes a logged event again, whatever
+// happened to it the first time
+func (cfg *apiConfig) PostWebhookReplayHandler(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.db.WithContext(r.Context()).GetWebhookEvent(r.PathValue("eventID"))
+	if err != nil {
+		respondWithError(w, 404, "Webhook event not found")
+		return
+	}
+
+	event, err = cfg.processPolkaEvent(r.Context(), event)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "replay webhook event", "event_id", event.Id, "error", err)
+	}
+
+	respondWithJSON(w, 200, newWebhookEventResponse(event))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// postPolkaEvent sends a signed Polka delivery to the webhook handler
+func postPolkaEvent(t *testing.T, cfg *apiConfig, id, event string, userId int) int {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]any{"id": id, "event": event, "data": map[string]any{"user_id": userId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	req := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", bytes.NewReader(body))
+	req.Header.Set("Polka-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("Polka-Signature", "v1="+auth.SignWebhook("polka-secret", now, body))
+	rec := httptest.NewRecorder()
+	cfg.PostPolkaWebhookHandler(rec, req)
+	return rec.Code
+}
+
+func newPolkaTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	verifier, err := auth.NewWebhookVerifier([]string{"polka-secret"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.polkaWebhooks = verifier
+	cfg.subscriptionPeriod = 30 * 24 * time.Hour
+	return cfg
+}
+
+func TestPolkaWebhookInProgressRetry(t *testing.T) {
+	cfg := newPolkaTestConfig(t)
+	user, _ := createTestUser(t, cfg, "red@example.com")
+
+	// Another delivery of the event has claimed it and is still working
+	_, claimed, err := cfg.db.RecordWebhookEvent(database.WebhookEvent{Id: "evt_1", Event: eventUserUpgraded})
+	if err != nil || !claimed {
+		t.Fatalf("claim event: %v, %v", claimed, err)
+	}
+
+	status := postPolkaEvent(t, cfg, "evt_1", eventUserUpgraded, user.Id)
+	if status != 204 {
+		t.Fatalf("status = %d, want 204", status)
+	}
+	user, err = cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsChirpyRed {
+		t.Error("a retry acted on an event that was still being processed")
+	}
+}
+
+func TestPolkaWebhookFailedRetry(t *testing.T) {
+	cfg := newPolkaTestConfig(t)
+
+	// The user doesn't exist yet, so the first delivery fails
+	status := postPolkaEvent(t, cfg, "evt_1", eventUserUpgraded, 1)
+	if status != 404 {
+		t.Fatalf("status = %d, want 404", status)
+	}
+	event, err := cfg.db.GetWebhookEvent("evt_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != database.WebhookFailed {
+		t.Fatalf("event has status %q, want %q", event.Status, database.WebhookFailed)
+	}
+
+	user, _ := createTestUser(t, cfg, "red@example.com")
+	status = postPolkaEvent(t, cfg, "evt_1", eventUserUpgraded, user.Id)
+	if status != 204 {
+		t.Fatalf("retry status = %d, want 204", status)
+	}
+	user, err = cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsChirpyRed {
+		t.Error("retry of a failed event wasn't processed")
+	}
+
+	// Once it went through, retries are only acknowledged
+	event, err = cfg.db.GetWebhookEvent("evt_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = postPolkaEvent(t, cfg, "evt_1", eventUserUpgraded, user.Id)
+	if status != 204 {
+		t.Fatalf("second retry status = %d, want 204", status)
+	}
+	again, err := cfg.db.GetWebhookEvent("evt_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Attempts != event.Attempts {
+		t.Errorf("processed event was processed again: %d attempts, want %d", again.Attempts, event.Attempts)
+	}
+}
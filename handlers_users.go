@@ -2,99 +2,80 @@ package main
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/carsongro/chirpy/internal/auth"
 	"github.com/carsongro/chirpy/internal/database"
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (cfg *apiConfig) PostUserUpgrade(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
-
-	polkaKey := r.Header.Get("Authorization")
-	polkaKey, found := strings.CutPrefix(polkaKey, "Apikey ")
-	if !found || polkaKey != cfg.polkaKey {
-		respondWithError(w, 401, "Unauthorized")
-		return
-	}
+func (cfg *apiConfig) PostUserHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
 
 	type parameters struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserId int `json:"user_id"`
-		} `json:"data"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
-	if err != nil || params.Event != "user.upgraded" {
-		respondWithError(w, 500, "Something went wrong")
-		return
-	}
-
-	user, err := db.GetUser(params.Data.UserId)
 	if err != nil {
-		respondWithError(w, 404, "User not found")
+		respondWithServerError(w, r, err)
 		return
 	}
 
-	_, err = db.UpdateUser(user.Id, user.Email, user.Password, true)
-	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
-		return
-	}
+	params.Email = normalizeEmail(params.Email)
 
-	respondWithJSON(w, 200, "")
-}
-
-func (cfg *apiConfig) PostUserHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
-
-	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+	fields := map[string][]string{}
+	if !validEmail(params.Email) {
+		fields["email"] = []string{"must be a valid email address"}
+	}
+	if problems := cfg.passwordProblems(params.Password, params.Email); len(problems) > 0 {
+		fields["password"] = problems
+	}
+	if len(fields) > 0 {
+		respondWithFieldErrors(w, fields)
+		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
+	hashedPassword, err := cfg.hashPassword(r.Context(), params.Password)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	newUser, err := db.CreateUser(params.Email, hashedPassword)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
 
-	newUser, err := db.CreateUser(params.Email, string(hashedPassword))
+	err = cfg.sendEmailVerification(r.Context(), newUser, newUser.Email)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong: ")
-		return
+		slog.ErrorContext(r.Context(), "send verification mail", "user_id", newUser.Id, "error", err)
 	}
+	cfg.emitEvent(r.Context(), eventUserCreated, newUser.Id, userEventData{Id: newUser.Id, Email: newUser.Email})
 
 	type newUserResponse struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
 	}
 
 	respondWithJSON(w, 201, newUserResponse{
-		Id:          newUser.Id,
-		Email:       newUser.Email,
-		IsChirpyRed: false,
+		Id:            newUser.Id,
+		Email:         newUser.Email,
+		IsChirpyRed:   false,
+		EmailVerified: false,
 	})
 }
 
 func (cfg *apiConfig) PostLoginHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
 	type parameters struct {
 		Password string `json:"password"`
@@ -109,184 +90,307 @@ func (cfg *apiConfig) PostLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := db.GetUsers()
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+	params.Email = normalizeEmail(params.Email)
+
+	if wait := cfg.loginLockout(r, params.Email); wait > 0 {
+		respondWithLockout(w, wait)
 		return
 	}
 
-	var user database.User
-	for _, dbUser := range users {
-		if dbUser.Email == params.Email {
-			user = dbUser
-		}
+	// Unknown emails are checked against an empty hash, which costs the
+	// same as a real one
+	user, err := db.GetUserByEmail(params.Email)
+	if err != nil {
+		user = database.User{}
 	}
 
-	if user == (database.User{}) {
+	ok, needsRehash := cfg.verifyPassword(r.Context(), user.Password, params.Password)
+	if !ok {
+		cfg.loginFailed(r, params.Email)
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password))
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
-		return
+	// Now that the password is known, move it to the current hash settings
+	if needsRehash {
+		hashedPassword, err := cfg.hashPassword(r.Context(), params.Password)
+		if err == nil {
+			var rehashed database.User
+			rehashed, err = db.UpdateUserFunc(user.Id, func(u *database.User) error {
+				// Unless it was changed in the meantime
+				if u.Password == user.Password {
+					u.Password = hashedPassword
+				}
+				return nil
+			})
+			if err == nil {
+				user = rehashed
+			}
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "rehash password", "user_id", user.Id, "error", err)
+		}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy_access",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Second * time.Duration(3600))),
-		Subject:   strconv.Itoa(user.Id),
-	})
+	// With two-factor enabled the failures stand until the second factor
+	// is right too, or codes could be guessed between password logins
+	if user.TOTPEnabled {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy_refresh",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Second * time.Duration(86400*60))),
-		Subject:   strconv.Itoa(user.Id),
-	})
+	cfg.loginSucceeded(user.Email)
+	cfg.respondWithSession(w, user)
+}
 
-	tokenString, err := token.SignedString([]byte(cfg.jwtSecret))
+// respondWithSession issues a new access and refresh token pair for user
+func (cfg *apiConfig) respondWithSession(w http.ResponseWriter, user database.User) {
+	tokenString, err := cfg.tokens.Issue(auth.TokenAccess, strconv.Itoa(user.Id))
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
-	refreshTokenString, err := refreshToken.SignedString([]byte(cfg.jwtSecret))
+	refreshTokenString, err := cfg.tokens.Issue(auth.TokenRefresh, strconv.Itoa(user.Id))
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
 	type userResponse struct {
-		Id           int    `json:"id"`
-		Email        string `json:"email"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		Token         string `json:"token"`
+		RefreshToken  string `json:"refresh_token"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
+
+		Subscription        subscriptionResponse `json:"subscription"`
+		DeletionScheduledAt *time.Time           `json:"deletion_scheduled_at,omitempty"`
 	}
 
-	respondWithJSON(w, 200, userResponse{
-		Id:           user.Id,
-		Email:        user.Email,
-		Token:        tokenString,
-		RefreshToken: refreshTokenString,
-		IsChirpyRed:  user.IsChirpyRed,
-	})
+	response := userResponse{
+		Id:            user.Id,
+		Email:         user.Email,
+		Token:         tokenString,
+		RefreshToken:  refreshTokenString,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Subscription:  newSubscriptionResponse(user),
+	}
+	// Lets the client offer to restore an account that is about to be deleted
+	if !user.DeletionScheduledAt.IsZero() {
+		response.DeletionScheduledAt = &user.DeletionScheduledAt
+	}
+
+	respondWithJSON(w, 200, response)
 }
 
-func (cfg *apiConfig) PutUsersHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+// PatchUserHandler changes only the fields that are sent. Changing the email
+// or password needs the current password, and a new password signs out
+// every other session.
+func (cfg *apiConfig) PatchUserHandler(w http.ResponseWriter, r *http.Request) {
+	db := cfg.db.WithContext(r.Context())
 
 	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+		respondWithError(w, 400, "Invalid request")
 		return
 	}
 
-	jwtToken := r.Header.Get("Authorization")
-	jwtToken, found := strings.CutPrefix(jwtToken, "Bearer ")
-	if !found {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	type userClaims struct {
-		jwt.RegisteredClaims
-	}
-	var claims userClaims
-	token, err := jwt.ParseWithClaims(jwtToken, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	})
-	if err != nil || !token.Valid || claims.Issuer == "chirpy_refresh" {
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	id, err := strconv.Atoi(claims.Subject)
-	if err != nil {
-		respondWithError(w, 401, "Unauthorized")
+	if params.Email != nil {
+		*params.Email = normalizeEmail(*params.Email)
+	}
+
+	emailChanged := params.Email != nil && *params.Email != user.Email
+	passwordChanged := params.Password != nil
+
+	fields := map[string][]string{}
+	if emailChanged && !validEmail(*params.Email) {
+		fields["email"] = []string{"must be a valid email address"}
+	}
+	if passwordChanged {
+		email := user.Email
+		if emailChanged {
+			email = *params.Email
+		}
+		if problems := cfg.passwordProblems(*params.Password, email); len(problems) > 0 {
+			fields["password"] = problems
+		}
+	}
+	if len(fields) > 0 {
+		respondWithFieldErrors(w, fields)
 		return
 	}
 
-	oldUser, err := db.GetUser(id)
+	// A stolen access token alone must not be enough to take over the account
+	if emailChanged || passwordChanged {
+		if user.Password == "" {
+			respondWithError(w, 403, "Set a password with a password reset first")
+			return
+		}
+		if params.CurrentPassword == "" {
+			respondWithFieldErrors(w, map[string][]string{"current_password": {"is required to change your email or password"}})
+			return
+		}
+		if wait := cfg.loginLockout(r, user.Email); wait > 0 {
+			respondWithLockout(w, wait)
+			return
+		}
+		ok, _ := cfg.verifyPassword(r.Context(), user.Password, params.CurrentPassword)
+		if !ok {
+			cfg.loginFailed(r, user.Email)
+			respondWithFieldErrors(w, map[string][]string{"current_password": {"is incorrect"}})
+			return
+		}
+	}
+
+	var hashedPassword string
+	if passwordChanged {
+		hashedPassword, err = cfg.hashPassword(r.Context(), *params.Password)
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+	}
+
+	updatedUser, err := db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		// A new email only takes effect once it has been confirmed
+		if emailChanged {
+			u.PendingEmail = *params.Email
+		}
+		if passwordChanged {
+			u.Password = hashedPassword
+			u.SessionsRevokedAt = time.Now().UTC()
+		}
+		return nil
+	})
 	if err != nil {
-		respondWithError(w, 404, "User not found")
+		respondWithServerError(w, r, err)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	if emailChanged {
+		err = cfg.sendEmailVerification(r.Context(), updatedUser, updatedUser.PendingEmail)
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+	}
+
+	type userResponse struct {
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
+		PendingEmail  string `json:"pending_email,omitempty"`
+		Token         string `json:"token,omitempty"`
+		RefreshToken  string `json:"refresh_token,omitempty"`
+	}
+
+	response := userResponse{
+		Id:            updatedUser.Id,
+		Email:         updatedUser.Email,
+		IsChirpyRed:   updatedUser.IsChirpyRed,
+		EmailVerified: updatedUser.EmailVerified,
+		PendingEmail:  updatedUser.PendingEmail,
+	}
+
+	// Every earlier token was just revoked, so this session gets new ones
+	if passwordChanged {
+		response.Token, err = cfg.tokens.Issue(auth.TokenAccess, strconv.Itoa(updatedUser.Id))
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+		response.RefreshToken, err = cfg.tokens.Issue(auth.TokenRefresh, strconv.Itoa(updatedUser.Id))
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) GetUserMeHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	updatedUser, err := db.UpdateUser(id, params.Email, string(hashedPassword), oldUser.IsChirpyRed)
+	user, err := cfg.authenticateScoped(r.Context(), jwtToken, auth.ScopeProfile)
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
 	type userResponse struct {
-		Id          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		EmailVerified bool   `json:"email_verified"`
+		Role          string `json:"role"`
+
+		Subscription subscriptionResponse `json:"subscription"`
 	}
 
 	respondWithJSON(w, 200, userResponse{
-		Id:          updatedUser.Id,
-		Email:       updatedUser.Email,
-		IsChirpyRed: updatedUser.IsChirpyRed,
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          auth.EffectiveRole(user.Role),
+		Subscription:  newSubscriptionResponse(user),
 	})
 }
 
 func (cfg *apiConfig) PostRefreshHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
-	jwtToken := r.Header.Get("Authorization")
-	jwtToken, found := strings.CutPrefix(jwtToken, "Bearer ")
-	if !found {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	type userClaims struct {
-		jwt.RegisteredClaims
-	}
-	var claims userClaims
-	token, err := jwt.ParseWithClaims(jwtToken, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	})
-	if err != nil || !token.Valid || claims.Issuer != "chirpy_refresh" {
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenRefresh)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
 	revokedTokens, err := db.GetRevokedTokens()
 	if err != nil {
-		respondWithError(w, 500, "Something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
-	if _, ok := revokedTokens[token.Raw]; ok {
+	if _, ok := revokedTokens[jwtToken]; ok {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy_access",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Second * time.Duration(3600))),
-		Subject:   claims.Subject,
-	})
-
-	tokenString, err := newToken.SignedString([]byte(cfg.jwtSecret))
+	tokenString, err := cfg.tokens.Issue(auth.TokenAccess, strconv.Itoa(user.Id))
 	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
@@ -302,30 +406,23 @@ func (cfg *apiConfig) PostRefreshHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (cfg *apiConfig) PostRevokeHandler(w http.ResponseWriter, r *http.Request) {
-	db := cfg.db
+	db := cfg.db.WithContext(r.Context())
 
-	jwtToken := r.Header.Get("Authorization")
-	jwtToken, found := strings.CutPrefix(jwtToken, "Bearer ")
-	if !found {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	type userClaims struct {
-		jwt.RegisteredClaims
-	}
-	var claims userClaims
-	token, err := jwt.ParseWithClaims(jwtToken, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	})
-	if err != nil || !token.Valid || claims.Issuer != "chirpy_refresh" {
+	_, _, err = cfg.authenticateToken(r.Context(), jwtToken, auth.TokenRefresh)
+	if err != nil {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	err = db.UpdateRevokedTokens(token.Raw)
+	err = db.UpdateRevokedTokens(jwtToken)
 	if err != nil {
-		respondWithError(w, 500, "something went wrong")
+		respondWithServerError(w, r, err)
 		return
 	}
 
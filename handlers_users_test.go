@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/mail"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setTestPassword gives user password and marks them as a Chirpy Red
+// member, so tests can check updates leave unrelated fields alone
+func setTestPassword(t *testing.T, cfg *apiConfig, user database.User, password string) database.User {
+	t.Helper()
+
+	hash, err := cfg.passwords.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = cfg.db.UpdateUserFunc(user.Id, func(u *database.User) error {
+		u.Password = hash
+		u.IsChirpyRed = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestPatchUserPassword(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.passwordPolicy = auth.DefaultPasswordPolicy()
+	user, token := createTestUser(t, cfg, "user@example.com")
+	user = setTestPassword(t, cfg, user, "the old password")
+
+	status := serveJSON(t, cfg.PatchUserHandler, http.MethodPatch, "/api/users/me", token, map[string]string{
+		"password": "a much longer password",
+	}, nil)
+	if status != 400 {
+		t.Fatalf("status without the current password = %d, want 400", status)
+	}
+
+	var response struct {
+		Email        string `json:"email"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	status = serveJSON(t, cfg.PatchUserHandler, http.MethodPatch, "/api/users/me", token, map[string]string{
+		"password":         "a much longer password",
+		"current_password": "the old password",
+	}, &response)
+	if status != 200 {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if response.Email != user.Email || response.Token == "" || response.RefreshToken == "" {
+		t.Errorf("response = %+v, want the same email and a new session", response)
+	}
+
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cfg.passwords.Verify(saved.Password, "a much longer password"); !ok {
+		t.Error("password wasn't changed")
+	}
+	if saved.SessionsRevokedAt.IsZero() {
+		t.Error("sessions weren't revoked")
+	}
+	if saved.Email != user.Email || !saved.IsChirpyRed || !saved.EmailVerified {
+		t.Errorf("saved user = %+v, want only the password changed", saved)
+	}
+}
+
+func TestPatchUserEmailWaitsForConfirmation(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.mailer = mail.LogMailer{}
+	user, token := createTestUser(t, cfg, "user@example.com")
+	user = setTestPassword(t, cfg, user, "the old password")
+
+	status := serveJSON(t, cfg.PatchUserHandler, http.MethodPatch, "/api/users/me", token, map[string]string{
+		"email":            "New@Example.com",
+		"current_password": "the old password",
+	}, nil)
+	if status != 200 {
+		t.Fatalf("status = %d, want 200", status)
+	}
+
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Email != "user@example.com" || saved.PendingEmail != "new@example.com" {
+		t.Errorf("email = %q, pending %q; want the old one until the new one is confirmed", saved.Email, saved.PendingEmail)
+	}
+	if saved.Password != user.Password || !saved.SessionsRevokedAt.IsZero() || !saved.IsChirpyRed {
+		t.Errorf("saved user = %+v, want only the pending email changed", saved)
+	}
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "user@example.com")
+	user = setTestPassword(t, cfg, user, "the password")
+
+	// Logging in after the cost goes up moves the hash to the new cost
+	passwords, err := auth.NewPasswordHasher(auth.HashBcrypt, bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.passwords = passwords
+
+	status := serveJSON(t, cfg.PostLoginHandler, http.MethodPost, "/api/login", "", map[string]string{
+		"email":    "user@example.com",
+		"password": "the password",
+	}, nil)
+	if status != 200 {
+		t.Fatalf("status = %d, want 200", status)
+	}
+
+	saved, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(saved.Password)); cost != bcrypt.MinCost+1 {
+		t.Errorf("hash cost = %d, want %d", cost, bcrypt.MinCost+1)
+	}
+	if !saved.IsChirpyRed || !saved.EmailVerified {
+		t.Errorf("saved user = %+v, want only the hash changed", saved)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// maxWebhookEndpoints is how many endpoints each user may register
+const maxWebhookEndpoints = 10
+
+type webhookEndpointResponse struct {
+	Id        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookEndpointResponse(endpoint database.WebhookEndpoint) webhookEndpointResponse {
+	return webhookEndpointResponse{
+		Id:        endpoint.Id,
+		URL:       endpoint.URL,
+		Events:    endpoint.Events,
+		CreatedAt: endpoint.CreatedAt,
+	}
+}
+
+type webhookDeliveryResponse struct {
+	Id             string          `json:"id"`
+	EndpointId     string          `json:"endpoint_id"`
+	EventId        string          `json:"event_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+}
+
+func newWebhookDeliveryResponse(delivery database.WebhookDelivery) webhookDeliveryResponse {
+	response := webhookDeliveryResponse{
+		Id:             delivery.Id,
+		EndpointId:     delivery.EndpointId,
+		EventId:        delivery.EventId,
+		Event:          delivery.Event,
+		Payload:        delivery.Payload,
+		Status:         delivery.Status,
+		Attempts:       delivery.Attempts,
+		LastStatusCode: delivery.LastStatusCode,
+		LastError:      delivery.LastError,
+		CreatedAt:      delivery.CreatedAt,
+	}
+	if !delivery.LastAttemptAt.IsZero() {
+		response.LastAttemptAt = &delivery.LastAttemptAt
+	}
+	if delivery.Status == database.DeliveryPending {
+		response.NextAttemptAt = &delivery.NextAttemptAt
+	}
+	return response
+}
+
+// webhookOwner returns the user an endpoint request acts for. Requests to
+// the user routes must be signed in, while admin routes act for no one, so
+// their endpoints hear about every user.
+func (cfg *apiConfig) webhookOwner(w http.ResponseWriter, r *http.Request, admin bool) (int, bool) {
+	if admin {
+		return 0, true
+	}
+
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return 0, false
+	}
+
+	user, _, err := cfg.authenticateToken(r.Context(), jwtToken, auth.TokenAccess)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return 0, false
+	}
+	return user.Id, true
+}
+
+// ownedWebhookEndpoint loads the endpoint in the path, if ownerId owns it
+func (cfg *apiConfig) ownedWebhookEndpoint(w http.ResponseWriter, r *http.Request, ownerId int) (database.WebhookEndpoint, bool) {
+	endpoint, err := cfg.db.WithContext(r.Context()).GetWebhookEndpoint(r.PathValue("endpointID"))
+	if err != nil || endpoint.OwnerId != ownerId {
+		respondWithError(w, 404, "Webhook endpoint not found")
+		return database.WebhookEndpoint{}, false
+	}
+	return endpoint, true
+}
+
+// validWebhookURL only allows https, unless private addresses are allowed
+// for local testing, in which case plain http is fine too
+func (cfg *apiConfig) validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+	return u.Scheme == "https" || (u.Scheme == "http" && cfg.webhooks.allowPrivate)
+}
+
+func (cfg *apiConfig) createWebhookEndpoint(w http.ResponseWriter, r *http.Request, admin bool) {
+	db := cfg.db.WithContext(r.Context())
+
+	ownerId, ok := cfg.webhookOwner(w, r, admin)
+	if !ok {
+		return
+	}
+
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "Invalid request")
+		return
+	}
+
+	fields := map[string][]string{}
+	if !cfg.validWebhookURL(params.URL) {
+		fields["url"] = []string{"must be an https URL"}
+	}
+	if len(params.Events) == 0 {
+		fields["events"] = []string{"must list at least one event"}
+	}
+	for _, event := range params.Events {
+		if !webhookEvents[event] {
+			fields["events"] = append(fields["events"], fmt.Sprintf("%s is not an event", event))
+		}
+	}
+	if len(fields) > 0 {
+		respondWithFieldErrors(w, fields)
+		return
+	}
+
+	if !admin {
+		endpoints, err := db.GetWebhookEndpoints(ownerId)
+		if err != nil {
+			respondWithServerError(w, r, err)
+			return
+		}
+		if len(endpoints) >= maxWebhookEndpoints {
+			respondWithError(w, 409, fmt.Sprintf("You can register at most %d webhook endpoints", maxWebhookEndpoints))
+			return
+		}
+	}
+
+	id, err := randomId(16)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	secret, err := randomId(32)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	endpoint, err := db.CreateWebhookEndpoint(database.WebhookEndpoint{
+		Id:        id,
+		OwnerId:   ownerId,
+		URL:       params.URL,
+		Events:    params.Events,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	// The secret is only ever shown here
+	response := newWebhookEndpointResponse(endpoint)
+	response.Secret = endpoint.Secret
+	respondWithJSON(w, 201, response)
+}
+
+func (cfg *apiConfig) listWebhookEndpoints(w http.ResponseWriter, r *http.Request, admin bool) {
+	ownerId, ok := cfg.webhookOwner(w, r, admin)
+	if !ok {
+		return
+	}
+
+	endpoints, err := cfg.db.WithContext(r.Context()).GetWebhookEndpoints(ownerId)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	response := make([]webhookEndpointResponse, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		response = append(response, newWebhookEndpointResponse(endpoint))
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) deleteWebhookEndpoint(w http.ResponseWriter, r *http.Request, admin bool) {
+	ownerId, ok := cfg.webhookOwner(w, r, admin)
+	if !ok {
+		return
+	}
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, r, ownerId)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.WithContext(r.Context()).DeleteWebhookEndpoint(endpoint.Id)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// listWebhookDeliveries shows an endpoint's delivery history, newest first,
+// optionally only deliveries with the status given in the query
+func (cfg *apiConfig) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, admin bool) {
+	ownerId, ok := cfg.webhookOwner(w, r, admin)
+	if !ok {
+		return
+	}
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, r, ownerId)
+	if !ok {
+		return
+	}
+
+	deliveries, err := cfg.db.WithContext(r.Context()).GetWebhookDeliveries(endpoint.Id, r.URL.Query().Get("status"))
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	respondWithWebhookDeliveries(w, deliveries)
+}
+
+// retryWebhookDelivery queues a delivery to be sent again straight away,
+// which is how dead deliveries are brought back
+func (cfg *apiConfig) retryWebhookDelivery(w http.ResponseWriter, r *http.Request, admin bool) {
+	db := cfg.db.WithContext(r.Context())
+
+	ownerId, ok := cfg.webhookOwner(w, r, admin)
+	if !ok {
+		return
+	}
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, r, ownerId)
+	if !ok {
+		return
+	}
+
+	delivery, err := db.GetWebhookDelivery(r.PathValue("deliveryID"))
+	if err != nil || delivery.EndpointId != endpoint.Id {
+		respondWithError(w, 404, "Webhook delivery not found")
+		return
+	}
+
+	delivery.Status = database.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now().UTC()
+	delivery, err = db.UpdateWebhookDelivery(delivery)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	cfg.wakeWebhookSender()
+
+	respondWithJSON(w, 202, newWebhookDeliveryResponse(delivery))
+}
+
+func respondWithWebhookDeliveries(w http.ResponseWriter, deliveries []database.WebhookDelivery) {
+	response := make([]webhookDeliveryResponse, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		response = append(response, newWebhookDeliveryResponse(delivery))
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) PostWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.createWebhookEndpoint(w, r, false)
+}
+
+func (cfg *apiConfig) GetWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.listWebhookEndpoints(w, r, false)
+}
+
+func (cfg *apiConfig) DeleteWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.deleteWebhookEndpoint(w, r, false)
+}
+
+func (cfg *apiConfig) GetWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.listWebhookDeliveries(w, r, false)
+}
+
+func (cfg *apiConfig) PostWebhookDeliveryRetryHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.retryWebhookDelivery(w, r, false)
+}
+
+func (cfg *apiConfig) PostAdminWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.createWebhookEndpoint(w, r, true)
+}
+
+func (cfg *apiConfig) GetAdminWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.listWebhookEndpoints(w, r, true)
+}
+
+func (cfg *apiConfig) DeleteAdminWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.deleteWebhookEndpoint(w, r, true)
+}
+
+func (cfg *apiConfig) GetAdminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.listWebhookDeliveries(w, r, true)
+}
+
+func (cfg *apiConfig) PostAdminWebhookDeliveryRetryHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.retryWebhookDelivery(w, r, true)
+}
+
+// GetAdminDeadLettersHandler lists every delivery that ran out of attempts,
+// across all endpoints, newest first
+func (cfg *apiConfig) GetAdminDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := cfg.db.WithContext(r.Context()).GetWebhookDeliveries("", database.DeliveryDead)
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+	respondWithWebhookDeliveries(w, deliveries)
+}
@@ -1,21 +1,83 @@
 package main
 
 import (
+	"io/fs"
 	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/carsongro/chirpy/internal/auth"
 	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/entitlements"
+	"github.com/carsongro/chirpy/internal/mail"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	db             database.DB
-	jwtSecret      string
-	polkaKey       string
+	metrics       *metrics
+	db            database.DB
+	keys          *auth.KeySet
+	tokens        *auth.Issuer
+	polkaWebhooks *auth.WebhookVerifier
+
+	subscriptionPeriod time.Duration
+	plans              entitlements.Plans
+	chirpLimiter       *rateLimiter
+	mediaLimiter       *rateLimiter
+	mediaDir           string
+	bannedWords        map[string]bool
+	webhooks           *webhookSender
+	adminToken         string
+	devMode            bool
+	draining           atomic.Bool
+	background         sync.WaitGroup
+
+	passwords      *auth.PasswordHasher
+	passwordPolicy auth.PasswordPolicy
+	breachList     *auth.BreachList
+
+	mailer               mail.Mailer
+	passwordResetTTL     time.Duration
+	passwordResetLimit   int
+	passwordResetIPs     *rateLimiter
+	emailVerificationTTL time.Duration
+	verifiedOnly         map[string]bool
+
+	webauthn   *webauthn.WebAuthn
+	ceremonies *flowStore[ceremony]
+
+	oidcProviders map[string]*auth.OIDCProvider
+	oidcFlows     *flowStore[oidcFlow]
+
+	authCodes *flowStore[authCode]
+
+	loginAccounts *loginThrottle
+	loginIPs      *loginThrottle
+
+	deletionGrace  time.Duration
+	deletedChirps  string
+	exportDir      string
+	exportTTL      time.Duration
+	exportInterval time.Duration
+}
+
+// goBackground runs fn after the request that started it has been answered.
+// Shutdown waits for it before closing the database.
+func (cfg *apiConfig) goBackground(fn func()) {
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+		fn()
+	}()
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits += 1
+		cfg.metrics.fileserverHits.Inc()
 		next.ServeHTTP(w, r)
 	})
 }
@@ -23,7 +85,7 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -32,3 +94,54 @@ func middlewareCors(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// privateFileSystem hides files and directories that must never be served
+// should they end up under the static file root, like the config, the
+// database, the JWT signing keys and users' data exports, as well as
+// dotfiles such as .env
+type privateFileSystem struct {
+	fs     http.FileSystem
+	hidden map[string]bool
+}
+
+// newPrivateFileSystem serves the files under root except for the hidden
+// paths, which may be relative to the working directory or absolute. Hidden
+// paths outside root can't be served anyway and are left out.
+func newPrivateFileSystem(root string, hidden ...string) (privateFileSystem, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return privateFileSystem{}, err
+	}
+
+	p := privateFileSystem{fs: http.Dir(root), hidden: make(map[string]bool)}
+	for _, name := range hidden {
+		if name == "" {
+			continue
+		}
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return privateFileSystem{}, err
+		}
+		rel, err := filepath.Rel(absRoot, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		p.hidden[path.Clean("/"+filepath.ToSlash(rel))] = true
+	}
+	return p, nil
+}
+
+func (p privateFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+	for hidden := range p.hidden {
+		if hidden == "/" || name == hidden || strings.HasPrefix(name, hidden+"/") {
+			return nil, fs.ErrNotExist
+		}
+	}
+	return p.fs.Open(name)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrivateFileSystem(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"index.html",
+		"assets/logo.png",
+		"database.json",
+		"chirpy.yaml",
+		".env",
+		".git/config",
+		"data/jwt_keys.json",
+		"mail/0001.eml",
+	} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(file), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(file, []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hidden paths may be relative to the working directory or absolute
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative := func(name string) string {
+		rel, err := filepath.Rel(wd, filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rel
+	}
+	staticFiles, err := newPrivateFileSystem(root,
+		relative("chirpy.yaml"),
+		relative("database.json"),
+		filepath.Join(root, "data", "jwt_keys.json"),
+		filepath.Join(root, "mail"),
+		filepath.Join(t.TempDir(), "exports"),
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/app", http.FileServer(staticFiles))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/app/", 200},
+		{"/app/assets/logo.png", 200},
+		{"/app/database.json", 404},
+		{"/app/chirpy.yaml", 404},
+		{"/app/.env", 404},
+		{"/app/.git/config", 404},
+		{"/app/data/jwt_keys.json", 404},
+		{"/app/mail/0001.eml", 404},
+		{"/app/mail/", 404},
+		{"/app/assets/../database.json", 404},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = tt.path
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestPrivateFileSystemHidesEverythingUnderHiddenRoot(t *testing.T) {
+	root := t.TempDir()
+	err := os.WriteFile(filepath.Join(root, "upload.png"), []byte("png"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pointing the file root at the media directory mustn't expose it
+	staticFiles, err := newPrivateFileSystem(root, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = staticFiles.Open("/upload.png")
+	if !os.IsNotExist(err) {
+		t.Errorf("Open = %v, want not found", err)
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachList checks passwords against a local copy of a breached password
+// hash list in the k-anonymity range format used by Have I Been Pwned. Dir
+// holds one file per five character SHA-1 prefix, such as 21BD1.txt, whose
+// lines are the remaining hash suffix and a count, like
+// "0018A45C4D1DEF81644B54AB7F969B88D65:10".
+type BreachList struct {
+	dir string
+}
+
+// NewBreachList uses the range files in dir
+func NewBreachList(dir string) (*BreachList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(dir + " is not a directory")
+	}
+	return &BreachList{dir: dir}, nil
+}
+
+// Contains reports whether password appears in the list. Only the range
+// file for the hash prefix is read.
+func (b *BreachList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		candidate, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(candidate), suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
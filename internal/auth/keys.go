@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// JWKSMaxAge is how long clients may cache the JWKS. A new key is published
+// this long before it starts signing so every cached copy already has it.
+const JWKSMaxAge = 5 * time.Minute
+
+// KeySet holds the asymmetric keys used to sign and verify JWTs.
+// The newest active key signs new tokens; older keys stay available for
+// verification until they are retired.
+type KeySet struct {
+	path         string
+	alg          string
+	retainFor    time.Duration
+	legacySecret []byte
+	mux          *sync.RWMutex
+	keys         []signingKey
+}
+
+type signingKey struct {
+	Kid        string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	CreatedAt  time.Time `json:"created_at"`
+	ActiveAt   time.Time `json:"active_at"`
+	RetiresAt  time.Time `json:"retires_at"`
+	PrivateKey string    `json:"private_key"`
+
+	signer crypto.Signer
+}
+
+// JWK is a single public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewKeySet loads the key set stored at path, creating it with a fresh
+// signing key if it doesn't exist. Retired keys are kept for verification
+// for retainFor, which should be at least the longest token lifetime.
+// If legacySecret is not empty, HS256 tokens without a kid are still accepted.
+func NewKeySet(path, alg string, retainFor time.Duration, legacySecret string) (*KeySet, error) {
+	if alg != AlgRS256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+
+	ks := KeySet{
+		path:         path,
+		alg:          alg,
+		retainFor:    retainFor,
+		legacySecret: []byte(legacySecret),
+		mux:          &sync.RWMutex{},
+	}
+
+	err := ks.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// With no key to sign in the meantime, the first key can't wait to be
+	// published
+	if len(ks.keys) == 0 {
+		err = ks.rotate(0)
+		if err != nil {
+			return nil, err
+		}
+	} else if ks.keys[len(ks.keys)-1].Alg != alg {
+		err = ks.Rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ks, nil
+}
+
+// Rotate generates a new signing key and retires the current one.
+// The new key is published in the JWKS straight away but only starts
+// signing after JWKSMaxAge, so verifiers with a cached JWKS don't see a kid
+// they don't know. The retired key keeps verifying tokens until its
+// retention period ends.
+func (ks *KeySet) Rotate() error {
+	return ks.rotate(JWKSMaxAge)
+}
+
+func (ks *KeySet) rotate(publishAhead time.Duration) error {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+
+	newKey, err := generateKey(ks.alg)
+	if err != nil {
+		return err
+	}
+	newKey.ActiveAt = newKey.CreatedAt.Add(publishAhead)
+
+	now := time.Now().UTC()
+	keys := make([]signingKey, 0, len(ks.keys)+1)
+	for _, key := range ks.keys {
+		if key.RetiresAt.IsZero() {
+			key.RetiresAt = newKey.ActiveAt.Add(ks.retainFor)
+		}
+		if key.RetiresAt.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, newKey)
+
+	err = ks.write(keys)
+	if err != nil {
+		return err
+	}
+
+	ks.keys = keys
+	return nil
+}
+
+// StartRotation rotates the signing key every interval until done is closed.
+// A key that is already older than interval is rotated immediately.
+func (ks *KeySet) StartRotation(interval time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			ks.mux.RLock()
+			due := ks.keys[len(ks.keys)-1].CreatedAt.Add(interval)
+			ks.mux.RUnlock()
+
+			timer := time.NewTimer(time.Until(due))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			err := ks.Rotate()
+			if err != nil {
+				// Try again later rather than spinning on a broken disk
+				time.Sleep(time.Minute)
+			}
+		}
+	}()
+}
+
+// Sign signs claims with the active key and sets the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key := ks.activeKey()
+
+	token := jwt.NewWithClaims(signingMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.signer)
+}
+
+// activeKey returns the newest key that has started signing. Keys are
+// appended in creation order, so that's the last one whose ActiveAt has
+// passed.
+func (ks *KeySet) activeKey() signingKey {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	now := time.Now().UTC()
+	for i := len(ks.keys) - 1; i > 0; i-- {
+		if !now.Before(ks.keys[i].ActiveAt) {
+			return ks.keys[i]
+		}
+	}
+	return ks.keys[0]
+}
+
+// Keyfunc resolves the verification key for a token by its kid header.
+// It can be passed directly to jwt.Parse.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, ok := t.Header["kid"].(string)
+	if !ok {
+		if len(ks.legacySecret) > 0 && t.Method == jwt.SigningMethodHS256 {
+			return ks.legacySecret, nil
+		}
+		return nil, errors.New("token has no kid")
+	}
+
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	now := time.Now().UTC()
+	for _, key := range ks.keys {
+		if key.Kid != kid {
+			continue
+		}
+		if !key.RetiresAt.IsZero() && now.After(key.RetiresAt) {
+			return nil, errors.New("signing key has been retired")
+		}
+		if t.Method.Alg() != key.Alg {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.signer.Public(), nil
+	}
+
+	return nil, errors.New("unknown kid")
+}
+
+// ValidMethods returns the signing algorithms accepted by Keyfunc
+func (ks *KeySet) ValidMethods() []string {
+	return []string{AlgRS256, AlgEdDSA}
+}
+
+// JWKS returns the public halves of every key still valid for verification
+func (ks *KeySet) JWKS() JWKS {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	now := time.Now().UTC()
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		if !key.RetiresAt.IsZero() && now.After(key.RetiresAt) {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, publicJWK(key))
+	}
+
+	return jwks
+}
+
+func publicJWK(key signingKey) JWK {
+	jwk := JWK{
+		Kid: key.Kid,
+		Use: "sig",
+		Alg: key.Alg,
+	}
+
+	switch pub := key.signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64URL(pub.N.Bytes())
+		jwk.E = base64URL(bigEndian(pub.E))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64URL(pub)
+	}
+
+	return jwk
+}
+
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func bigEndian(n int) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == AlgEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+func generateKey(alg string) (signingKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	kid := make([]byte, 8)
+	_, err = rand.Read(kid)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	return signingKey{
+		Kid:        hex.EncodeToString(kid),
+		Alg:        alg,
+		CreatedAt:  time.Now().UTC(),
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		signer:     signer,
+	}, nil
+}
+
+// load reads the key file into memory, dropping keys past retirement
+func (ks *KeySet) load() error {
+	file, err := os.ReadFile(ks.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(file) == 0 {
+		return nil
+	}
+
+	var keys []signingKey
+	err = json.Unmarshal(file, &keys)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, key := range keys {
+		if !key.RetiresAt.IsZero() && now.After(key.RetiresAt) {
+			continue
+		}
+
+		block, _ := pem.Decode([]byte(key.PrivateKey))
+		if block == nil {
+			return fmt.Errorf("invalid private key for kid %s", key.Kid)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("invalid private key for kid %s", key.Kid)
+		}
+		key.signer = signer
+		ks.keys = append(ks.keys, key)
+	}
+
+	return nil
+}
+
+// write saves the key file to disk, readable only by the owner
+func (ks *KeySet) write(keys []signingKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(ks.path, data, 0600)
+}
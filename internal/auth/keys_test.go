@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestKeySet(t *testing.T, path, alg, legacySecret string) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(path, alg, time.Hour, legacySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func newTestIssuer(t *testing.T, ks *KeySet, policy TokenPolicy) *Issuer {
+	t.Helper()
+
+	issuer, err := NewIssuer(ks, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func tokenKid(t *testing.T, tokenString string) string {
+	t.Helper()
+
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+func jwksKids(ks *KeySet) []string {
+	var kids []string
+	for _, key := range ks.JWKS().Keys {
+		kids = append(kids, key.Kid)
+	}
+	return kids
+}
+
+func TestKeySetRotation(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		t.Run(alg, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jwt_keys.json")
+			ks := newTestKeySet(t, path, alg, "")
+			issuer := newTestIssuer(t, ks, DefaultTokenPolicy())
+
+			before, err := issuer.Issue(TokenAccess, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldKid := tokenKid(t, before)
+
+			err = ks.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kids := jwksKids(ks)
+			if len(kids) != 2 || kids[0] != oldKid {
+				t.Fatalf("JWKS kids = %v, want the old key and the new one", kids)
+			}
+			newKid := kids[1]
+
+			// The new key is published before it signs, so verifiers with a
+			// cached JWKS already know it by the time they see it
+			during, err := issuer.Issue(TokenAccess, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kid := tokenKid(t, during); kid != oldKid {
+				t.Errorf("signed with %s straight after rotating, want the old key %s", kid, oldKid)
+			}
+
+			ks.keys[1].ActiveAt = time.Now().UTC().Add(-time.Second)
+			after, err := issuer.Issue(TokenAccess, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kid := tokenKid(t, after); kid != newKid {
+				t.Errorf("signed with %s once the new key is active, want %s", kid, newKid)
+			}
+
+			// Tokens signed before the rotation still verify
+			for _, token := range []string{before, during, after} {
+				_, _, err = issuer.Parse(token, TokenAccess)
+				if err != nil {
+					t.Errorf("Parse = %v", err)
+				}
+			}
+
+			// Both keys survive a restart
+			reloaded := newTestKeySet(t, path, alg, "")
+			if got := jwksKids(reloaded); len(got) != 2 || got[0] != oldKid || got[1] != newKid {
+				t.Errorf("reloaded JWKS kids = %v, want %v", got, kids)
+			}
+			_, _, err = newTestIssuer(t, reloaded, DefaultTokenPolicy()).Parse(before, TokenAccess)
+			if err != nil {
+				t.Errorf("Parse after reload = %v", err)
+			}
+		})
+	}
+}
+
+func TestKeySetRetiresOldKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_keys.json")
+	ks := newTestKeySet(t, path, AlgEdDSA, "")
+	issuer := newTestIssuer(t, ks, DefaultTokenPolicy())
+
+	old, err := issuer.Issue(TokenAccess, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key keeps verifying for the retention period after the new
+	// key starts signing
+	wantRetires := ks.keys[1].ActiveAt.Add(time.Hour)
+	if !ks.keys[0].RetiresAt.Equal(wantRetires) {
+		t.Errorf("old key retires at %v, want %v", ks.keys[0].RetiresAt, wantRetires)
+	}
+
+	ks.keys[0].RetiresAt = time.Now().UTC().Add(-time.Second)
+	_, _, err = issuer.Parse(old, TokenAccess)
+	if err == nil {
+		t.Error("token signed with a retired key was accepted")
+	}
+	if kids := jwksKids(ks); len(kids) != 1 || kids[0] != ks.keys[1].Kid {
+		t.Errorf("JWKS kids = %v, want only the new key", kids)
+	}
+
+	// The next rotation drops it from the file
+	err = ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestKeySet(t, path, AlgEdDSA, "")
+	if n := len(reloaded.keys); n != 2 {
+		t.Errorf("key file holds %d keys, want 2", n)
+	}
+}
+
+func TestKeySetRejectsUnknownKid(t *testing.T) {
+	ks := newTestKeySet(t, filepath.Join(t.TempDir(), "jwt_keys.json"), AlgEdDSA, "")
+	other := newTestKeySet(t, filepath.Join(t.TempDir(), "jwt_keys.json"), AlgEdDSA, "")
+
+	token, err := newTestIssuer(t, other, DefaultTokenPolicy()).Issue(TokenAccess, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = newTestIssuer(t, ks, DefaultTokenPolicy()).Parse(token, TokenAccess)
+	if err == nil {
+		t.Error("token signed by another key set was accepted")
+	}
+}
+
+func TestKeySetRotatesOnAlgorithmChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_keys.json")
+	newTestKeySet(t, path, AlgRS256, "")
+
+	ks := newTestKeySet(t, path, AlgEdDSA, "")
+	if n := len(ks.keys); n != 2 {
+		t.Fatalf("got %d keys, want the old and a new one", n)
+	}
+	if alg := ks.keys[1].Alg; alg != AlgEdDSA {
+		t.Errorf("new key is %s, want %s", alg, AlgEdDSA)
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	sign := func(t *testing.T, method jwt.SigningMethod, issuer string, kid bool) string {
+		t.Helper()
+		now := time.Now().UTC()
+		token := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "1",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		})
+		if kid {
+			token.Header["kid"] = "legacy"
+		}
+		signed, err := token.SignedString([]byte("legacy-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		token    func(t *testing.T) string
+		tokenUse string
+		wantOK   bool
+	}{
+		{"access token with the secret set", "legacy-secret", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS256, "chirpy_access", false)
+		}, TokenAccess, true},
+		{"refresh token with the secret set", "legacy-secret", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS256, "chirpy_refresh", false)
+		}, TokenRefresh, true},
+		{"refresh token used as access token", "legacy-secret", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS256, "chirpy_refresh", false)
+		}, TokenAccess, false},
+		{"secret unset", "", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS256, "chirpy_access", false)
+		}, TokenAccess, false},
+		{"wrong secret", "other-secret", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS256, "chirpy_access", false)
+		}, TokenAccess, false},
+		{"HS256 with a kid", "legacy-secret", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS256, "chirpy_access", true)
+		}, TokenAccess, false},
+		{"HS512", "legacy-secret", func(t *testing.T) string {
+			return sign(t, jwt.SigningMethodHS512, "chirpy_access", false)
+		}, TokenAccess, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := newTestKeySet(t, filepath.Join(t.TempDir(), "jwt_keys.json"), AlgEdDSA, tt.secret)
+			_, claims, err := newTestIssuer(t, ks, DefaultTokenPolicy()).Parse(tt.token(t), tt.tokenUse)
+			if tt.wantOK && (err != nil || claims.Subject != "1" || claims.TokenUse != tt.tokenUse) {
+				t.Errorf("Parse = %+v, %v; want the legacy token accepted", claims, err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Error("legacy token was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCConfig describes an external OpenID Connect provider
+type OIDCConfig struct {
+	Name         string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against a
+// provider and verifies the ID tokens it returns
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mux       *sync.Mutex
+	discovery *oidcDiscovery
+	jwks      map[string]JWK
+	jwksAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDTokenClaims are the ID token claims Chirpy cares about
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// jwksMinRefresh stops an attacker forcing a JWKS fetch on every request
+// by sending unknown kids
+const jwksMinRefresh = time.Minute
+
+// NewOIDCProvider creates a provider. Discovery happens on first use so
+// an unreachable provider doesn't stop the server from starting.
+func NewOIDCProvider(config OIDCConfig, client *http.Client) (*OIDCProvider, error) {
+	if config.Name == "" || config.IssuerURL == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("oidc provider needs a name, issuer, client id and redirect url")
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email"}
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &OIDCProvider{
+		config: config,
+		client: client,
+		mux:    &sync.Mutex{},
+	}, nil
+}
+
+// Name returns the name the provider was configured with
+func (p *OIDCProvider) Name() string {
+	return p.config.Name
+}
+
+// NewPKCE returns a code verifier and its S256 code challenge
+func NewPKCE() (verifier, challenge string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	return verifier, PKCEChallenge(verifier), nil
+}
+
+// PKCEChallenge derives the S256 code challenge for verifier
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL to send the user to for sign in
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return discovery.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange trades an authorization code for the provider's ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", res.Status)
+	}
+
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", err
+	}
+	if tokenResponse.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+
+	return tokenResponse.IDToken, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce
+// of an ID token
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (IDTokenClaims, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	keyfunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.verificationKey(ctx, kid)
+	}
+
+	var claims IDTokenClaims
+	_, err = jwt.ParseWithClaims(rawIDToken, &claims, keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	if claims.Subject == "" {
+		return IDTokenClaims{}, errors.New("id token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return IDTokenClaims{}, errors.New("id token nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// discover fetches and caches the provider's discovery document
+func (p *OIDCProvider) discover(ctx context.Context) (oidcDiscovery, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	var discovery oidcDiscovery
+	err := p.getJSON(ctx, wellKnown, &discovery)
+	if err != nil {
+		return oidcDiscovery{}, err
+	}
+
+	if discovery.Issuer != p.config.IssuerURL {
+		return oidcDiscovery{}, fmt.Errorf("issuer mismatch: configured %s, provider says %s", p.config.IssuerURL, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return oidcDiscovery{}, errors.New("incomplete discovery document")
+	}
+
+	p.discovery = &discovery
+	return discovery, nil
+}
+
+// verificationKey finds the provider key for kid, refetching the JWKS
+// when the kid is unknown since the provider may have rotated keys
+func (p *OIDCProvider) verificationKey(ctx context.Context, kid string) (interface{}, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	key, ok := p.jwks[kid]
+	if !ok && time.Since(p.jwksAt) > jwksMinRefresh {
+		var jwks JWKS
+		err := p.getJSON(ctx, p.discovery.JWKSURI, &jwks)
+		if err != nil {
+			return nil, err
+		}
+
+		p.jwks = make(map[string]JWK, len(jwks.Keys))
+		for _, k := range jwks.Keys {
+			if k.Use == "" || k.Use == "sig" {
+				p.jwks[k.Kid] = k
+			}
+		}
+		p.jwksAt = time.Now()
+		key, ok = p.jwks[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+
+	return key.PublicKey()
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth/oidctest"
+)
+
+func newTestOIDCProvider(t *testing.T, mock *oidctest.Provider) *OIDCProvider {
+	t.Helper()
+
+	provider, err := NewOIDCProvider(OIDCConfig{
+		Name:         "test",
+		IssuerURL:    mock.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://localhost:8080/api/oauth/test/callback",
+	}, mock.Server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// signIn follows the provider's authorization redirect and returns the code
+// and state it sends back
+func signIn(t *testing.T, mock *oidctest.Provider, authURL string) (code, state string) {
+	t.Helper()
+
+	client := mock.Server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d", res.StatusCode)
+	}
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+	provider := newTestOIDCProvider(t, mock)
+	ctx := context.Background()
+
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state := signIn(t, mock, authURL)
+	if state != "state-1" {
+		t.Errorf("got state %q back, want %q", state, "state-1")
+	}
+
+	idToken, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, idToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != mock.Subject || claims.Email != mock.Email || !claims.EmailVerified {
+		t.Errorf("got claims %+v", claims)
+	}
+}
+
+func TestOIDCExchangeRejectsWrongVerifier(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+	provider := newTestOIDCProvider(t, mock)
+	ctx := context.Background()
+
+	_, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := signIn(t, mock, authURL)
+
+	otherVerifier, _, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = provider.Exchange(ctx, code, otherVerifier)
+	if err == nil {
+		t.Error("exchange with the wrong code verifier succeeded")
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+	provider := newTestOIDCProvider(t, mock)
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		claim string
+		value any
+	}{
+		{"wrong issuer", "iss", "https://attacker.example.com"},
+		{"wrong audience", "aud", "another-client"},
+		{"expired", "exp", time.Now().Add(-time.Hour).Unix()},
+		{"wrong nonce", "nonce", "nonce-2"},
+		{"no subject", "sub", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := mock.IDTokenClaims("nonce-1")
+			claims[tt.claim] = tt.value
+
+			_, err := provider.VerifyIDToken(ctx, mock.SignIDToken(t, claims), "nonce-1")
+			if err == nil {
+				t.Error("invalid id token was accepted")
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyIDTokenRejectsForgedSignature(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+	provider := newTestOIDCProvider(t, mock)
+	ctx := context.Background()
+
+	_, err := provider.VerifyIDToken(ctx, mock.SignIDToken(t, mock.IDTokenClaims("nonce-1")), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed by a key the provider never published
+	forger := oidctest.NewProvider(t)
+	forged := mock.IDTokenClaims("nonce-1")
+	_, err = provider.VerifyIDToken(ctx, forger.SignIDToken(t, forged), "nonce-1")
+	if err == nil {
+		t.Error("id token signed with an unpublished key was accepted")
+	}
+}
+
+func TestOIDCDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	mock := oidctest.NewProvider(t)
+
+	// Discovery is fetched from the same place, but the document names an
+	// issuer without the trailing slash
+	provider, err := NewOIDCProvider(OIDCConfig{
+		Name:        "test",
+		IssuerURL:   mock.Issuer() + "/",
+		ClientID:    oidctest.ClientID,
+		RedirectURL: "http://localhost:8080/api/oauth/test/callback",
+	}, mock.Server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.AuthCodeURL(context.Background(), "state-1", "nonce-1", "challenge")
+	if err == nil {
+		t.Error("provider with a mismatched issuer was trusted")
+	}
+}
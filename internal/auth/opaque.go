@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MakeOpaqueToken returns a random token to hand to the user and the hash
+// of it to store. Only the hash should ever be persisted.
+func MakeOpaqueToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	token = hex.EncodeToString(b)
+	return token, HashOpaqueToken(token), nil
+}
+
+// HashOpaqueToken hashes a token made by MakeOpaqueToken for lookup
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// PersonalTokenPrefix marks personal access tokens so they can be told
+// apart from JWTs in an Authorization header
+const PersonalTokenPrefix = "chirpy_pat_"
+
+// MakePersonalToken returns a new personal access token and its hash
+func MakePersonalToken() (token, hash string, err error) {
+	token, _, err = MakeOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	token = PersonalTokenPrefix + token
+	return token, HashOpaqueToken(token), nil
+}
+
+// IsPersonalToken reports whether token looks like a personal access token
+func IsPersonalToken(token string) bool {
+	return strings.HasPrefix(token, PersonalTokenPrefix)
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// argon2id parameters, the OWASP recommendation at the time of writing
+const (
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// PasswordHasher hashes new passwords with the configured algorithm and
+// verifies passwords against hashes made with any supported algorithm
+type PasswordHasher struct {
+	alg        string
+	bcryptCost int
+	dummyHash  string
+}
+
+// NewPasswordHasher creates a hasher for alg. bcryptCost is only used
+// with HashBcrypt.
+func NewPasswordHasher(alg string, bcryptCost int) (*PasswordHasher, error) {
+	switch alg {
+	case HashArgon2id:
+	case HashBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported password hash: %s", alg)
+	}
+
+	h := &PasswordHasher{alg: alg, bcryptCost: bcryptCost}
+	dummyHash, err := h.Hash("chirpy dummy password")
+	if err != nil {
+		return nil, err
+	}
+	h.dummyHash = dummyHash
+	return h, nil
+}
+
+// Hash hashes password with the configured algorithm
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.alg == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks password against hash. needsRehash reports that the hash
+// is weaker than what Hash would produce today, so the caller should store
+// a fresh hash now that it knows the password. An empty hash, for unknown
+// users or users without a password, takes as long to check as a real one
+// and never matches.
+func (h *PasswordHasher) Verify(hash, password string) (ok, needsRehash bool) {
+	if hash == "" {
+		h.verify(h.dummyHash, password)
+		return false, false
+	}
+	return h.verify(hash, password)
+}
+
+func (h *PasswordHasher) verify(hash, password string) (ok, needsRehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, false
+		}
+
+		candidate := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false
+		}
+		return true, h.alg != HashArgon2id || params != currentArgon2Params
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, h.alg != HashBcrypt || err != nil || cost < h.bcryptCost
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+var currentArgon2Params = argon2Params{memory: argon2Memory, time: argon2Time, threads: argon2Threads}
+
+// decodeArgon2id parses a hash in the PHC string format
+func decodeArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return argon2Params{}, nil, nil, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2Params{}, nil, nil, errors.New("unsupported argon2id version")
+	}
+
+	var params argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return argon2Params{}, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2Params{}, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return argon2Params{}, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
+
+// PasswordPolicy describes what makes a password acceptable. MinClasses is
+// how many of lowercase, uppercase, digits and symbols must appear.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	MinClasses    int
+	DisallowEmail bool
+}
+
+// DefaultPasswordPolicy favours length over composition rules. The maximum
+// is bcrypt's limit, so hashes can move between algorithms.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:     8,
+		MaxLength:     72,
+		MinClasses:    0,
+		DisallowEmail: true,
+	}
+}
+
+// Check returns every way password breaks the policy, as messages fit to
+// show the user
+func (p PasswordPolicy) Check(password, email string) []string {
+	problems := []string{}
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", p.MaxLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+
+	if p.DisallowEmail && email != "" {
+		lowered := strings.ToLower(password)
+		localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if strings.Contains(lowered, strings.ToLower(email)) || (len(localPart) >= 3 && strings.Contains(lowered, localPart)) {
+			problems = append(problems, "must not contain your email address")
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestHasher(t *testing.T, alg string, bcryptCost int) *PasswordHasher {
+	t.Helper()
+
+	h, err := NewPasswordHasher(alg, bcryptCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	for _, alg := range []string{HashBcrypt, HashArgon2id} {
+		t.Run(alg, func(t *testing.T) {
+			h := newTestHasher(t, alg, bcrypt.MinCost)
+			hash, err := h.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok, needsRehash := h.Verify(hash, "correct horse battery staple")
+			if !ok || needsRehash {
+				t.Errorf("right password: got ok %v, needsRehash %v", ok, needsRehash)
+			}
+			ok, _ = h.Verify(hash, "correct horse battery stapler")
+			if ok {
+				t.Error("wrong password matched")
+			}
+			ok, _ = h.Verify("", "")
+			if ok {
+				t.Error("empty hash matched")
+			}
+			ok, _ = h.Verify("$argon2id$v=19$m=1,t=1$salt$key", "correct horse battery staple")
+			if ok {
+				t.Error("malformed hash matched")
+			}
+		})
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	weakBcrypt := newTestHasher(t, HashBcrypt, bcrypt.MinCost)
+	bcryptHash, err := weakBcrypt.Hash("hunter2hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := newTestHasher(t, HashArgon2id, 0).Hash("hunter2hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher *PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{"same bcrypt cost", weakBcrypt, bcryptHash, false},
+		{"higher bcrypt cost", newTestHasher(t, HashBcrypt, bcrypt.MinCost+1), bcryptHash, true},
+		{"bcrypt to argon2id", newTestHasher(t, HashArgon2id, 0), bcryptHash, true},
+		{"argon2id to bcrypt", weakBcrypt, argon2Hash, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash := tt.hasher.Verify(tt.hash, "hunter2hunter2")
+			if !ok {
+				t.Fatal("right password did not match")
+			}
+			if needsRehash != tt.want {
+				t.Errorf("got needsRehash %v, want %v", needsRehash, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRehashesWeakArgon2id(t *testing.T) {
+	h := newTestHasher(t, HashArgon2id, 0)
+
+	// The same password hashed with fewer passes than Hash uses today
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("hunter2hunter2"), salt, argon2Time-1, argon2Memory, argon2Threads, argon2KeyLen)
+	weak := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time-1, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	ok, needsRehash := h.Verify(weak, "hunter2hunter2")
+	if !ok || !needsRehash {
+		t.Errorf("got ok %v, needsRehash %v, want both true", ok, needsRehash)
+	}
+}
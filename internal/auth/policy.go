@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// knownClaims are the registered claims a policy may require
+var knownClaims = map[string]bool{
+	"iss": true,
+	"sub": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+}
+
+// TokenPolicy controls how tokens are minted and what is enforced when
+// they are parsed
+type TokenPolicy struct {
+	AccessTTL      time.Duration
+	RefreshTTL     time.Duration
+	MFATTL         time.Duration
+	Issuer         string
+	Audience       string
+	Leeway         time.Duration
+	RequiredClaims []string
+}
+
+// DefaultTokenPolicy returns the policy used when nothing is configured
+func DefaultTokenPolicy() TokenPolicy {
+	return TokenPolicy{
+		AccessTTL:      time.Hour,
+		RefreshTTL:     60 * 24 * time.Hour,
+		MFATTL:         5 * time.Minute,
+		Issuer:         "chirpy",
+		Audience:       "chirpy",
+		Leeway:         30 * time.Second,
+		RequiredClaims: []string{"iss", "sub", "aud", "exp", "iat"},
+	}
+}
+
+// Validate reports the first problem with the policy, if any
+func (p TokenPolicy) Validate() error {
+	if p.AccessTTL <= 0 {
+		return errors.New("access token lifetime must be positive")
+	}
+	if p.RefreshTTL < p.AccessTTL {
+		return errors.New("refresh token lifetime must not be shorter than the access token lifetime")
+	}
+	if p.MFATTL <= 0 {
+		return errors.New("mfa challenge lifetime must be positive")
+	}
+	if p.Issuer == "" {
+		return errors.New("token issuer must not be empty")
+	}
+	if p.Leeway < 0 {
+		return errors.New("token leeway must not be negative")
+	}
+	if p.Leeway >= p.AccessTTL {
+		return errors.New("token leeway must be shorter than the access token lifetime")
+	}
+
+	for _, claim := range p.RequiredClaims {
+		if !knownClaims[claim] {
+			return fmt.Errorf("unknown required claim: %s", claim)
+		}
+		if claim == "aud" && p.Audience == "" {
+			return errors.New("aud is required but no audience is configured")
+		}
+	}
+
+	return nil
+}
+
+// requires reports whether claim must be present on every token
+func (p TokenPolicy) requires(claim string) bool {
+	for _, required := range p.RequiredClaims {
+		if required == claim {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package auth
+
+// Roles a user can have. Users without a role are plain users.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permission is something only some roles may do
+type Permission string
+
+const (
+	PermDeleteAnyChirp Permission = "chirps:delete_any"
+	PermViewMetrics    Permission = "metrics:view"
+	PermResetMetrics   Permission = "metrics:reset"
+	PermUnlockUsers    Permission = "users:unlock"
+	PermManageRoles    Permission = "users:manage_roles"
+	PermManageWebhooks Permission = "webhooks:manage"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleUser:      {},
+	RoleModerator: {PermDeleteAnyChirp},
+	RoleAdmin:     {PermDeleteAnyChirp, PermViewMetrics, PermResetMetrics, PermUnlockUsers, PermManageRoles, PermManageWebhooks},
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// EffectiveRole returns role, or RoleUser for users without one
+func EffectiveRole(role string) string {
+	if role == "" {
+		return RoleUser
+	}
+	return role
+}
+
+// RoleCan reports whether role grants perm
+func RoleCan(role string, perm Permission) bool {
+	for _, p := range rolePermissions[EffectiveRole(role)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+	TokenMFA     = "mfa_challenge"
+)
+
+// Scopes that third-party apps and personal access tokens can be granted
+const (
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	ScopeProfile     = "profile"
+)
+
+var knownScopes = map[string]bool{
+	ScopeChirpsRead:  true,
+	ScopeChirpsWrite: true,
+	ScopeProfile:     true,
+}
+
+// ParseScopes splits a space separated scope string, rejecting unknown scopes
+func ParseScopes(scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			return nil, fmt.Errorf("unknown scope: %s", s)
+		}
+	}
+	return scopes, nil
+}
+
+// Claims are the claims carried by every Chirpy token. Tokens issued to
+// third-party apps carry the app's client ID and the scopes it was granted.
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenUse string `json:"token_use"`
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// HasScope reports whether the token grants scope. First-party tokens,
+// which have no client ID, are not limited by scopes.
+func (c Claims) HasScope(scope string) bool {
+	if c.ClientID == "" {
+		return true
+	}
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Issuer mints and verifies tokens according to a TokenPolicy
+type Issuer struct {
+	keys   *KeySet
+	policy TokenPolicy
+}
+
+// NewIssuer creates an Issuer, rejecting invalid policies
+func NewIssuer(keys *KeySet, policy TokenPolicy) (*Issuer, error) {
+	err := policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{
+		keys:   keys,
+		policy: policy,
+	}, nil
+}
+
+// Policy returns the policy the issuer enforces
+func (i *Issuer) Policy() TokenPolicy {
+	return i.policy
+}
+
+// Issue mints a token of the given use for subject
+func (i *Issuer) Issue(tokenUse, subject string) (string, error) {
+	var ttl time.Duration
+	switch tokenUse {
+	case TokenAccess:
+		ttl = i.policy.AccessTTL
+	case TokenRefresh:
+		ttl = i.policy.RefreshTTL
+	case TokenMFA:
+		ttl = i.policy.MFATTL
+	default:
+		return "", fmt.Errorf("unknown token use: %s", tokenUse)
+	}
+
+	return i.IssueClaims(Claims{TokenUse: tokenUse}, subject, ttl)
+}
+
+// IssueForClient mints an access or refresh token for a third-party app
+// limited to scopes
+func (i *Issuer) IssueForClient(tokenUse, subject, clientID string, scopes []string) (string, error) {
+	ttl := i.policy.AccessTTL
+	if tokenUse == TokenRefresh {
+		ttl = i.policy.RefreshTTL
+	} else if tokenUse != TokenAccess {
+		return "", fmt.Errorf("unknown token use: %s", tokenUse)
+	}
+
+	return i.IssueClaims(Claims{
+		TokenUse: tokenUse,
+		ClientID: clientID,
+		Scope:    strings.Join(scopes, " "),
+	}, subject, ttl)
+}
+
+// IssueClaims fills in the registered claims on claims and signs it
+func (i *Issuer) IssueClaims(claims Claims, subject string, ttl time.Duration) (string, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    i.policy.Issuer,
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		ID:        hex.EncodeToString(jti),
+	}
+	if i.policy.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{i.policy.Audience}
+	}
+
+	return i.keys.Sign(claims)
+}
+
+// Parse verifies a token and checks it against the policy and tokenUse
+func (i *Issuer) Parse(tokenString, tokenUse string) (*jwt.Token, Claims, error) {
+	if i.isLegacy(tokenString) {
+		return i.parseLegacy(tokenString, tokenUse)
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(i.keys.ValidMethods()),
+		jwt.WithIssuer(i.policy.Issuer),
+		jwt.WithLeeway(i.policy.Leeway),
+		jwt.WithIssuedAt(),
+	}
+	if i.policy.Audience != "" {
+		options = append(options, jwt.WithAudience(i.policy.Audience))
+	}
+	if i.policy.requires("exp") {
+		options = append(options, jwt.WithExpirationRequired())
+	}
+
+	var claims Claims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, i.keys.Keyfunc, options...)
+	if err != nil {
+		return nil, Claims{}, err
+	}
+	if !token.Valid {
+		return nil, Claims{}, errors.New("invalid token")
+	}
+
+	err = i.checkRequired(claims)
+	if err != nil {
+		return nil, Claims{}, err
+	}
+
+	if claims.TokenUse != tokenUse {
+		return nil, Claims{}, errors.New("unexpected token use")
+	}
+
+	return token, claims, nil
+}
+
+// legacyIssuers are the issuers HS256 tokens used to tell access and refresh
+// tokens apart before tokens carried a token_use claim
+var legacyIssuers = map[string]string{
+	TokenAccess:  "chirpy_access",
+	TokenRefresh: "chirpy_refresh",
+}
+
+// isLegacy reports whether tokenString looks like an HS256 token minted
+// before signing keys, and the key set still accepts them
+func (i *Issuer) isLegacy(tokenString string) bool {
+	if len(i.keys.legacySecret) == 0 {
+		return false
+	}
+
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &jwt.RegisteredClaims{})
+	if err != nil {
+		return false
+	}
+	_, hasKid := token.Header["kid"]
+	return !hasKid && token.Method == jwt.SigningMethodHS256
+}
+
+// parseLegacy verifies an HS256 token minted before signing keys. These
+// predate the token policy, so they are checked against the issuer they
+// were minted with instead. Once the last of them has expired (a refresh
+// token lifetime after the switch), the legacy secret can be unset.
+func (i *Issuer) parseLegacy(tokenString, tokenUse string) (*jwt.Token, Claims, error) {
+	issuer, ok := legacyIssuers[tokenUse]
+	if !ok {
+		return nil, Claims{}, errors.New("unexpected token use")
+	}
+
+	var claims Claims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, i.keys.Keyfunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithLeeway(i.policy.Leeway),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, Claims{}, err
+	}
+	if !token.Valid || claims.Subject == "" || claims.IssuedAt == nil {
+		return nil, Claims{}, errors.New("invalid token")
+	}
+
+	claims.TokenUse = tokenUse
+	return token, claims, nil
+}
+
+// checkRequired makes sure every claim required by the policy is present
+func (i *Issuer) checkRequired(claims Claims) error {
+	present := map[string]bool{
+		"iss": claims.Issuer != "",
+		"sub": claims.Subject != "",
+		"aud": len(claims.Audience) > 0,
+		"exp": claims.ExpiresAt != nil,
+		"nbf": claims.NotBefore != nil,
+		"iat": claims.IssuedAt != nil,
+		"jti": claims.ID != "",
+	}
+
+	for _, claim := range i.policy.RequiredClaims {
+		if !present[claim] {
+			return fmt.Errorf("token is missing required claim: %s", claim)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssuerParse(t *testing.T) {
+	ks := newTestKeySet(t, filepath.Join(t.TempDir(), "jwt_keys.json"), AlgEdDSA, "")
+	policy := DefaultTokenPolicy()
+	issuer := newTestIssuer(t, ks, policy)
+
+	// Tokens from the same keys but minted under another policy
+	mintedBy := func(change func(*TokenPolicy)) *Issuer {
+		other := DefaultTokenPolicy()
+		change(&other)
+		return newTestIssuer(t, ks, other)
+	}
+	otherAudience := mintedBy(func(p *TokenPolicy) { p.Audience = "someone-else" })
+	otherIssuer := mintedBy(func(p *TokenPolicy) { p.Issuer = "someone-else" })
+	noAudience := mintedBy(func(p *TokenPolicy) {
+		p.Audience = ""
+		p.RequiredClaims = []string{"iss", "sub", "exp", "iat"}
+	})
+
+	tests := []struct {
+		name     string
+		issuer   *Issuer
+		claims   Claims
+		subject  string
+		ttl      time.Duration
+		tokenUse string
+		wantErr  bool
+	}{
+		{name: "valid", issuer: issuer, claims: Claims{TokenUse: TokenAccess}, subject: "1", ttl: time.Hour, tokenUse: TokenAccess},
+		{name: "wrong token use", issuer: issuer, claims: Claims{TokenUse: TokenRefresh}, subject: "1", ttl: time.Hour, tokenUse: TokenAccess, wantErr: true},
+		{name: "wrong audience", issuer: otherAudience, claims: Claims{TokenUse: TokenAccess}, subject: "1", ttl: time.Hour, tokenUse: TokenAccess, wantErr: true},
+		{name: "no audience", issuer: noAudience, claims: Claims{TokenUse: TokenAccess}, subject: "1", ttl: time.Hour, tokenUse: TokenAccess, wantErr: true},
+		{name: "wrong issuer", issuer: otherIssuer, claims: Claims{TokenUse: TokenAccess}, subject: "1", ttl: time.Hour, tokenUse: TokenAccess, wantErr: true},
+		{name: "missing required subject", issuer: issuer, claims: Claims{TokenUse: TokenAccess}, ttl: time.Hour, tokenUse: TokenAccess, wantErr: true},
+		{name: "expired within the leeway", issuer: issuer, claims: Claims{TokenUse: TokenAccess}, subject: "1", ttl: -policy.Leeway / 2, tokenUse: TokenAccess},
+		{name: "expired beyond the leeway", issuer: issuer, claims: Claims{TokenUse: TokenAccess}, subject: "1", ttl: -2 * policy.Leeway, tokenUse: TokenAccess, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.issuer.IssueClaims(tt.claims, tt.subject, tt.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, claims, err := issuer.Parse(token, tt.tokenUse)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Parse succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse = %v", err)
+			}
+			if claims.Subject != tt.subject || claims.TokenUse != tt.tokenUse {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestIssuerIssueLifetimes(t *testing.T) {
+	ks := newTestKeySet(t, filepath.Join(t.TempDir(), "jwt_keys.json"), AlgEdDSA, "")
+	policy := DefaultTokenPolicy()
+	policy.AccessTTL = 10 * time.Minute
+	policy.RefreshTTL = 24 * time.Hour
+	policy.MFATTL = 2 * time.Minute
+	issuer := newTestIssuer(t, ks, policy)
+
+	for tokenUse, ttl := range map[string]time.Duration{
+		TokenAccess:  policy.AccessTTL,
+		TokenRefresh: policy.RefreshTTL,
+		TokenMFA:     policy.MFATTL,
+	} {
+		token, err := issuer.Issue(tokenUse, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, claims, err := issuer.Parse(token, tokenUse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := claims.ExpiresAt.Sub(claims.IssuedAt.Time); got != ttl {
+			t.Errorf("%s token lives %v, want %v", tokenUse, got, ttl)
+		}
+		if len(claims.Audience) != 1 || claims.Audience[0] != policy.Audience || claims.Issuer != policy.Issuer {
+			t.Errorf("%s token has audience %v and issuer %s", tokenUse, claims.Audience, claims.Issuer)
+		}
+	}
+
+	_, err := issuer.Issue("session", "1")
+	if err == nil {
+		t.Error("Issue accepted an unknown token use")
+	}
+}
+
+func TestTokenPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*TokenPolicy)
+		wantErr string
+	}{
+		{name: "default", change: func(*TokenPolicy) {}},
+		{name: "no access lifetime", change: func(p *TokenPolicy) { p.AccessTTL = 0 }, wantErr: "access token lifetime"},
+		{name: "refresh shorter than access", change: func(p *TokenPolicy) { p.RefreshTTL = p.AccessTTL / 2 }, wantErr: "refresh token lifetime"},
+		{name: "no mfa lifetime", change: func(p *TokenPolicy) { p.MFATTL = 0 }, wantErr: "mfa challenge lifetime"},
+		{name: "no issuer", change: func(p *TokenPolicy) { p.Issuer = "" }, wantErr: "issuer"},
+		{name: "negative leeway", change: func(p *TokenPolicy) { p.Leeway = -time.Second }, wantErr: "leeway"},
+		{name: "leeway as long as a token", change: func(p *TokenPolicy) { p.Leeway = p.AccessTTL }, wantErr: "leeway"},
+		{name: "unknown claim", change: func(p *TokenPolicy) { p.RequiredClaims = []string{"nonce"} }, wantErr: "unknown required claim"},
+		{name: "aud required without an audience", change: func(p *TokenPolicy) { p.Audience = "" }, wantErr: "aud is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultTokenPolicy()
+			tt.change(&policy)
+
+			err := policy.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClaimsHasScope(t *testing.T) {
+	firstParty := Claims{}
+	thirdParty := Claims{ClientID: "app", Scope: ScopeChirpsRead + " " + ScopeProfile}
+
+	if !firstParty.HasScope(ScopeChirpsWrite) {
+		t.Error("first-party token was limited by scope")
+	}
+	if !thirdParty.HasScope(ScopeProfile) {
+		t.Error("third-party token lacks a scope it was granted")
+	}
+	if thirdParty.HasScope(ScopeChirpsWrite) {
+		t.Error("third-party token has a scope it wasn't granted")
+	}
+
+	_, err := ParseScopes(ScopeChirpsRead + " admin")
+	if err == nil {
+		t.Error("ParseScopes accepted an unknown scope")
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D, cut to six digits
+	key := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := hotp(key, int64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_010, 0)
+	counter := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name        string
+		code        string
+		lastCounter int64
+		wantStep    int64
+		wantOK      bool
+	}{
+		{"current step", hotp(key, counter), 0, counter, true},
+		{"previous step", hotp(key, counter-1), 0, counter - 1, true},
+		{"next step", hotp(key, counter+1), 0, counter + 1, true},
+		{"too old", hotp(key, counter-2), 0, 0, false},
+		{"too new", hotp(key, counter+2), 0, 0, false},
+		{"already used", hotp(key, counter), counter, 0, false},
+		{"earlier than last used", hotp(key, counter-1), counter, 0, false},
+		{"later than last used", hotp(key, counter+1), counter, counter + 1, true},
+		{"short", hotp(key, counter)[:5], 0, 0, false},
+		{"empty", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(secret, tt.code, now, tt.lastCounter)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("ValidateTOTP = %d, %v; want %d, %v", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+
+	// Authenticator apps may show the secret in lower case
+	if _, ok := ValidateTOTP(strings.ToLower(secret), hotp(key, counter), now, 0); !ok {
+		t.Error("lower case secret was rejected")
+	}
+	if _, ok := ValidateTOTP("not base32!", hotp(key, counter), now, 0); ok {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 || len(hashes) != 10 {
+		t.Fatalf("got %d codes and %d hashes, want 10 each", len(codes), len(hashes))
+	}
+
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("code %s was generated twice", code)
+		}
+		seen[code] = true
+
+		if hashes[i] == code {
+			t.Error("code is stored as is")
+		}
+		// Codes are matched however they're typed
+		for _, typed := range []string{code, strings.ToUpper(code), strings.ReplaceAll(code, "-", ""), strings.ReplaceAll(code, "-", " ")} {
+			if HashRecoveryCode(typed) != hashes[i] {
+				t.Errorf("%q doesn't match the hash of %q", typed, code)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebhookSignature = errors.New("invalid webhook signature")
+	ErrWebhookTimestamp = errors.New("webhook timestamp outside the tolerance window")
+)
+
+// WebhookVerifier checks signed webhook deliveries. Senders sign
+// "<timestamp>.<body>" with HMAC-SHA256, where timestamp is in Unix seconds,
+// and send the timestamp and signature alongside the raw body. Signatures are
+// sent as "v1=<hex>", comma separated when the sender signs with several
+// secrets. Any active secret may match, so secrets can be rotated without
+// dropping deliveries.
+type WebhookVerifier struct {
+	secrets   [][]byte
+	tolerance time.Duration
+}
+
+// NewWebhookVerifier accepts deliveries signed with any of secrets whose
+// timestamp is within tolerance of now
+func NewWebhookVerifier(secrets []string, tolerance time.Duration) (*WebhookVerifier, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("at least one webhook secret is required")
+	}
+
+	v := &WebhookVerifier{tolerance: tolerance}
+	for _, secret := range secrets {
+		v.secrets = append(v.secrets, []byte(secret))
+	}
+	return v, nil
+}
+
+// SignWebhook returns the v1 signature of body sent at timestamp
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	return hex.EncodeToString(webhookMAC([]byte(secret), strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+func webhookMAC(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Verify checks that body was signed by the sender within the tolerance
+// window, and returns when it was signed. A delivery can be replayed until
+// the window closes, and senders retry ones that failed, so callers must
+// make handling it idempotent, for example by event ID.
+func (v *WebhookVerifier) Verify(timestamp, signatures string, body []byte) (time.Time, error) {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrWebhookSignature
+	}
+	sentAt := time.Unix(unix, 0)
+	now := time.Now()
+	if now.Sub(sentAt).Abs() > v.tolerance {
+		return time.Time{}, ErrWebhookTimestamp
+	}
+
+	matched := false
+	for _, signature := range strings.Split(signatures, ",") {
+		value, found := strings.CutPrefix(strings.TrimSpace(signature), "v1=")
+		if !found {
+			continue
+		}
+		candidate, err := hex.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		for _, secret := range v.secrets {
+			if hmac.Equal(candidate, webhookMAC(secret, timestamp, body)) {
+				matched = true
+			}
+		}
+	}
+	if !matched {
+		return time.Time{}, ErrWebhookSignature
+	}
+
+	return sentAt, nil
+}
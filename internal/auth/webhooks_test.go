@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookVerifierVerify(t *testing.T) {
+	v, err := NewWebhookVerifier([]string{"old-secret", "new-secret"}, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"id":"evt_1","event":"user.upgraded"}`)
+	now := time.Now()
+	stamp := func(at time.Time) string { return strconv.FormatInt(at.Unix(), 10) }
+
+	tests := []struct {
+		name       string
+		timestamp  string
+		signatures string
+		body       []byte
+		want       error
+	}{
+		{"signed", stamp(now), "v1=" + SignWebhook("new-secret", now, body), body, nil},
+		{"signed with a secret being rotated out", stamp(now), "v1=" + SignWebhook("old-secret", now, body), body, nil},
+		{"one of several signatures matches", stamp(now), "v1=abcd, v1=" + SignWebhook("new-secret", now, body), body, nil},
+		{"within the tolerance", stamp(now.Add(-4 * time.Minute)), "v1=" + SignWebhook("new-secret", now.Add(-4*time.Minute), body), body, nil},
+		{"unknown secret", stamp(now), "v1=" + SignWebhook("other-secret", now, body), body, ErrWebhookSignature},
+		{"tampered body", stamp(now), "v1=" + SignWebhook("new-secret", now, body), []byte(`{"id":"evt_2"}`), ErrWebhookSignature},
+		{"signature for another time", stamp(now), "v1=" + SignWebhook("new-secret", now.Add(-time.Second), body), body, ErrWebhookSignature},
+		{"unknown scheme", stamp(now), "v0=" + SignWebhook("new-secret", now, body), body, ErrWebhookSignature},
+		{"no signature", stamp(now), "", body, ErrWebhookSignature},
+		{"bad timestamp", "yesterday", "v1=" + SignWebhook("new-secret", now, body), body, ErrWebhookSignature},
+		{"too old", stamp(now.Add(-10 * time.Minute)), "v1=" + SignWebhook("new-secret", now.Add(-10*time.Minute), body), body, ErrWebhookTimestamp},
+		{"from the future", stamp(now.Add(10 * time.Minute)), "v1=" + SignWebhook("new-secret", now.Add(10*time.Minute), body), body, ErrWebhookTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sentAt, err := v.Verify(tt.timestamp, tt.signatures, tt.body)
+			if err != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			if err == nil && strconv.FormatInt(sentAt.Unix(), 10) != tt.timestamp {
+				t.Errorf("got signing time %v, want %s", sentAt, tt.timestamp)
+			}
+		})
+	}
+}
+
+func TestWebhookVerifierAcceptsRetries(t *testing.T) {
+	v, err := NewWebhookVerifier([]string{"secret"}, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sender retrying a delivery we failed to process sends it again as is
+	body := []byte(`{"id":"evt_1","event":"user.upgraded"}`)
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := "v1=" + SignWebhook("secret", now, body)
+	for attempt := 1; attempt <= 2; attempt++ {
+		_, err = v.Verify(timestamp, signature, body)
+		if err != nil {
+			t.Errorf("attempt %d: %v", attempt, err)
+		}
+	}
+}
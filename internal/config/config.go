@@ -0,0 +1,286 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+)
+
+// Config is every setting the server reads at startup. Each setting can be
+// given in the config file under its yaml key, in the environment variable
+// named by its env tag, or as a flag named after its dotted yaml path, such
+// as -server.port. Flags win over the environment, which wins over the
+// file. Settings tagged secret are redacted when printed, and those tagged
+// required must be set for the server to start.
+type Config struct {
+	Debug      bool   `yaml:"debug" env:"DEBUG"`
+	AdminToken string `yaml:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+
+	// DevMode allows settings that are only safe on a developer's machine,
+	// such as mailers that write tokens to the logs or to disk, and lets
+	// /reset wipe the database. Debug only turns on debug logging.
+	DevMode bool `yaml:"dev_mode" env:"DEV_MODE"`
+
+	Server        Server        `yaml:"server"`
+	Database      Database      `yaml:"database"`
+	Log           Log           `yaml:"log"`
+	Tracing       Tracing       `yaml:"tracing"`
+	Tokens        Tokens        `yaml:"tokens"`
+	Passwords     Passwords     `yaml:"passwords"`
+	Login         Login         `yaml:"login"`
+	Accounts      Accounts      `yaml:"accounts"`
+	Mail          Mail          `yaml:"mail"`
+	WebAuthn      WebAuthn      `yaml:"webauthn"`
+	Chirps        Chirps        `yaml:"chirps"`
+	Polka         Polka         `yaml:"polka"`
+	Subscriptions Subscriptions `yaml:"subscriptions"`
+	Webhooks      Webhooks      `yaml:"webhooks"`
+
+	// OIDC providers are keyed by name. From the environment, a provider
+	// listed in OIDC_PROVIDERS as "google" is read from OIDC_GOOGLE_ISSUER,
+	// OIDC_GOOGLE_CLIENT_ID, OIDC_GOOGLE_CLIENT_SECRET,
+	// OIDC_GOOGLE_REDIRECT_URL and OIDC_GOOGLE_SCOPES.
+	OIDC map[string]OIDCProvider `yaml:"oidc"`
+
+	// File is the config file the settings were read from, if any
+	File string `yaml:"-"`
+}
+
+type Server struct {
+	Port              string        `yaml:"port" env:"PORT"`
+	FileRoot          string        `yaml:"file_root" env:"FILE_ROOT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	ShutdownDrain     time.Duration `yaml:"shutdown_drain" env:"SHUTDOWN_DRAIN"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type Database struct {
+	Path string `yaml:"path" env:"DATABASE_PATH"`
+}
+
+type Log struct {
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+}
+
+type Tokens struct {
+	SigningAlg     string        `yaml:"signing_alg" env:"JWT_SIGNING_ALG"`
+	KeysFile       string        `yaml:"keys_file" env:"JWT_KEYS_FILE"`
+	KeyRotation    time.Duration `yaml:"key_rotation" env:"JWT_KEY_ROTATION"`
+	AccessTTL      time.Duration `yaml:"access_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTTL     time.Duration `yaml:"refresh_ttl" env:"REFRESH_TOKEN_TTL"`
+	MFATTL         time.Duration `yaml:"mfa_ttl" env:"MFA_CHALLENGE_TTL"`
+	Leeway         time.Duration `yaml:"leeway" env:"JWT_LEEWAY"`
+	Issuer         string        `yaml:"issuer" env:"JWT_ISSUER"`
+	Audience       string        `yaml:"audience" env:"JWT_AUDIENCE"`
+	RequiredClaims []string      `yaml:"required_claims" env:"JWT_REQUIRED_CLAIMS"`
+
+	// LegacySecret verifies HS256 tokens minted before signing keys.
+	// Unset it once the last of them has expired.
+	LegacySecret string `yaml:"legacy_secret" env:"JWT_SECRET" secret:"true"`
+}
+
+type Passwords struct {
+	Hash          string        `yaml:"hash" env:"PASSWORD_HASH"`
+	BcryptCost    int           `yaml:"bcrypt_cost" env:"PASSWORD_BCRYPT_COST"`
+	MinLength     int           `yaml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MaxLength     int           `yaml:"max_length" env:"PASSWORD_MAX_LENGTH"`
+	MinClasses    int           `yaml:"min_classes" env:"PASSWORD_MIN_CLASSES"`
+	DisallowEmail bool          `yaml:"disallow_email" env:"PASSWORD_DISALLOW_EMAIL"`
+	BreachedDir   string        `yaml:"breached_dir" env:"BREACHED_PASSWORDS_DIR"`
+	ResetTTL      time.Duration `yaml:"reset_ttl" env:"PASSWORD_RESET_TTL"`
+	// Reset requests allowed per client IP per hour
+	ResetLimit int `yaml:"reset_limit" env:"PASSWORD_RESET_LIMIT"`
+}
+
+type Login struct {
+	MaxFailures   int           `yaml:"max_failures" env:"LOGIN_MAX_FAILURES"`
+	IPMaxFailures int           `yaml:"ip_max_failures" env:"LOGIN_IP_MAX_FAILURES"`
+	Lockout       time.Duration `yaml:"lockout" env:"LOGIN_LOCKOUT"`
+	MaxLockout    time.Duration `yaml:"max_lockout" env:"LOGIN_MAX_LOCKOUT"`
+}
+
+type Accounts struct {
+	EmailVerificationTTL   time.Duration `yaml:"email_verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	UnverifiedRestrictions []string      `yaml:"unverified_restrictions" env:"UNVERIFIED_RESTRICTIONS"`
+	DeletionGrace          time.Duration `yaml:"deletion_grace" env:"ACCOUNT_DELETION_GRACE"`
+	DeletionChirps         string        `yaml:"deletion_chirps" env:"ACCOUNT_DELETION_CHIRPS"`
+	PurgeInterval          time.Duration `yaml:"purge_interval" env:"ACCOUNT_PURGE_INTERVAL"`
+	ExportDir              string        `yaml:"export_dir" env:"EXPORT_DIR"`
+	ExportTTL              time.Duration `yaml:"export_ttl" env:"EXPORT_TTL"`
+	ExportInterval         time.Duration `yaml:"export_interval" env:"EXPORT_INTERVAL"`
+}
+
+type Mail struct {
+	// The log and file mailers need dev_mode, and log is the default
+	// there. Otherwise it defaults to smtp.
+	Mailer   string `yaml:"mailer" env:"MAILER"`
+	Dir      string `yaml:"dir" env:"MAIL_DIR"`
+	From     string `yaml:"from" env:"MAIL_FROM"`
+	SMTPHost string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort string `yaml:"smtp_port" env:"SMTP_PORT"`
+	Username string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	Password string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+}
+
+type WebAuthn struct {
+	RPID string `yaml:"rp_id" env:"WEBAUTHN_RP_ID"`
+	// Defaults to the server's own localhost origin
+	RPOrigins []string `yaml:"rp_origins" env:"WEBAUTHN_RP_ORIGINS"`
+}
+
+type Chirps struct {
+	BannedWords      []string      `yaml:"banned_words" env:"CHIRP_BANNED_WORDS"`
+	EntitlementsFile string        `yaml:"entitlements_file" env:"ENTITLEMENTS_FILE"`
+	MediaDir         string        `yaml:"media_dir" env:"MEDIA_DIR"`
+	OrphanMediaTTL   time.Duration `yaml:"orphan_media_ttl" env:"ORPHAN_MEDIA_TTL"`
+}
+
+type Polka struct {
+	// While a secret is being rotated both the old and new one are listed
+	WebhookSecrets   []string      `yaml:"webhook_secrets" env:"POLKA_WEBHOOK_SECRETS" secret:"true" required:"true"`
+	WebhookTolerance time.Duration `yaml:"webhook_tolerance" env:"POLKA_WEBHOOK_TOLERANCE"`
+}
+
+type Subscriptions struct {
+	Period         time.Duration `yaml:"period" env:"SUBSCRIPTION_PERIOD"`
+	ExpiryInterval time.Duration `yaml:"expiry_interval" env:"SUBSCRIPTION_EXPIRY_INTERVAL"`
+}
+
+type Webhooks struct {
+	AllowPrivate     bool          `yaml:"allow_private" env:"WEBHOOK_ALLOW_PRIVATE"`
+	MaxAttempts      int           `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	RetryBase        time.Duration `yaml:"retry_base" env:"WEBHOOK_RETRY_BASE"`
+	RetryMax         time.Duration `yaml:"retry_max" env:"WEBHOOK_RETRY_MAX"`
+	HistoryTTL       time.Duration `yaml:"history_ttl" env:"WEBHOOK_HISTORY_TTL"`
+	DeliveryInterval time.Duration `yaml:"delivery_interval" env:"WEBHOOK_DELIVERY_INTERVAL"`
+}
+
+type OIDCProvider struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// Default returns the settings used when nothing else is given
+func Default() Config {
+	tokens := auth.DefaultTokenPolicy()
+	passwords := auth.DefaultPasswordPolicy()
+
+	return Config{
+		Server: Server{
+			Port:              "8080",
+			FileRoot:          "public",
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      2 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownDrain:     5 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: Database{Path: "database.json"},
+		Log:      Log{Format: "text"},
+		Tokens: Tokens{
+			SigningAlg:     auth.AlgRS256,
+			KeysFile:       "jwt_keys.json",
+			KeyRotation:    30 * 24 * time.Hour,
+			AccessTTL:      tokens.AccessTTL,
+			RefreshTTL:     tokens.RefreshTTL,
+			MFATTL:         tokens.MFATTL,
+			Leeway:         tokens.Leeway,
+			Issuer:         tokens.Issuer,
+			Audience:       tokens.Audience,
+			RequiredClaims: tokens.RequiredClaims,
+		},
+		Passwords: Passwords{
+			Hash:          auth.HashArgon2id,
+			BcryptCost:    12,
+			MinLength:     passwords.MinLength,
+			MaxLength:     passwords.MaxLength,
+			MinClasses:    passwords.MinClasses,
+			DisallowEmail: passwords.DisallowEmail,
+			ResetTTL:      time.Hour,
+			ResetLimit:    5,
+		},
+		Login: Login{
+			MaxFailures:   5,
+			IPMaxFailures: 50,
+			Lockout:       time.Minute,
+			MaxLockout:    time.Hour,
+		},
+		Accounts: Accounts{
+			EmailVerificationTTL:   24 * time.Hour,
+			UnverifiedRestrictions: []string{"post_chirp"},
+			DeletionGrace:          30 * 24 * time.Hour,
+			DeletionChirps:         "delete",
+			PurgeInterval:          time.Hour,
+			ExportDir:              "exports",
+			ExportTTL:              7 * 24 * time.Hour,
+			ExportInterval:         24 * time.Hour,
+		},
+		Mail:     Mail{SMTPPort: "587"},
+		WebAuthn: WebAuthn{RPID: "localhost"},
+		Chirps: Chirps{
+			BannedWords:    []string{"kerfuffle", "sharbert", "fornax"},
+			MediaDir:       "media",
+			OrphanMediaTTL: 24 * time.Hour,
+		},
+		Polka: Polka{WebhookTolerance: 5 * time.Minute},
+		Subscriptions: Subscriptions{
+			Period:         30 * 24 * time.Hour,
+			ExpiryInterval: 10 * time.Minute,
+		},
+		Webhooks: Webhooks{
+			MaxAttempts:      8,
+			RetryBase:        30 * time.Second,
+			RetryMax:         6 * time.Hour,
+			HistoryTTL:       30 * 24 * time.Hour,
+			DeliveryInterval: 5 * time.Second,
+		},
+	}
+}
+
+// Validate reports every required setting that is missing, so they can all
+// be fixed at once
+func (c Config) Validate() error {
+	var missing []string
+	walk(&c, func(f field) {
+		if f.required && f.empty() {
+			missing = append(missing, f.describe())
+		}
+	})
+	if c.Mail.Mailer == "smtp" {
+		if c.Mail.SMTPHost == "" {
+			missing = append(missing, "mail.smtp_host (env SMTP_HOST)")
+		}
+		if c.Mail.From == "" {
+			missing = append(missing, "mail.from (env MAIL_FROM)")
+		}
+	}
+	for name, provider := range c.OIDC {
+		if provider.ClientSecret == "" {
+			missing = append(missing, fmt.Sprintf("oidc.%s.client_secret (env OIDC_%s_CLIENT_SECRET)", name, strings.ToUpper(name)))
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("missing required settings: " + strings.Join(missing, ", "))
+	}
+
+	// These mailers put reset and verification tokens where anyone with
+	// access to the logs or the disk can use them
+	if (c.Mail.Mailer == "log" || c.Mail.Mailer == "file") && !c.DevMode {
+		return fmt.Errorf("mail.mailer %q is only allowed with dev_mode (env DEV_MODE)", c.Mail.Mailer)
+	}
+	return nil
+}
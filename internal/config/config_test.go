@@ -0,0 +1,293 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// clearEnv unsets every variable the config reads for the rest of the test
+func clearEnv(t *testing.T) {
+	t.Helper()
+
+	names := []string{"CHIRPY_CONFIG", "OIDC_PROVIDERS"}
+	cfg := Default()
+	walk(&cfg, func(f field) { names = append(names, f.env) })
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "chirpy.yaml")
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		flags    []string
+		wantPort string
+		wantTTL  string
+	}{
+		{
+			name:     "defaults",
+			wantPort: "8080",
+			wantTTL:  "1h0m0s",
+		},
+		{
+			name:     "file",
+			file:     "server:\n  port: \"1111\"\npasswords:\n  reset_ttl: 2h\n",
+			wantPort: "1111",
+			wantTTL:  "2h0m0s",
+		},
+		{
+			name:     "env over file",
+			file:     "server:\n  port: \"1111\"\npasswords:\n  reset_ttl: 2h\n",
+			env:      map[string]string{"PORT": "2222", "PASSWORD_RESET_TTL": "3h"},
+			wantPort: "2222",
+			wantTTL:  "3h0m0s",
+		},
+		{
+			name:     "flag over env and file",
+			file:     "server:\n  port: \"1111\"\npasswords:\n  reset_ttl: 2h\n",
+			env:      map[string]string{"PORT": "2222", "PASSWORD_RESET_TTL": "3h"},
+			flags:    []string{"-server.port", "3333", "-passwords.reset_ttl", "4h"},
+			wantPort: "3333",
+			wantTTL:  "4h0m0s",
+		},
+		{
+			name:     "empty env doesn't clear a duration",
+			env:      map[string]string{"PASSWORD_RESET_TTL": ""},
+			wantPort: "8080",
+			wantTTL:  "1h0m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.flags
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			args = append(args, "role", "user@example.com", "admin")
+
+			cfg, rest, err := Load(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.Port != tt.wantPort {
+				t.Errorf("port = %s, want %s", cfg.Server.Port, tt.wantPort)
+			}
+			if got := cfg.Passwords.ResetTTL.String(); got != tt.wantTTL {
+				t.Errorf("reset TTL = %s, want %s", got, tt.wantTTL)
+			}
+			if !slices.Equal(rest, []string{"role", "user@example.com", "admin"}) {
+				t.Errorf("remaining args = %v, want the command", rest)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsBadSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags []string
+	}{
+		{name: "unknown file key", file: "server:\n  prot: \"1111\"\n"},
+		{name: "invalid env duration", env: map[string]string{"PASSWORD_RESET_TTL": "soon"}},
+		{name: "invalid flag number", flags: []string{"-login.max_failures", "many"}},
+		{name: "missing file", flags: []string{"-config", "does-not-exist.yaml"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.flags
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			_, _, err := Load(args)
+			if err == nil {
+				t.Error("Load succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestLoadDefaultMailer(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"production", nil, "smtp"},
+		{"dev mode", map[string]string{"DEV_MODE": "true"}, "log"},
+		{"dev mode with smtp", map[string]string{"DEV_MODE": "true", "MAILER": "smtp"}, "smtp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, _, err := Load(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Mail.Mailer != tt.want {
+				t.Errorf("mailer = %s, want %s", cfg.Mail.Mailer, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		cfg := Default()
+		cfg.Polka.WebhookSecrets = []string{"polka-secret"}
+		cfg.Mail.Mailer = "smtp"
+		cfg.Mail.SMTPHost = "smtp.example.com"
+		cfg.Mail.From = "chirpy@example.com"
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr []string
+	}{
+		{name: "valid", change: func(*Config) {}},
+		{
+			name:    "no polka secrets",
+			change:  func(c *Config) { c.Polka.WebhookSecrets = nil },
+			wantErr: []string{"polka.webhook_secrets (env POLKA_WEBHOOK_SECRETS)"},
+		},
+		{
+			name:    "smtp without host",
+			change:  func(c *Config) { c.Mail.SMTPHost = "" },
+			wantErr: []string{"mail.smtp_host (env SMTP_HOST)"},
+		},
+		{
+			name:    "smtp without from",
+			change:  func(c *Config) { c.Mail.From = "" },
+			wantErr: []string{"mail.from (env MAIL_FROM)"},
+		},
+		{
+			name: "everything missing at once",
+			change: func(c *Config) {
+				c.Polka.WebhookSecrets = nil
+				c.Mail.SMTPHost = ""
+				c.Mail.From = ""
+			},
+			wantErr: []string{"polka.webhook_secrets", "mail.smtp_host", "mail.from"},
+		},
+		{
+			name: "log mailer needs no smtp settings in dev mode",
+			change: func(c *Config) {
+				c.DevMode = true
+				c.Mail = Mail{Mailer: "log"}
+			},
+		},
+		{
+			name:    "log mailer outside dev mode",
+			change:  func(c *Config) { c.Mail.Mailer = "log" },
+			wantErr: []string{`mail.mailer "log" is only allowed with dev_mode`},
+		},
+		{
+			name:    "file mailer outside dev mode",
+			change:  func(c *Config) { c.Mail.Mailer = "file" },
+			wantErr: []string{`mail.mailer "file" is only allowed with dev_mode`},
+		},
+		{
+			name: "oidc provider without a secret",
+			change: func(c *Config) {
+				c.OIDC = map[string]OIDCProvider{"google": {ClientID: "client"}}
+			},
+			wantErr: []string{"oidc.google.client_secret (env OIDC_GOOGLE_CLIENT_SECRET)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(&cfg)
+
+			err := cfg.Validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate = nil, want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate = %q, want it to mention %s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.AdminToken = "admin-token-value"
+	cfg.Tokens.LegacySecret = "legacy-secret-value"
+	cfg.Mail.Password = "smtp-password-value"
+	cfg.Polka.WebhookSecrets = []string{"polka-old-value", "polka-new-value"}
+	cfg.OIDC = map[string]OIDCProvider{"google": {ClientID: "google-client", ClientSecret: "oidc-secret-value"}}
+
+	var out bytes.Buffer
+	err := cfg.Print(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := out.String()
+
+	for _, secret := range []string{"admin-token-value", "legacy-secret-value", "smtp-password-value", "polka-old-value", "polka-new-value", "oidc-secret-value"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("printed config contains %s", secret)
+		}
+	}
+	// Two redacted webhook secrets show a rotation is in progress
+	if n := strings.Count(printed, redacted); n != 6 {
+		t.Errorf("printed %d redactions, want 6:\n%s", n, printed)
+	}
+	for _, setting := range []string{"port: \"8080\"", "client_id: google-client"} {
+		if !strings.Contains(printed, setting) {
+			t.Errorf("printed config is missing %s:\n%s", setting, printed)
+		}
+	}
+
+	// Printing mustn't redact the settings in use
+	if cfg.Polka.WebhookSecrets[0] != "polka-old-value" || cfg.OIDC["google"].ClientSecret != "oidc-secret-value" {
+		t.Error("Print changed the config")
+	}
+}
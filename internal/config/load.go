@@ -0,0 +1,303 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// Load reads the configuration from the defaults, the config file named by
+// -config or CHIRPY_CONFIG, the environment and the flags in args, which is
+// the command line without the program name. It returns the arguments left
+// after the flags.
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CHIRPY_CONFIG"), "YAML config file (env CHIRPY_CONFIG)")
+	var flags []*flagValue
+	walk(&cfg, func(f field) {
+		value := &flagValue{field: f}
+		flags = append(flags, value)
+		fs.Var(value, f.path, "env "+f.env)
+	})
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if *path != "" {
+		err = loadFile(&cfg, *path)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("config file %s: %w", *path, err)
+		}
+		cfg.File = *path
+	}
+
+	err = loadEnv(&cfg)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	for _, value := range flags {
+		if value.isSet {
+			err = value.field.set(value.raw)
+			if err != nil {
+				return Config{}, nil, err
+			}
+		}
+	}
+
+	if len(cfg.WebAuthn.RPOrigins) == 0 {
+		cfg.WebAuthn.RPOrigins = []string{"http://localhost:" + cfg.Server.Port}
+	}
+	if cfg.Mail.Mailer == "" {
+		cfg.Mail.Mailer = "smtp"
+		if cfg.DevMode {
+			cfg.Mail.Mailer = "log"
+		}
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// loadFile overlays the settings in a YAML file. Unknown keys are rejected
+// so a typo doesn't silently leave the default in place.
+func loadFile(cfg *Config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// loadEnv overlays the settings found in the environment. Empty variables
+// only count for text and lists, where empty can be meant.
+func loadEnv(cfg *Config) error {
+	var err error
+	walk(cfg, func(f field) {
+		value, ok := os.LookupEnv(f.env)
+		if !ok || err != nil {
+			return
+		}
+		if value == "" && f.value.Kind() != reflect.String && f.value.Kind() != reflect.Slice {
+			return
+		}
+		err = f.set(value)
+	})
+	if err != nil {
+		return err
+	}
+
+	names, ok := os.LookupEnv("OIDC_PROVIDERS")
+	if !ok {
+		return nil
+	}
+	if cfg.OIDC == nil {
+		cfg.OIDC = make(map[string]OIDCProvider)
+	}
+	for _, name := range SplitList(names) {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := cfg.OIDC[name]
+		lookupString(prefix+"ISSUER", &provider.Issuer)
+		lookupString(prefix+"CLIENT_ID", &provider.ClientID)
+		lookupString(prefix+"CLIENT_SECRET", &provider.ClientSecret)
+		lookupString(prefix+"REDIRECT_URL", &provider.RedirectURL)
+		if scopes, ok := os.LookupEnv(prefix + "SCOPES"); ok {
+			provider.Scopes = SplitList(scopes)
+		}
+		cfg.OIDC[name] = provider
+	}
+	return nil
+}
+
+func lookupString(name string, value *string) {
+	if s, ok := os.LookupEnv(name); ok {
+		*value = s
+	}
+}
+
+// Print writes the settings as YAML, in the same form the config file
+// takes, with secrets redacted
+func (c Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(c.redacted())
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func (c Config) redacted() Config {
+	walk(&c, func(f field) {
+		if !f.secret || f.empty() {
+			return
+		}
+		switch f.value.Kind() {
+		case reflect.String:
+			f.value.SetString(redacted)
+		case reflect.Slice:
+			secrets := make([]string, f.value.Len())
+			for i := range secrets {
+				secrets[i] = redacted
+			}
+			f.value.Set(reflect.ValueOf(secrets))
+		}
+	})
+
+	providers := make(map[string]OIDCProvider, len(c.OIDC))
+	for name, provider := range c.OIDC {
+		if provider.ClientSecret != "" {
+			provider.ClientSecret = redacted
+		}
+		providers[name] = provider
+	}
+	c.OIDC = providers
+	return c
+}
+
+// SplitList splits a comma or space separated list
+func SplitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// field is one setting, found by walking the Config struct
+type field struct {
+	path     string
+	env      string
+	secret   bool
+	required bool
+	value    reflect.Value
+}
+
+func (f field) describe() string {
+	return fmt.Sprintf("%s (env %s)", f.path, f.env)
+}
+
+func (f field) empty() bool {
+	if f.value.Kind() == reflect.Slice {
+		return f.value.Len() == 0
+	}
+	return f.value.IsZero()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the setting
+func (f field) set(s string) error {
+	if f.value.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", f.describe(), err)
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", f.describe(), err)
+		}
+		f.value.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", f.describe(), err)
+		}
+		f.value.SetInt(int64(n))
+	case reflect.Slice:
+		f.value.Set(reflect.ValueOf(SplitList(s)))
+	default:
+		return fmt.Errorf("%s has an unsupported type", f.path)
+	}
+	return nil
+}
+
+// walk calls fn for every setting in cfg that can come from the environment
+func walk(cfg *Config, fn func(field)) {
+	walkStruct(reflect.ValueOf(cfg).Elem(), "", fn)
+}
+
+func walkStruct(v reflect.Value, prefix string, fn func(field)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if v.Field(i).Kind() == reflect.Struct {
+			walkStruct(v.Field(i), prefix+name+".", fn)
+			continue
+		}
+		env := sf.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		fn(field{
+			path:     prefix + name,
+			env:      env,
+			secret:   sf.Tag.Get("secret") == "true",
+			required: sf.Tag.Get("required") == "true",
+			value:    v.Field(i),
+		})
+	}
+}
+
+// flagValue holds a setting given on the command line until the file and
+// environment have been read, since flags take precedence over both
+type flagValue struct {
+	field field
+	raw   string
+	isSet bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil || !v.field.value.IsValid() {
+		return ""
+	}
+	if v.field.secret {
+		return ""
+	}
+	if v.field.value.Kind() == reflect.Slice {
+		return strings.Join(v.field.value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.field.value.Interface())
+}
+
+func (v *flagValue) Set(s string) error {
+	// Parsed into a scratch value now only to report mistakes early
+	scratch := v.field
+	scratch.value = reflect.New(v.field.value.Type()).Elem()
+	err := scratch.set(s)
+	if err != nil {
+		return err
+	}
+	v.raw = s
+	v.isSet = true
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.field.value.IsValid() && v.field.value.Kind() == reflect.Bool
+}
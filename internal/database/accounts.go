@@ -0,0 +1,111 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// DeleteUser permanently removes a user whose deletion was due by now, and
+// everything tied to them. Their chirps are deleted, or kept without an
+// author when anonymizeChirps is set. ErrDeletionNotDue is returned if the
+// deletion was cancelled or isn't due yet. The user's data exports and
+// uploads are returned, since removing their files is up to the caller.
+func (db *DB) DeleteUser(userId int, now time.Time, anonymizeChirps bool) ([]DataExport, []Media, error) {
+	db, span := db.startOperation("DeleteUser", userID(userId))
+	defer span.End()
+
+	var exports []DataExport
+	var media []Media
+	err := db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
+		}
+		// The user may have restored their account since the purge looked
+		if user.DeletionScheduledAt.IsZero() || now.Before(user.DeletionScheduledAt) {
+			return ErrDeletionNotDue
+		}
+
+		delete(dbStructure.Users, userId)
+
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.AuthorId != userId {
+				continue
+			}
+			if anonymizeChirps {
+				chirp.AuthorId = 0
+				chirp.Media = nil
+				dbStructure.Chirps[id] = chirp
+			} else {
+				delete(dbStructure.Chirps, id)
+			}
+		}
+
+		for key, reset := range dbStructure.PasswordResets {
+			if reset.UserId == userId {
+				delete(dbStructure.PasswordResets, key)
+			}
+		}
+		for key, verification := range dbStructure.EmailVerifications {
+			if verification.UserId == userId {
+				delete(dbStructure.EmailVerifications, key)
+			}
+		}
+		for key, passkey := range dbStructure.Passkeys {
+			if passkey.UserId == userId {
+				delete(dbStructure.Passkeys, key)
+			}
+		}
+		for key, identity := range dbStructure.Identities {
+			if identity.UserId == userId {
+				delete(dbStructure.Identities, key)
+			}
+		}
+		for key, token := range dbStructure.PersonalTokens {
+			if token.UserId == userId {
+				delete(dbStructure.PersonalTokens, key)
+			}
+		}
+		for key, export := range dbStructure.DataExports {
+			if export.UserId == userId {
+				exports = append(exports, export)
+				delete(dbStructure.DataExports, key)
+			}
+		}
+		for key, upload := range dbStructure.Media {
+			if upload.UserId == userId {
+				media = append(media, upload)
+				delete(dbStructure.Media, key)
+			}
+		}
+		for key, endpoint := range dbStructure.WebhookEndpoints {
+			if endpoint.OwnerId == userId {
+				delete(dbStructure.WebhookEndpoints, key)
+			}
+		}
+		for key, delivery := range dbStructure.WebhookDeliveries {
+			if _, ok := dbStructure.WebhookEndpoints[delivery.EndpointId]; !ok {
+				delete(dbStructure.WebhookDeliveries, key)
+			}
+		}
+
+		// Apps the user registered go too, along with everyone's grants to them
+		for key, client := range dbStructure.OAuthClients {
+			if client.OwnerId == userId {
+				delete(dbStructure.OAuthClients, key)
+			}
+		}
+		for key, grant := range dbStructure.OAuthGrants {
+			if _, ok := dbStructure.OAuthClients[grant.ClientId]; grant.UserId == userId || !ok {
+				delete(dbStructure.OAuthGrants, key)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return exports, media, nil
+}
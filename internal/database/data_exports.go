@@ -0,0 +1,153 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// SaveDataExport creates or replaces a data export
+func (db *DB) SaveDataExport(export DataExport) (DataExport, error) {
+	db, span := db.startOperation("SaveDataExport", userID(export.UserId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	if _, ok := dbStructure.Users[export.UserId]; !ok {
+		return DataExport{}, errors.New("user not found")
+	}
+
+	dbStructure.DataExports[export.Id] = export
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return DataExport{}, err
+	}
+
+	return export, nil
+}
+
+// StartDataExport saves a new pending export unless the user already has
+// one pending, or asked for one that didn't fail within interval. In that
+// case it returns the earlier export and false.
+func (db *DB) StartDataExport(export DataExport, interval time.Duration) (DataExport, bool, error) {
+	db, span := db.startOperation("StartDataExport", userID(export.UserId))
+	defer span.End()
+
+	started := false
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[export.UserId]; !ok {
+			return errors.New("user not found")
+		}
+
+		for _, earlier := range dbStructure.DataExports {
+			if earlier.UserId != export.UserId || earlier.Status == ExportFailed {
+				continue
+			}
+			if earlier.Status == ExportPending || export.RequestedAt.Before(earlier.RequestedAt.Add(interval)) {
+				export = earlier
+				return nil
+			}
+		}
+
+		dbStructure.DataExports[export.Id] = export
+		started = true
+		return nil
+	})
+	if err != nil {
+		return DataExport{}, false, err
+	}
+
+	return export, started, nil
+}
+
+// FailPendingDataExports marks every pending export failed and returns
+// them. Meant for startup, when nothing can still be building them.
+func (db *DB) FailPendingDataExports() ([]DataExport, error) {
+	db, span := db.startOperation("FailPendingDataExports")
+	defer span.End()
+
+	var failed []DataExport
+	err := db.update(func(dbStructure *DBStructure) error {
+		for id, export := range dbStructure.DataExports {
+			if export.Status != ExportPending {
+				continue
+			}
+			export.Status = ExportFailed
+			dbStructure.DataExports[id] = export
+			failed = append(failed, export)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return failed, nil
+}
+
+// GetLatestDataExport returns the export a user requested most recently
+func (db *DB) GetLatestDataExport(userId int) (DataExport, error) {
+	db, span := db.startOperation("GetLatestDataExport", userID(userId))
+	defer span.End()
+
+	exports, err := db.GetDataExports(&userId)
+	if err != nil {
+		return DataExport{}, err
+	}
+	if len(exports) == 0 {
+		return DataExport{}, errors.New("export not found")
+	}
+
+	return exports[len(exports)-1], nil
+}
+
+// GetDataExports returns every export, or only a user's, oldest first
+func (db *DB) GetDataExports(userId *int) ([]DataExport, error) {
+	db, span := db.startOperation("GetDataExports")
+	defer span.End()
+	if userId != nil {
+		span.SetAttributes(userID(*userId))
+	}
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []DataExport{}, err
+	}
+
+	exports := make([]DataExport, 0)
+	for _, export := range dbStructure.DataExports {
+		if userId != nil && export.UserId != *userId {
+			continue
+		}
+		exports = append(exports, export)
+	}
+
+	sort.Slice(exports, func(i, j int) bool { return exports[i].RequestedAt.Before(exports[j].RequestedAt) })
+	return exports, nil
+}
+
+// DeleteDataExport forgets an export. Removing its file is up to the caller.
+func (db *DB) DeleteDataExport(id string) error {
+	db, span := db.startOperation("DeleteDataExport")
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := dbStructure.DataExports[id]; !ok {
+		return errors.New("export not found")
+	}
+
+	delete(dbStructure.DataExports, id)
+
+	return db.writeDB(dbStructure)
+}
@@ -4,12 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 func (db *DB) GetRevokedTokens() (map[string]time.Time, error) {
+	db, span := db.startOperation("GetRevokedTokens")
+	defer span.End()
+
 	dbStructure, err := db.loadDB()
 	if err != nil {
 		return map[string]time.Time{}, err
@@ -19,6 +24,9 @@ func (db *DB) GetRevokedTokens() (map[string]time.Time, error) {
 }
 
 func (db *DB) UpdateRevokedTokens(token string) error {
+	db, span := db.startOperation("UpdateRevokedTokens")
+	defer span.End()
+
 	dbStructure, err := db.loadDB()
 	if err != nil {
 		return err
@@ -34,82 +42,131 @@ func (db *DB) UpdateRevokedTokens(token string) error {
 	return nil
 }
 
-func (db *DB) UpdateUser(Id int, email, password string, isChirpyRed bool) (User, error) {
-	dbStructure, err := db.loadDB()
+// UpdateUser replaces a stored user with user
+func (db *DB) UpdateUser(user User) (User, error) {
+	db, span := db.startOperation("UpdateUser", userID(user.Id))
+	defer span.End()
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.Users[user.Id]
+		if !ok {
+			return errors.New("failed to update user")
+		}
+
+		dbStructure.Users[user.Id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	newUser := User{
-		Id:          Id,
-		Email:       email,
-		Password:    password,
-		IsChirpyRed: isChirpyRed,
-	}
+	return user, nil
+}
 
-	_, ok := dbStructure.Users[Id]
-	if !ok {
-		return User{}, errors.New("failed to update user")
-	}
+// UpdateUserFunc applies fn to a stored user and saves the result in one
+// locked operation, for changes that depend on the user's current state.
+// Nothing is saved if fn returns an error.
+func (db *DB) UpdateUserFunc(id int, fn func(*User) error) (User, error) {
+	db, span := db.startOperation("UpdateUserFunc", userID(id))
+	defer span.End()
+
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			return errors.New("user not found")
+		}
 
-	dbStructure.Users[Id] = newUser
+		err := fn(&user)
+		if err != nil {
+			return err
+		}
 
-	err = db.writeDB(dbStructure)
+		dbStructure.Users[id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	return newUser, nil
+	return user, nil
 }
 
-// CreateUser creates a new user and saves it to disk
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
+// RevokeSessions invalidates every token issued to a user before now
+func (db *DB) RevokeSessions(userId int) error {
+	db, span := db.startOperation("RevokeSessions", userID(userId))
+	defer span.End()
 
-	for _, user := range dbStructure.Users {
-		if email == user.Email {
-			return User{}, errors.New("a user with this email already exists")
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return errors.New("user not found")
 		}
-	}
 
-	newId := len(dbStructure.Users) + 1
+		user.SessionsRevokedAt = time.Now().UTC()
+		dbStructure.Users[userId] = user
+		return nil
+	})
+}
 
-	newUser := User{
-		Id:          newId,
-		Email:       email,
-		Password:    password,
-		IsChirpyRed: false,
-	}
+// CreateUser creates a new user and saves it to disk
+func (db *DB) CreateUser(email string, password string) (User, error) {
+	db, span := db.startOperation("CreateUser")
+	defer span.End()
+
+	var newUser User
+	err := db.update(func(dbStructure *DBStructure) error {
+		for _, user := range dbStructure.Users {
+			if strings.EqualFold(email, user.Email) {
+				return errors.New("a user with this email already exists")
+			}
+		}
 
-	dbStructure.Users[newId] = newUser
+		newId := nextId(&dbStructure.LastUserId, dbStructure.Users)
 
-	err = db.writeDB(dbStructure)
+		newUser = User{
+			Id:          newId,
+			Email:       email,
+			Password:    password,
+			IsChirpyRed: false,
+			Subscription: Subscription{
+				Plan: PlanFree,
+			},
+		}
+
+		dbStructure.Users[newId] = newUser
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
+	span.SetAttributes(userID(newUser.Id))
 
 	return newUser, nil
 }
 
 // CreateUser creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
+func (db *DB) CreateChirp(body string, authorId int, media []string) (Chirp, error) {
+	db, span := db.startOperation("CreateChirp", userID(authorId))
+	defer span.End()
+
 	dbStructure, err := db.loadDB()
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	newId := len(dbStructure.Chirps) + 1
+	newId := nextId(&dbStructure.LastChirpId, dbStructure.Chirps)
 
 	newChirp := Chirp{
 		Id:       newId,
 		Body:     body,
 		AuthorId: authorId,
+		Media:    media,
 	}
 
 	dbStructure.Chirps[newId] = newChirp
+	span.SetAttributes(chirpID(newId))
 
 	err = db.writeDB(dbStructure)
 	if err != nil {
@@ -121,6 +178,12 @@ func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
 
 // GetChirps returns all chirps in the database
 func (db *DB) GetChirps(author_id *int) ([]Chirp, error) {
+	db, span := db.startOperation("GetChirps")
+	defer span.End()
+	if author_id != nil {
+		span.SetAttributes(userID(*author_id))
+	}
+
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
@@ -141,7 +204,55 @@ func (db *DB) GetChirps(author_id *int) ([]Chirp, error) {
 	return chirps, nil
 }
 
+// GetChirp returns a single chirp
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	db, span := db.startOperation("GetChirp", chirpID(id))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp, ok := dbStructure.Chirps[id]
+	if !ok {
+		return Chirp{}, errors.New("chirp not found")
+	}
+
+	return chirp, nil
+}
+
+// UpdateChirp saves changes to an existing chirp
+func (db *DB) UpdateChirp(chirp Chirp) (Chirp, error) {
+	db, span := db.startOperation("UpdateChirp", chirpID(chirp.Id), userID(chirp.AuthorId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	if _, ok := dbStructure.Chirps[chirp.Id]; !ok {
+		return Chirp{}, errors.New("chirp not found")
+	}
+
+	dbStructure.Chirps[chirp.Id] = chirp
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
 func (db *DB) DeleteChirp(id int) error {
+	db, span := db.startOperation("DeleteChirp", chirpID(id))
+	defer span.End()
+
 	dbStructure, err := db.loadDB()
 	if err != nil {
 		return err
@@ -163,6 +274,9 @@ func (db *DB) DeleteChirp(id int) error {
 
 // GetUsers returns all users in the database
 func (db *DB) GetUsers() ([]User, error) {
+	db, span := db.startOperation("GetUsers")
+	defer span.End()
+
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
@@ -181,6 +295,9 @@ func (db *DB) GetUsers() ([]User, error) {
 }
 
 func (db *DB) GetUser(id int) (User, error) {
+	db, span := db.startOperation("GetUser", userID(id))
+	defer span.End()
+
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
@@ -197,12 +314,35 @@ func (db *DB) GetUser(id int) (User, error) {
 	return user, nil
 }
 
+// GetUserByEmail returns the user registered with email
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	db, span := db.startOperation("GetUserByEmail")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	for _, user := range dbStructure.Users {
+		if strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+
+	return User{}, errors.New("user not found")
+}
+
 // NewDB creates a new database connection
 // and creates the database file if it doesn't exist
 func NewDB(path string, makeNew bool) (*DB, error) {
 	db := DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:   path,
+		mux:    &sync.RWMutex{},
+		closed: new(bool),
 	}
 	err := db.ensureDB(makeNew)
 	if err != nil {
@@ -212,6 +352,11 @@ func NewDB(path string, makeNew bool) (*DB, error) {
 	return &db, nil
 }
 
+// SetObserver reports file operations to o from now on
+func (db *DB) SetObserver(o Observer) {
+	db.observer = o
+}
+
 // ensureDB creates a new database file if it doesn't exist
 func (db *DB) ensureDB(makeNew bool) error {
 	db.mux.Lock()
@@ -232,51 +377,239 @@ func (db *DB) ensureDB(makeNew bool) error {
 	return nil
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	file, err := os.ReadFile(db.path)
-	if err != nil {
-		return DBStructure{}, err
+// Close waits for any write in progress, makes sure it has reached the disk
+// and refuses writes from then on, so the file is left whole when the server
+// stops
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if *db.closed {
+		return nil
 	}
+	*db.closed = true
 
-	dbStructure := DBStructure{
-		Chirps:        make(map[int]Chirp),
-		Users:         make(map[int]User),
-		RevokedTokens: make(map[string]time.Time),
+	file, err := os.Open(db.path)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Check makes sure the database file can still be read and written
+func (db *DB) Check() error {
+	db, span := db.startOperation("Check")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	if len(file) == 0 {
-		return dbStructure, nil
+	if *db.closed {
+		return ErrClosed
+	}
+	file, err := os.OpenFile(db.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
 	}
+	return file.Close()
+}
+
+// Reset deletes everything in the database
+func (db *DB) Reset() error {
+	db, span := db.startOperation("Reset")
+	defer span.End()
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.replaceFile(nil)
+}
 
-	err = json.Unmarshal(file, &dbStructure)
+// loadDB reads the database file into memory
+func (db *DB) loadDB() (_ DBStructure, err error) {
+	span := db.startSpan("database.load")
+	var file []byte
+	defer func() { endSpan(span, len(file), err) }()
+
+	start := time.Now()
+	file, err = os.ReadFile(db.path)
 	if err != nil {
 		return DBStructure{}, err
 	}
 
+	dbStructure := DBStructure{}
+
+	if len(file) > 0 {
+		err = json.Unmarshal(file, &dbStructure)
+		if err != nil {
+			return DBStructure{}, err
+		}
+	}
+
+	// Files written by older versions may be missing newer collections
 	if dbStructure.Chirps == nil {
 		dbStructure.Chirps = make(map[int]Chirp)
+	}
+	if dbStructure.Users == nil {
 		dbStructure.Users = make(map[int]User)
+	}
+	if dbStructure.RevokedTokens == nil {
 		dbStructure.RevokedTokens = make(map[string]time.Time)
 	}
+	if dbStructure.PasswordResets == nil {
+		dbStructure.PasswordResets = make(map[string]PasswordReset)
+	}
+	if dbStructure.EmailVerifications == nil {
+		dbStructure.EmailVerifications = make(map[string]EmailVerification)
+	}
+	if dbStructure.Passkeys == nil {
+		dbStructure.Passkeys = make(map[string]Passkey)
+	}
+	if dbStructure.Identities == nil {
+		dbStructure.Identities = make(map[string]Identity)
+	}
+	if dbStructure.OAuthClients == nil {
+		dbStructure.OAuthClients = make(map[string]OAuthClient)
+	}
+	if dbStructure.OAuthGrants == nil {
+		dbStructure.OAuthGrants = make(map[string]OAuthGrant)
+	}
+	if dbStructure.PersonalTokens == nil {
+		dbStructure.PersonalTokens = make(map[string]PersonalToken)
+	}
+	if dbStructure.DataExports == nil {
+		dbStructure.DataExports = make(map[string]DataExport)
+	}
+	if dbStructure.WebhookEvents == nil {
+		dbStructure.WebhookEvents = make(map[string]WebhookEvent)
+	}
+	if dbStructure.Media == nil {
+		dbStructure.Media = make(map[string]Media)
+	}
+	if dbStructure.WebhookEndpoints == nil {
+		dbStructure.WebhookEndpoints = make(map[string]WebhookEndpoint)
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = make(map[string]WebhookDelivery)
+	}
+
+	migrate(&dbStructure)
+
+	if db.observer != nil {
+		db.observer.ObserveLoad(time.Since(start), len(file))
+	}
 
 	return dbStructure, nil
 }
 
+// replaceFile swaps the database file for one holding data. The data is
+// synced to a temporary file that is then renamed over the old one, so a
+// crash or a full disk leaves the old file whole rather than a truncated
+// one. The caller must hold the lock.
+func (db *DB) replaceFile(data []byte) error {
+	dir := filepath.Dir(db.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(db.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The rename only survives a crash once the directory is synced too
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// nextId hands out IDs that are never reused, even once their record is
+// deleted, so nothing still pointing at an old ID can pick up a new record.
+// Databases from before the counter existed start after their highest ID.
+func nextId[T any](last *int, records map[int]T) int {
+	for id := range records {
+		if id > *last {
+			*last = id
+		}
+	}
+	*last++
+	return *last
+}
+
+// errUnchanged is returned from an update func that found nothing to do
+var errUnchanged = errors.New("nothing changed")
+
+// update loads the database, applies fn and writes the result, holding the
+// lock throughout so no other write can land in between. Nothing is written
+// if fn returns an error, and returning errUnchanged skips the write without
+// failing.
+func (db *DB) update(fn func(*DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&dbStructure)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.saveDB(dbStructure)
+}
+
 // writeDB writes the database file to disk
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	newData, err := json.Marshal(dbStructure)
+	return db.saveDB(dbStructure)
+}
+
+// saveDB writes the database file to disk. The caller must hold the lock.
+func (db *DB) saveDB(dbStructure DBStructure) (err error) {
+	span := db.startSpan("database.write")
+	var newData []byte
+	defer func() { endSpan(span, len(newData), err) }()
+
+	if *db.closed {
+		return ErrClosed
+	}
+
+	start := time.Now()
+	newData, err = json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, newData, os.ModeAppend)
+	err = db.replaceFile(newData)
 	if err != nil {
 		return err
 	}
 
+	if db.observer != nil {
+		db.observer.ObserveWrite(time.Since(start), len(newData))
+	}
 	return nil
 }
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	db, err := NewDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		_, err = db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved DBStructure
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatalf("database file isn't valid JSON: %v", err)
+	}
+	if len(saved.Users) != 2 {
+		t.Errorf("saved %d users, want 2", len(saved.Users))
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the database", len(entries))
+	}
+}
+
+func TestWriteAfterCloseKeepsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("a@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("b@example.com", "hash")
+	if err != ErrClosed {
+		t.Fatalf("CreateUser after Close = %v, want ErrClosed", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("database file changed after Close")
+	}
+}
+
+func TestCreateUserUniqueEmail(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			db.CreateUser("user@example.com", "hash")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Errorf("created %d users with the same email, want 1", len(users))
+	}
+}
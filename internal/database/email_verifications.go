@@ -0,0 +1,88 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// CreateEmailVerification stores a verification token hash for email,
+// replacing any verification the user still had outstanding
+func (db *DB) CreateEmailVerification(userId int, email, tokenHash string, expiresAt time.Time) (EmailVerification, error) {
+	db, span := db.startOperation("CreateEmailVerification", userID(userId))
+	defer span.End()
+
+	verification := EmailVerification{
+		TokenHash: tokenHash,
+		UserId:    userId,
+		Email:     email,
+		ExpiresAt: expiresAt,
+	}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userId]; !ok {
+			return errors.New("user not found")
+		}
+
+		now := time.Now().UTC()
+		for hash, other := range dbStructure.EmailVerifications {
+			if other.UserId == userId || now.After(other.ExpiresAt) {
+				delete(dbStructure.EmailVerifications, hash)
+			}
+		}
+
+		dbStructure.EmailVerifications[tokenHash] = verification
+		return nil
+	})
+	if err != nil {
+		return EmailVerification{}, err
+	}
+
+	return verification, nil
+}
+
+// ConfirmEmail consumes a verification token and marks its email as
+// verified. If the token was for a pending email change, the change is
+// applied as long as no other user has taken the address in the meantime.
+func (db *DB) ConfirmEmail(tokenHash string) (User, error) {
+	db, span := db.startOperation("ConfirmEmail")
+	defer span.End()
+
+	var user User
+	err := db.update(func(dbStructure *DBStructure) error {
+		verification, ok := dbStructure.EmailVerifications[tokenHash]
+		if !ok || time.Now().UTC().After(verification.ExpiresAt) {
+			return errors.New("invalid or expired verification token")
+		}
+		delete(dbStructure.EmailVerifications, tokenHash)
+
+		user, ok = dbStructure.Users[verification.UserId]
+		if !ok {
+			return errors.New("user not found")
+		}
+
+		switch verification.Email {
+		case user.Email:
+			user.EmailVerified = true
+		case user.PendingEmail:
+			for _, other := range dbStructure.Users {
+				if other.Id != user.Id && strings.EqualFold(other.Email, verification.Email) {
+					return errors.New("a user with this email already exists")
+				}
+			}
+			user.Email = user.PendingEmail
+			user.PendingEmail = ""
+			user.EmailVerified = true
+		default:
+			return errors.New("invalid or expired verification token")
+		}
+
+		dbStructure.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
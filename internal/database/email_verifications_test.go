@@ -0,0 +1,106 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// confirmConcurrently has each token confirmed several times at once and
+// returns how many confirmations succeeded
+func confirmConcurrently(db *DB, tokenHashes ...string) int32 {
+	var confirmed atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 4 {
+		for _, tokenHash := range tokenHashes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				_, err := db.ConfirmEmail(tokenHash)
+				if err == nil {
+					confirmed.Add(1)
+				}
+			}()
+		}
+	}
+	close(start)
+	wg.Wait()
+	return confirmed.Load()
+}
+
+func TestConfirmEmailOnce(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateEmailVerification(user.Id, user.Email, "token-hash", time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := confirmConcurrently(db, "token-hash"); n != 1 {
+		t.Errorf("token used %d times, want once", n)
+	}
+	saved, err := db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.EmailVerified {
+		t.Error("email wasn't verified")
+	}
+}
+
+func TestConfirmEmailChangeClaimsAddressOnce(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two users asked to move to the same address
+	var tokenHashes []string
+	for i := range 2 {
+		user, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UpdateUserFunc(user.Id, func(u *User) error {
+			u.PendingEmail = "wanted@example.com"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenHash := fmt.Sprintf("token-hash-%d", i)
+		_, err = db.CreateEmailVerification(user.Id, "wanted@example.com", tokenHash, time.Now().UTC().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenHashes = append(tokenHashes, tokenHash)
+	}
+
+	if n := confirmConcurrently(db, tokenHashes...); n != 1 {
+		t.Errorf("address claimed %d times, want once", n)
+	}
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owners int
+	for _, user := range users {
+		if user.Email == "wanted@example.com" {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Errorf("%d users have the address, want 1", owners)
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// identityKey is the map key for a provider's subject
+func identityKey(provider, subject string) string {
+	return provider + "|" + subject
+}
+
+// GetIdentity returns the identity linked for a provider's subject
+func (db *DB) GetIdentity(provider, subject string) (Identity, error) {
+	db, span := db.startOperation("GetIdentity")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity, ok := dbStructure.Identities[identityKey(provider, subject)]
+	if !ok {
+		return Identity{}, errors.New("identity not found")
+	}
+
+	return identity, nil
+}
+
+// LinkIdentity links a provider's subject to an existing user
+func (db *DB) LinkIdentity(provider, subject string, userId int, email string) (Identity, error) {
+	db, span := db.startOperation("LinkIdentity", userID(userId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	if _, ok := dbStructure.Users[userId]; !ok {
+		return Identity{}, errors.New("user not found")
+	}
+
+	key := identityKey(provider, subject)
+	if _, ok := dbStructure.Identities[key]; ok {
+		return Identity{}, errors.New("identity is already linked")
+	}
+
+	identity := Identity{
+		Provider:  provider,
+		Subject:   subject,
+		UserId:    userId,
+		Email:     email,
+		CreatedAt: time.Now().UTC(),
+	}
+	dbStructure.Identities[key] = identity
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return identity, nil
+}
+
+// GetIdentities returns every external identity linked to a user
+func (db *DB) GetIdentities(userId int) ([]Identity, error) {
+	db, span := db.startOperation("GetIdentities", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []Identity{}, err
+	}
+
+	identities := make([]Identity, 0)
+	for _, identity := range dbStructure.Identities {
+		if identity.UserId == userId {
+			identities = append(identities, identity)
+		}
+	}
+
+	sort.Slice(identities, func(i, j int) bool { return identities[i].CreatedAt.Before(identities[j].CreatedAt) })
+	return identities, nil
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// CreateMedia saves an uploaded file's record, unless the user's uploads
+// would then take up more than quota bytes
+func (db *DB) CreateMedia(media Media, quota int64) (Media, error) {
+	db, span := db.startOperation("CreateMedia", userID(media.UserId))
+	defer span.End()
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[media.UserId]; !ok {
+			return errors.New("user not found")
+		}
+
+		used := media.Size
+		for _, upload := range dbStructure.Media {
+			if upload.UserId == media.UserId {
+				used += upload.Size
+			}
+		}
+		if used > quota {
+			return ErrStorageQuota
+		}
+
+		dbStructure.Media[media.Id] = media
+		return nil
+	})
+	if err != nil {
+		return Media{}, err
+	}
+
+	return media, nil
+}
+
+// GetMedia returns an uploaded file's record
+func (db *DB) GetMedia(id string) (Media, error) {
+	db, span := db.startOperation("GetMedia")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Media{}, err
+	}
+
+	media, ok := dbStructure.Media[id]
+	if !ok {
+		return Media{}, errors.New("media not found")
+	}
+
+	return media, nil
+}
+
+// GetUserMedia returns everything a user uploaded, oldest first
+func (db *DB) GetUserMedia(userId int) ([]Media, error) {
+	db, span := db.startOperation("GetUserMedia", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []Media{}, err
+	}
+
+	uploads := make([]Media, 0)
+	for _, media := range dbStructure.Media {
+		if media.UserId == userId {
+			uploads = append(uploads, media)
+		}
+	}
+
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].CreatedAt.Before(uploads[j].CreatedAt) })
+	return uploads, nil
+}
+
+// DeleteOrphanedMedia forgets uploads made before cutoff that no chirp
+// uses, and returns them so the caller can remove their files
+func (db *DB) DeleteOrphanedMedia(cutoff time.Time) ([]Media, error) {
+	db, span := db.startOperation("DeleteOrphanedMedia")
+	defer span.End()
+
+	orphans := make([]Media, 0)
+	err := db.update(func(dbStructure *DBStructure) error {
+		attached := make(map[string]bool)
+		for _, chirp := range dbStructure.Chirps {
+			for _, id := range chirp.Media {
+				attached[id] = true
+			}
+		}
+
+		for id, media := range dbStructure.Media {
+			if attached[id] || !media.CreatedAt.Before(cutoff) {
+				continue
+			}
+			orphans = append(orphans, media)
+			delete(dbStructure.Media, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return []Media{}, err
+	}
+
+	return orphans, nil
+}
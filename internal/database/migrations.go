@@ -0,0 +1,20 @@
+package database
+
+// schemaVersion is the version of the records written by this code. Bump it
+// when stored records need upgrading and add a step to migrate.
+const schemaVersion = 1
+
+// migrate upgrades records written by older versions. It runs on every
+// load, so the upgrade is saved along with the next write.
+func migrate(dbStructure *DBStructure) {
+	if dbStructure.Version < 1 {
+		// Accounts from before email verification never had the chance to
+		// verify, so they keep everything they could already do
+		for id, user := range dbStructure.Users {
+			user.EmailVerified = true
+			dbStructure.Users[id] = user
+		}
+	}
+
+	dbStructure.Version = schemaVersion
+}
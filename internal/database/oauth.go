@@ -0,0 +1,218 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// grantKey is the map key for a user's grant to a client
+func grantKey(userId int, clientId string) string {
+	return fmt.Sprintf("%d|%s", userId, clientId)
+}
+
+// CreateOAuthClient registers a new third-party app
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	db, span := db.startOperation("CreateOAuthClient", userID(client.OwnerId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	if _, ok := dbStructure.OAuthClients[client.Id]; ok {
+		return OAuthClient{}, errors.New("client already exists")
+	}
+
+	dbStructure.OAuthClients[client.Id] = client
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+// GetOAuthClient returns a registered app by its client ID
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	db, span := db.startOperation("GetOAuthClient")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, ok := dbStructure.OAuthClients[id]
+	if !ok {
+		return OAuthClient{}, errors.New("client not found")
+	}
+
+	return client, nil
+}
+
+// GetOAuthClients returns the apps registered by a user
+func (db *DB) GetOAuthClients(ownerId int) ([]OAuthClient, error) {
+	db, span := db.startOperation("GetOAuthClients", userID(ownerId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []OAuthClient{}, err
+	}
+
+	clients := make([]OAuthClient, 0)
+	for _, client := range dbStructure.OAuthClients {
+		if client.OwnerId == ownerId {
+			clients = append(clients, client)
+		}
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].CreatedAt.Before(clients[j].CreatedAt) })
+	return clients, nil
+}
+
+// DeleteOAuthClient removes an app and every grant made to it
+func (db *DB) DeleteOAuthClient(ownerId int, id string) error {
+	db, span := db.startOperation("DeleteOAuthClient", userID(ownerId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	client, ok := dbStructure.OAuthClients[id]
+	if !ok || client.OwnerId != ownerId {
+		return errors.New("client not found")
+	}
+
+	delete(dbStructure.OAuthClients, id)
+	for key, grant := range dbStructure.OAuthGrants {
+		if grant.ClientId == id {
+			delete(dbStructure.OAuthGrants, key)
+		}
+	}
+
+	return db.writeDB(dbStructure)
+}
+
+// SaveOAuthGrant records that a user authorized a client for scopes,
+// replacing any earlier grant to the same client. Taking away a scope
+// restarts the grant, so tokens issued under the wider one stop working.
+func (db *DB) SaveOAuthGrant(userId int, clientId string, scopes []string) (OAuthGrant, error) {
+	db, span := db.startOperation("SaveOAuthGrant", userID(userId))
+	defer span.End()
+
+	var grant OAuthGrant
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.OAuthClients[clientId]; !ok {
+			return errors.New("client not found")
+		}
+
+		key := grantKey(userId, clientId)
+		existing, ok := dbStructure.OAuthGrants[key]
+		grant = OAuthGrant{
+			UserId:       userId,
+			ClientId:     clientId,
+			Scopes:       scopes,
+			AuthorizedAt: existing.AuthorizedAt,
+		}
+		if !ok || !isSubset(existing.Scopes, scopes) {
+			grant.AuthorizedAt = time.Now().UTC()
+		}
+		dbStructure.OAuthGrants[key] = grant
+		return nil
+	})
+	if err != nil {
+		return OAuthGrant{}, err
+	}
+
+	return grant, nil
+}
+
+// isSubset reports whether every scope in scopes is also in of
+func isSubset(scopes, of []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(of, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetOAuthGrant returns a user's grant to a client
+func (db *DB) GetOAuthGrant(userId int, clientId string) (OAuthGrant, error) {
+	db, span := db.startOperation("GetOAuthGrant", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return OAuthGrant{}, err
+	}
+
+	grant, ok := dbStructure.OAuthGrants[grantKey(userId, clientId)]
+	if !ok {
+		return OAuthGrant{}, errors.New("grant not found")
+	}
+
+	return grant, nil
+}
+
+// GetOAuthGrants returns every app a user has authorized
+func (db *DB) GetOAuthGrants(userId int) ([]OAuthGrant, error) {
+	db, span := db.startOperation("GetOAuthGrants", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []OAuthGrant{}, err
+	}
+
+	grants := make([]OAuthGrant, 0)
+	for _, grant := range dbStructure.OAuthGrants {
+		if grant.UserId == userId {
+			grants = append(grants, grant)
+		}
+	}
+
+	sort.Slice(grants, func(i, j int) bool { return grants[i].AuthorizedAt.Before(grants[j].AuthorizedAt) })
+	return grants, nil
+}
+
+// DeleteOAuthGrant revokes a user's grant to a client, invalidating every
+// token the client holds for the user
+func (db *DB) DeleteOAuthGrant(userId int, clientId string) error {
+	db, span := db.startOperation("DeleteOAuthGrant", userID(userId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	key := grantKey(userId, clientId)
+	if _, ok := dbStructure.OAuthGrants[key]; !ok {
+		return errors.New("grant not found")
+	}
+
+	delete(dbStructure.OAuthGrants, key)
+
+	return db.writeDB(dbStructure)
+}
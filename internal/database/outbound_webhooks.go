@@ -0,0 +1,252 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// CreateWebhookEndpoint registers an endpoint
+func (db *DB) CreateWebhookEndpoint(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+	db, span := db.startOperation("CreateWebhookEndpoint", userID(endpoint.OwnerId))
+	defer span.End()
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[endpoint.OwnerId]; endpoint.OwnerId != 0 && !ok {
+			return errors.New("user not found")
+		}
+
+		dbStructure.WebhookEndpoints[endpoint.Id] = endpoint
+		return nil
+	})
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+// GetWebhookEndpoint returns an endpoint by its ID
+func (db *DB) GetWebhookEndpoint(id string) (WebhookEndpoint, error) {
+	db, span := db.startOperation("GetWebhookEndpoint")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	endpoint, ok := dbStructure.WebhookEndpoints[id]
+	if !ok {
+		return WebhookEndpoint{}, ErrWebhookEndpointNotFound
+	}
+
+	return endpoint, nil
+}
+
+// GetWebhookEndpoints returns the endpoints owned by ownerId, oldest first.
+// Admin endpoints have an owner of 0.
+func (db *DB) GetWebhookEndpoints(ownerId int) ([]WebhookEndpoint, error) {
+	db, span := db.startOperation("GetWebhookEndpoints", userID(ownerId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []WebhookEndpoint{}, err
+	}
+
+	endpoints := make([]WebhookEndpoint, 0)
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		if endpoint.OwnerId == ownerId {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt) })
+	return endpoints, nil
+}
+
+// GetSubscribedEndpoints returns the endpoints that should hear about event
+// happening to userId
+func (db *DB) GetSubscribedEndpoints(event string, userId int) ([]WebhookEndpoint, error) {
+	db, span := db.startOperation("GetSubscribedEndpoints", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []WebhookEndpoint{}, err
+	}
+
+	endpoints := make([]WebhookEndpoint, 0)
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		if endpoint.OwnerId != 0 && endpoint.OwnerId != userId {
+			continue
+		}
+		for _, e := range endpoint.Events {
+			if e == event {
+				endpoints = append(endpoints, endpoint)
+				break
+			}
+		}
+	}
+
+	return endpoints, nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint and its delivery history
+func (db *DB) DeleteWebhookEndpoint(id string) error {
+	db, span := db.startOperation("DeleteWebhookEndpoint")
+	defer span.End()
+
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.WebhookEndpoints[id]; !ok {
+			return ErrWebhookEndpointNotFound
+		}
+
+		delete(dbStructure.WebhookEndpoints, id)
+		for key, delivery := range dbStructure.WebhookDeliveries {
+			if delivery.EndpointId == id {
+				delete(dbStructure.WebhookDeliveries, key)
+			}
+		}
+		return nil
+	})
+}
+
+// CreateWebhookDeliveries queues deliveries
+func (db *DB) CreateWebhookDeliveries(deliveries []WebhookDelivery) error {
+	db, span := db.startOperation("CreateWebhookDeliveries")
+	defer span.End()
+
+	return db.update(func(dbStructure *DBStructure) error {
+		for _, delivery := range deliveries {
+			dbStructure.WebhookDeliveries[delivery.Id] = delivery
+		}
+		return nil
+	})
+}
+
+// UpdateWebhookDelivery saves the outcome of an attempt. It fails if the
+// endpoint, and with it the delivery, was deleted in the meantime.
+func (db *DB) UpdateWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+	db, span := db.startOperation("UpdateWebhookDelivery")
+	defer span.End()
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.WebhookDeliveries[delivery.Id]; !ok {
+			return errors.New("webhook delivery not found")
+		}
+
+		dbStructure.WebhookDeliveries[delivery.Id] = delivery
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// GetWebhookDelivery returns a delivery by its ID
+func (db *DB) GetWebhookDelivery(id string) (WebhookDelivery, error) {
+	db, span := db.startOperation("GetWebhookDelivery")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	delivery, ok := dbStructure.WebhookDeliveries[id]
+	if !ok {
+		return WebhookDelivery{}, errors.New("webhook delivery not found")
+	}
+
+	return delivery, nil
+}
+
+// GetWebhookDeliveries returns deliveries, newest first. An empty
+// endpointId or status matches every endpoint or status.
+func (db *DB) GetWebhookDeliveries(endpointId, status string) ([]WebhookDelivery, error) {
+	db, span := db.startOperation("GetWebhookDeliveries")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0)
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		if endpointId != "" && delivery.EndpointId != endpointId {
+			continue
+		}
+		if status != "" && delivery.Status != status {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+// GetDueWebhookDeliveries returns pending deliveries whose next attempt is
+// due at now, oldest first
+func (db *DB) GetDueWebhookDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	db, span := db.startOperation("GetDueWebhookDeliveries")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0)
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		if delivery.Status == DeliveryPending && !now.Before(delivery.NextAttemptAt) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+// PruneWebhookDeliveries forgets finished deliveries created before cutoff
+func (db *DB) PruneWebhookDeliveries(cutoff time.Time) error {
+	db, span := db.startOperation("PruneWebhookDeliveries")
+	defer span.End()
+
+	return db.update(func(dbStructure *DBStructure) error {
+		pruned := false
+		for key, delivery := range dbStructure.WebhookDeliveries {
+			if delivery.Status != DeliveryPending && delivery.CreatedAt.Before(cutoff) {
+				delete(dbStructure.WebhookDeliveries, key)
+				pruned = true
+			}
+		}
+		if !pruned {
+			return errUnchanged
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveryWritesDontOverwriteEachOther(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	pending := WebhookDelivery{Id: "pending", EndpointId: "endpoint", Status: DeliveryPending, CreatedAt: now}
+	err = db.CreateWebhookDeliveries([]WebhookDelivery{pending})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sender saving an attempt while new events are queued must keep both
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			delivery := pending
+			delivery.Attempts = i + 1
+			_, err := db.UpdateWebhookDelivery(delivery)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			err := db.CreateWebhookDeliveries([]WebhookDelivery{{
+				Id:         fmt.Sprint(i),
+				EndpointId: "endpoint",
+				Status:     DeliveryPending,
+				CreatedAt:  now,
+			}})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	deliveries, err := db.GetWebhookDeliveries("endpoint", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 9 {
+		t.Errorf("saved %d deliveries, want 9", len(deliveries))
+	}
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+)
+
+// passkeyKey is the map key for a credential ID
+func passkeyKey(credentialId []byte) string {
+	return base64.RawURLEncoding.EncodeToString(credentialId)
+}
+
+// CreatePasskey stores a newly registered passkey
+func (db *DB) CreatePasskey(passkey Passkey) (Passkey, error) {
+	db, span := db.startOperation("CreatePasskey", userID(passkey.UserId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	if _, ok := dbStructure.Users[passkey.UserId]; !ok {
+		return Passkey{}, errors.New("user not found")
+	}
+
+	key := passkeyKey(passkey.CredentialId)
+	if _, ok := dbStructure.Passkeys[key]; ok {
+		return Passkey{}, errors.New("passkey is already registered")
+	}
+
+	dbStructure.Passkeys[key] = passkey
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	return passkey, nil
+}
+
+// UpdatePasskey replaces a stored passkey, e.g. after its sign counter moved
+func (db *DB) UpdatePasskey(passkey Passkey) (Passkey, error) {
+	db, span := db.startOperation("UpdatePasskey", userID(passkey.UserId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	key := passkeyKey(passkey.CredentialId)
+	if _, ok := dbStructure.Passkeys[key]; !ok {
+		return Passkey{}, errors.New("passkey not found")
+	}
+
+	dbStructure.Passkeys[key] = passkey
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Passkey{}, err
+	}
+
+	return passkey, nil
+}
+
+// GetPasskeys returns every passkey registered to a user, oldest first
+func (db *DB) GetPasskeys(userId int) ([]Passkey, error) {
+	db, span := db.startOperation("GetPasskeys", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []Passkey{}, err
+	}
+
+	passkeys := make([]Passkey, 0)
+	for _, passkey := range dbStructure.Passkeys {
+		if passkey.UserId == userId {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+
+	sort.Slice(passkeys, func(i, j int) bool { return passkeys[i].CreatedAt.Before(passkeys[j].CreatedAt) })
+	return passkeys, nil
+}
+
+// DeletePasskey removes one of a user's passkeys
+func (db *DB) DeletePasskey(userId int, credentialId []byte) error {
+	db, span := db.startOperation("DeletePasskey", userID(userId))
+	defer span.End()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	key := passkeyKey(credentialId)
+	passkey, ok := dbStructure.Passkeys[key]
+	if !ok || passkey.UserId != userId {
+		return errors.New("passkey not found")
+	}
+
+	delete(dbStructure.Passkeys, key)
+
+	return db.writeDB(dbStructure)
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var errInvalidPasswordReset = errors.New("invalid or expired reset token")
+
+// CreatePasswordReset stores a reset token hash for a user, replacing
+// any reset the user still had outstanding
+func (db *DB) CreatePasswordReset(userId int, tokenHash string, expiresAt time.Time) (PasswordReset, error) {
+	db, span := db.startOperation("CreatePasswordReset", userID(userId))
+	defer span.End()
+
+	reset := PasswordReset{
+		TokenHash: tokenHash,
+		UserId:    userId,
+		ExpiresAt: expiresAt,
+	}
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userId]; !ok {
+			return errors.New("user not found")
+		}
+
+		now := time.Now().UTC()
+		for hash, old := range dbStructure.PasswordResets {
+			if old.UserId == userId || now.After(old.ExpiresAt) {
+				delete(dbStructure.PasswordResets, hash)
+			}
+		}
+
+		dbStructure.PasswordResets[tokenHash] = reset
+		return nil
+	})
+	if err != nil {
+		return PasswordReset{}, err
+	}
+
+	return reset, nil
+}
+
+// GetPasswordReset returns the reset for a token that can still be used,
+// without using it up
+func (db *DB) GetPasswordReset(tokenHash string) (PasswordReset, error) {
+	db, span := db.startOperation("GetPasswordReset")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return PasswordReset{}, err
+	}
+
+	reset, ok := dbStructure.PasswordResets[tokenHash]
+	if !ok || !reset.UsedAt.IsZero() || time.Now().UTC().After(reset.ExpiresAt) {
+		return PasswordReset{}, errInvalidPasswordReset
+	}
+
+	return reset, nil
+}
+
+// ConsumePasswordReset marks a reset token as used and returns it.
+// Unknown, expired and already used tokens are rejected.
+func (db *DB) ConsumePasswordReset(tokenHash string) (PasswordReset, error) {
+	db, span := db.startOperation("ConsumePasswordReset")
+	defer span.End()
+
+	var reset PasswordReset
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		reset, ok = dbStructure.PasswordResets[tokenHash]
+		now := time.Now().UTC()
+		if !ok || !reset.UsedAt.IsZero() || now.After(reset.ExpiresAt) {
+			return errInvalidPasswordReset
+		}
+
+		reset.UsedAt = now
+		dbStructure.PasswordResets[tokenHash] = reset
+		return nil
+	})
+	if err != nil {
+		return PasswordReset{}, err
+	}
+
+	return reset, nil
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsumePasswordResetOnce(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreatePasswordReset(user.Id, "token-hash", time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests racing with the same reset link must not both get in
+	var consumed atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := db.ConsumePasswordReset("token-hash")
+			if err == nil {
+				consumed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := consumed.Load(); n != 1 {
+		t.Errorf("token consumed %d times, want once", n)
+	}
+}
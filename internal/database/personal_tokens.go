@@ -0,0 +1,107 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// CreatePersonalToken stores a newly minted personal access token
+func (db *DB) CreatePersonalToken(token PersonalToken) (PersonalToken, error) {
+	db, span := db.startOperation("CreatePersonalToken", userID(token.UserId))
+	defer span.End()
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[token.UserId]; !ok {
+			return errors.New("user not found")
+		}
+
+		dbStructure.PersonalTokens[token.TokenHash] = token
+		return nil
+	})
+	if err != nil {
+		return PersonalToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetPersonalToken looks up a personal access token by its hash
+func (db *DB) GetPersonalToken(tokenHash string) (PersonalToken, error) {
+	db, span := db.startOperation("GetPersonalToken")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return PersonalToken{}, err
+	}
+
+	token, ok := dbStructure.PersonalTokens[tokenHash]
+	if !ok {
+		return PersonalToken{}, errors.New("token not found")
+	}
+
+	return token, nil
+}
+
+// GetPersonalTokens returns every personal access token a user has minted,
+// oldest first
+func (db *DB) GetPersonalTokens(userId int) ([]PersonalToken, error) {
+	db, span := db.startOperation("GetPersonalTokens", userID(userId))
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []PersonalToken{}, err
+	}
+
+	tokens := make([]PersonalToken, 0)
+	for _, token := range dbStructure.PersonalTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+// TouchPersonalToken records that a personal access token was used
+func (db *DB) TouchPersonalToken(tokenHash string, usedAt time.Time) error {
+	db, span := db.startOperation("TouchPersonalToken")
+	defer span.End()
+
+	return db.update(func(dbStructure *DBStructure) error {
+		token, ok := dbStructure.PersonalTokens[tokenHash]
+		if !ok {
+			return errors.New("token not found")
+		}
+
+		token.LastUsedAt = usedAt
+		dbStructure.PersonalTokens[tokenHash] = token
+		return nil
+	})
+}
+
+// DeletePersonalToken revokes one of a user's personal access tokens
+func (db *DB) DeletePersonalToken(userId int, id string) error {
+	db, span := db.startOperation("DeletePersonalToken", userID(userId))
+	defer span.End()
+
+	return db.update(func(dbStructure *DBStructure) error {
+		for hash, token := range dbStructure.PersonalTokens {
+			if token.Id == id && token.UserId == userId {
+				delete(dbStructure.PersonalTokens, hash)
+				return nil
+			}
+		}
+
+		return errors.New("token not found")
+	})
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTouchPersonalTokenKeepsConcurrentWrites(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	_, err = db.CreatePersonalToken(PersonalToken{
+		Id:        "used",
+		TokenHash: "used-hash",
+		UserId:    user.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recording a token's use mustn't write back a copy missing tokens
+	// created in the meantime
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := db.TouchPersonalToken("used-hash", now)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := db.CreatePersonalToken(PersonalToken{
+				Id:        fmt.Sprint(i),
+				TokenHash: fmt.Sprintf("hash-%d", i),
+				UserId:    user.Id,
+				CreatedAt: now,
+				ExpiresAt: now.Add(time.Hour),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	tokens, err := db.GetPersonalTokens(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 9 {
+		t.Errorf("saved %d tokens, want 9", len(tokens))
+	}
+}
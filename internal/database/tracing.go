@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/carsongro/chirpy/internal/database")
+
+// WithContext returns a handle to the same database whose operations are
+// traced as part of ctx
+func (db *DB) WithContext(ctx context.Context) *DB {
+	traced := *db
+	traced.ctx = ctx
+	return &traced
+}
+
+// startOperation starts the span for an exported DB method. The handle it
+// returns traces the file reads and writes the method makes under that span.
+func (db *DB) startOperation(name string, attrs ...attribute.KeyValue) (*DB, trace.Span) {
+	ctx, span := tracer.Start(db.context(), "database."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "jsonfile"),
+			attribute.String("db.operation.name", name),
+		),
+		trace.WithAttributes(attrs...),
+	)
+	return db.WithContext(ctx), span
+}
+
+// startSpan traces reading or writing the database file
+func (db *DB) startSpan(name string) trace.Span {
+	_, span := tracer.Start(db.context(), name)
+	return span
+}
+
+// endSpan records how the file operation went and ends span
+func endSpan(span trace.Span, size int, err error) {
+	span.SetAttributes(attribute.Int("db.file.size", size))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (db *DB) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+func userID(id int) attribute.KeyValue {
+	return attribute.Int("user.id", id)
+}
+
+func chirpID(id int) attribute.KeyValue {
+	return attribute.Int("chirp.id", id)
+}
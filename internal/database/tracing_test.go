@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans sends spans to an in-memory exporter, emptied for each test.
+// The package tracer only picks up the first provider set, so it's shared.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	spansOnce.Do(func() {
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+	})
+	spans.Reset()
+	return spans
+}
+
+func findSpan(t *testing.T, stubs tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, stub := range stubs {
+		if stub.Name == name {
+			return stub
+		}
+	}
+	t.Fatalf("no %s span in %d spans", name, len(stubs))
+	return tracetest.SpanStub{}
+}
+
+func hasAttribute(stub tracetest.SpanStub, want attribute.KeyValue) bool {
+	for _, attr := range stub.Attributes {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOperationSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := db.CreateChirp("hello", user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.Reset()
+
+	_, err = db.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UpdateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stubs := exporter.GetSpans()
+	getChirp := findSpan(t, stubs, "database.GetChirp")
+	if !hasAttribute(getChirp, attribute.Int("chirp.id", chirp.Id)) {
+		t.Errorf("GetChirp attributes = %v, want chirp.id %d", getChirp.Attributes, chirp.Id)
+	}
+	if !hasAttribute(getChirp, attribute.String("db.operation.name", "GetChirp")) {
+		t.Errorf("GetChirp attributes = %v, want its operation name", getChirp.Attributes)
+	}
+	updateUser := findSpan(t, stubs, "database.UpdateUser")
+	if !hasAttribute(updateUser, attribute.Int("user.id", user.Id)) {
+		t.Errorf("UpdateUser attributes = %v, want user.id %d", updateUser.Attributes, user.Id)
+	}
+
+	// File access is traced under the operation that needed it
+	var loads, writes int
+	for _, stub := range stubs {
+		switch stub.Name {
+		case "database.load":
+			loads++
+			if p := stub.Parent.SpanID(); p != getChirp.SpanContext.SpanID() && p != updateUser.SpanContext.SpanID() {
+				t.Errorf("load span has parent %s, not an operation", p)
+			}
+		case "database.write":
+			writes++
+			if stub.Parent.SpanID() != updateUser.SpanContext.SpanID() {
+				t.Errorf("write span has parent %s, want UpdateUser", stub.Parent.SpanID())
+			}
+		}
+	}
+	if loads != 2 || writes != 1 {
+		t.Errorf("got %d loads and %d writes, want 2 and 1", loads, writes)
+	}
+}
+
+func TestOperationSpansCreatedRecord(t *testing.T) {
+	exporter := recordSpans(t)
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := db.CreateChirp("hello", user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stubs := exporter.GetSpans()
+	if stub := findSpan(t, stubs, "database.CreateUser"); !hasAttribute(stub, attribute.Int("user.id", user.Id)) {
+		t.Errorf("CreateUser attributes = %v, want the new user's ID", stub.Attributes)
+	}
+	stub := findSpan(t, stubs, "database.CreateChirp")
+	if !hasAttribute(stub, attribute.Int("chirp.id", chirp.Id)) || !hasAttribute(stub, attribute.Int("user.id", user.Id)) {
+		t.Errorf("CreateChirp attributes = %v, want the new chirp's and its author's IDs", stub.Attributes)
+	}
+}
+
+func TestWithContextSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	_, err = db.WithContext(ctx).GetUsers()
+	parent.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stubs := exporter.GetSpans()
+	request := findSpan(t, stubs, "request")
+	getUsers := findSpan(t, stubs, "database.GetUsers")
+	if getUsers.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("GetUsers span has parent %s, want the caller's span", getUsers.Parent.SpanID())
+	}
+	load := findSpan(t, stubs, "database.load")
+	if load.SpanContext.TraceID() != request.SpanContext.TraceID() {
+		t.Error("file access is traced outside the caller's trace")
+	}
+}
@@ -1,7 +1,11 @@
 package database
 
+import "time"
+
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id       int        `json:"id"`
+	Body     string     `json:"body"`
+	AuthorId int        `json:"author_id"`
+	Media    []string   `json:"media,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
 }
@@ -0,0 +1,22 @@
+package database
+
+import "time"
+
+// Data export states
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is an archive of everything Chirpy stores about a user,
+// built in the background and kept on disk at Path until ExpiresAt
+type DataExport struct {
+	Id          string    `json:"id"`
+	UserId      int       `json:"user_id"`
+	Status      string    `json:"status"`
+	Path        string    `json:"path"`
+	RequestedAt time.Time `json:"requested_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
@@ -1,17 +1,52 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 )
 
+// ErrClosed is returned for writes after the database has been closed
+var ErrClosed = errors.New("database is closed")
+
+// ErrDeletionNotDue is returned when deleting a user whose deletion was
+// cancelled or isn't due yet
+var ErrDeletionNotDue = errors.New("user deletion is not due")
+
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path     string
+	mux      *sync.RWMutex
+	closed   *bool
+	observer Observer
+	ctx      context.Context
+}
+
+// Observer is told how long reading and writing the database file takes and
+// how large the file is, so they can be reported as metrics
+type Observer interface {
+	ObserveLoad(d time.Duration, size int)
+	ObserveWrite(d time.Duration, size int)
 }
 
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	Users         map[int]User         `json:"users"`
-	RevokedTokens map[string]time.Time `json:"revoked_tokens"`
+	Chirps         map[int]Chirp            `json:"chirps"`
+	Users          map[int]User             `json:"users"`
+	RevokedTokens  map[string]time.Time     `json:"revoked_tokens"`
+	PasswordResets map[string]PasswordReset `json:"password_resets"`
+	LastUserId     int                      `json:"last_user_id"`
+	LastChirpId    int                      `json:"last_chirp_id"`
+	Version        int                      `json:"version"`
+
+	EmailVerifications map[string]EmailVerification `json:"email_verifications"`
+	Passkeys           map[string]Passkey           `json:"passkeys"`
+	Identities         map[string]Identity          `json:"identities"`
+	OAuthClients       map[string]OAuthClient       `json:"oauth_clients"`
+	OAuthGrants        map[string]OAuthGrant        `json:"oauth_grants"`
+	PersonalTokens     map[string]PersonalToken     `json:"personal_tokens"`
+	DataExports        map[string]DataExport        `json:"data_exports"`
+	WebhookEvents      map[string]WebhookEvent      `json:"webhook_events"`
+	Media              map[string]Media             `json:"media"`
+	WebhookEndpoints   map[string]WebhookEndpoint   `json:"webhook_endpoints"`
+	WebhookDeliveries  map[string]WebhookDelivery   `json:"webhook_deliveries"`
 }
@@ -0,0 +1,12 @@
+package database
+
+import "time"
+
+// EmailVerification proves ownership of Email for a user, stored by the
+// hash of the token that was mailed to it
+type EmailVerification struct {
+	TokenHash string    `json:"token_hash"`
+	UserId    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
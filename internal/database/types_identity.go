@@ -0,0 +1,12 @@
+package database
+
+import "time"
+
+// Identity links an account at an external OpenID Connect provider to a user
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserId    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
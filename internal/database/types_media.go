@@ -0,0 +1,21 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStorageQuota is returned for uploads that would take a user past
+// their storage quota
+var ErrStorageQuota = errors.New("storage quota exceeded")
+
+// Media is a file a user uploaded to attach to chirps, stored on disk at
+// Path
+type Media struct {
+	Id          string    `json:"id"`
+	UserId      int       `json:"user_id"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Path        string    `json:"path"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,24 @@
+package database
+
+import "time"
+
+// OAuthClient is a third-party app registered to use Chirpy as an
+// authorization server. Public clients have no secret and must use PKCE.
+type OAuthClient struct {
+	Id           string    `json:"id"`
+	SecretHash   string    `json:"secret_hash"`
+	OwnerId      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OAuthGrant records that a user authorized a client for some scopes.
+// Tokens issued to the client before AuthorizedAt are no longer valid.
+type OAuthGrant struct {
+	UserId       int       `json:"user_id"`
+	ClientId     string    `json:"client_id"`
+	Scopes       []string  `json:"scopes"`
+	AuthorizedAt time.Time `json:"authorized_at"`
+}
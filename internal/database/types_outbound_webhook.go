@@ -0,0 +1,47 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrWebhookEndpointNotFound is returned for an endpoint that doesn't exist,
+// or no longer does
+var ErrWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+
+// WebhookEndpoint is a URL that Chirpy sends events to. Endpoints a user
+// registers only hear about that user, while ones an admin registers, with
+// no owner, hear about everyone.
+type WebhookEndpoint struct {
+	Id        string    `json:"id"`
+	OwnerId   int       `json:"owner_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery states. Deliveries that run out of attempts are dead, which is
+// where they wait to be retried by hand.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDelivery is one event on its way to one endpoint
+type WebhookDelivery struct {
+	Id             string          `json:"id"`
+	EndpointId     string          `json:"endpoint_id"`
+	EventId        string          `json:"event_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastAttemptAt  time.Time       `json:"last_attempt_at"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+}
@@ -0,0 +1,21 @@
+package database
+
+import "time"
+
+// Passkey is a WebAuthn credential registered to a user
+type Passkey struct {
+	CredentialId    []byte    `json:"credential_id"`
+	UserId          int       `json:"user_id"`
+	Name            string    `json:"name"`
+	PublicKey       []byte    `json:"public_key"`
+	AttestationType string    `json:"attestation_type"`
+	Transports      []string  `json:"transports"`
+	AAGUID          []byte    `json:"aaguid"`
+	SignCount       uint32    `json:"sign_count"`
+	UserPresent     bool      `json:"user_present"`
+	UserVerified    bool      `json:"user_verified"`
+	BackupEligible  bool      `json:"backup_eligible"`
+	BackupState     bool      `json:"backup_state"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastUsedAt      time.Time `json:"last_used_at"`
+}
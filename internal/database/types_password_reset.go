@@ -0,0 +1,11 @@
+package database
+
+import "time"
+
+// PasswordReset is a single-use reset token, stored by the hash of the token
+type PasswordReset struct {
+	TokenHash string    `json:"token_hash"`
+	UserId    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt    time.Time `json:"used_at"`
+}
@@ -0,0 +1,16 @@
+package database
+
+import "time"
+
+// PersonalToken is a long-lived, scoped token a user minted for a script
+// or bot, stored by the hash of the token
+type PersonalToken struct {
+	Id         string    `json:"id"`
+	TokenHash  string    `json:"token_hash"`
+	UserId     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
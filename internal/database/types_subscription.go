@@ -0,0 +1,39 @@
+package database
+
+import "time"
+
+// Plans a user can be subscribed to
+const (
+	PlanFree = "free"
+	PlanRed  = "red"
+)
+
+// Subscription states
+const (
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionRefunded = "refunded"
+	SubscriptionExpired  = "expired"
+)
+
+// Subscription is a user's Chirpy Red subscription, kept up to date from
+// Polka events. IsChirpyRed on the user says whether it currently grants Red.
+type Subscription struct {
+	Plan             string               `json:"plan"`
+	Status           string               `json:"status"`
+	CurrentPeriodEnd time.Time            `json:"current_period_end"`
+	History          []SubscriptionChange `json:"history"`
+}
+
+// SubscriptionChange records what an event did to a subscription. SentAt is
+// when Polka sent the event, and is zero for changes Chirpy made itself.
+type SubscriptionChange struct {
+	Event            string    `json:"event"`
+	EventId          string    `json:"event_id,omitempty"`
+	SentAt           time.Time `json:"sent_at"`
+	Plan             string    `json:"plan"`
+	Status           string    `json:"status"`
+	CurrentPeriodEnd time.Time `json:"current_period_end"`
+	At               time.Time `json:"at"`
+}
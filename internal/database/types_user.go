@@ -1,8 +1,24 @@
 package database
 
+import "time"
+
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id                int       `json:"id"`
+	Email             string    `json:"email"`
+	Password          string    `json:"password"`
+	IsChirpyRed       bool      `json:"is_chirpy_red"`
+	Role              string    `json:"role"`
+	EmailVerified     bool      `json:"email_verified"`
+	PendingEmail      string    `json:"pending_email"`
+	TOTPSecret        string    `json:"totp_secret"`
+	TOTPEnabled       bool      `json:"totp_enabled"`
+	TOTPLastCounter   int64     `json:"totp_last_counter"`
+	RecoveryCodes     []string  `json:"recovery_codes"`
+	SessionsRevokedAt time.Time `json:"sessions_revoked_at"`
+
+	Subscription Subscription `json:"subscription"`
+
+	// DeletionScheduledAt is when the account will be purged, unless the
+	// user restores it first
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
 }
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Webhook event states. Events are processing from the moment a delivery
+// claims them. Pending is only left by versions that didn't claim events.
+const (
+	WebhookPending    = "pending"
+	WebhookProcessing = "processing"
+	WebhookProcessed  = "processed"
+	WebhookIgnored    = "ignored"
+	WebhookFailed     = "failed"
+)
+
+// WebhookEvent is a webhook delivery as it was received, kept so retried
+// deliveries are only acted on once and so events can be replayed. SentAt
+// is when the first delivery was signed, which orders events that arrive
+// out of order.
+type WebhookEvent struct {
+	Id          string          `json:"id"`
+	Source      string          `json:"source"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	SentAt      time.Time       `json:"sent_at"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt time.Time       `json:"processed_at"`
+}
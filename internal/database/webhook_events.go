@@ -0,0 +1,102 @@
+package database
+
+import (
+	"errors"
+	"sort"
+)
+
+// RecordWebhookEvent saves a newly received event and claims it for
+// processing, so only the caller that gets claimed set to true acts on it.
+// If an event with the same ID was already received, that one is returned
+// instead, and is only claimed again if processing it failed.
+func (db *DB) RecordWebhookEvent(event WebhookEvent) (saved WebhookEvent, claimed bool, err error) {
+	db, span := db.startOperation("RecordWebhookEvent")
+	defer span.End()
+
+	err = db.update(func(dbStructure *DBStructure) error {
+		if existing, ok := dbStructure.WebhookEvents[event.Id]; ok {
+			saved = existing
+			if existing.Status != WebhookFailed && existing.Status != WebhookPending {
+				return nil
+			}
+			event = existing
+		}
+
+		event.Status = WebhookProcessing
+		dbStructure.WebhookEvents[event.Id] = event
+		saved, claimed = event, true
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, false, err
+	}
+
+	return saved, claimed, nil
+}
+
+// UpdateWebhookEvent saves the outcome of processing an event
+func (db *DB) UpdateWebhookEvent(event WebhookEvent) (WebhookEvent, error) {
+	db, span := db.startOperation("UpdateWebhookEvent")
+	defer span.End()
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.WebhookEvents[event.Id]; !ok {
+			return errors.New("webhook event not found")
+		}
+
+		dbStructure.WebhookEvents[event.Id] = event
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+// GetWebhookEvent returns an event by its delivery ID
+func (db *DB) GetWebhookEvent(id string) (WebhookEvent, error) {
+	db, span := db.startOperation("GetWebhookEvent")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	event, ok := dbStructure.WebhookEvents[id]
+	if !ok {
+		return WebhookEvent{}, errors.New("webhook event not found")
+	}
+
+	return event, nil
+}
+
+// GetWebhookEvents returns every event, or only those with status, newest
+// first
+func (db *DB) GetWebhookEvents(status string) ([]WebhookEvent, error) {
+	db, span := db.startOperation("GetWebhookEvents")
+	defer span.End()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return []WebhookEvent{}, err
+	}
+
+	events := make([]WebhookEvent, 0)
+	for _, event := range dbStructure.WebhookEvents {
+		if status != "" && event.Status != status {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ReceivedAt.After(events[j].ReceivedAt) })
+	return events, nil
+}
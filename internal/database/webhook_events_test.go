@@ -0,0 +1,90 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecordWebhookEventOnce(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Polka retrying a delivery while the first attempt is still being
+	// recorded must not get the event claimed, and acted on, twice
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, ok, err := db.RecordWebhookEvent(WebhookEvent{
+				Id:         "evt_1",
+				Event:      "user.upgraded",
+				ReceivedAt: time.Now().UTC(),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				claimed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := claimed.Load(); n != 1 {
+		t.Errorf("event was claimed %d times, want once", n)
+	}
+}
+
+func TestRecordWebhookEventClaims(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{WebhookProcessing, false},
+		{WebhookProcessed, false},
+		{WebhookIgnored, false},
+		{WebhookFailed, true},
+		{WebhookPending, true},
+	}
+	for _, tt := range tests {
+		id := "evt_" + tt.status
+		event, claimed, err := db.RecordWebhookEvent(WebhookEvent{Id: id, Event: "user.upgraded"})
+		if err != nil || !claimed {
+			t.Fatalf("new event: claimed = %v, %v", claimed, err)
+		}
+		if event.Status != WebhookProcessing {
+			t.Errorf("new event has status %q, want %q", event.Status, WebhookProcessing)
+		}
+		event.Status = tt.status
+		_, err = db.UpdateWebhookEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		event, claimed, err = db.RecordWebhookEvent(WebhookEvent{Id: id, Event: "user.upgraded"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != tt.want {
+			t.Errorf("retry of a %s event: claimed = %v, want %v", tt.status, claimed, tt.want)
+		}
+		if !claimed && event.Status != tt.status {
+			t.Errorf("retry of a %s event changed it to %q", tt.status, event.Status)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package entitlements
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// Entitlements are what a plan lets its users do. Zero means none, except
+// for ChirpsPerMinute and UploadsPerHour where it means no limit.
+// MaxStorageBytes is the total size of everything a user has uploaded.
+type Entitlements struct {
+	MaxChirpLength     int   `json:"max_chirp_length"`
+	EditChirps         bool  `json:"edit_chirps"`
+	ChirpsPerMinute    int   `json:"chirps_per_minute"`
+	MaxAttachments     int   `json:"max_attachments"`
+	MaxAttachmentBytes int64 `json:"max_attachment_bytes"`
+	MaxStorageBytes    int64 `json:"max_storage_bytes"`
+	UploadsPerHour     int   `json:"uploads_per_hour"`
+}
+
+// Plans maps the plans subscriptions are stored with to their entitlements
+type Plans map[string]Entitlements
+
+// Default returns the entitlements Chirpy ships with
+func Default() Plans {
+	return Plans{
+		database.PlanFree: {
+			MaxChirpLength:  140,
+			ChirpsPerMinute: 10,
+		},
+		database.PlanRed: {
+			MaxChirpLength:     1000,
+			EditChirps:         true,
+			ChirpsPerMinute:    60,
+			MaxAttachments:     4,
+			MaxAttachmentBytes: 5 << 20,
+			MaxStorageBytes:    100 << 20,
+			UploadsPerHour:     30,
+		},
+	}
+}
+
+// Load reads plans from a JSON file shaped like Plans. Plans and fields the
+// file leaves out keep their defaults, so it only has to list changes:
+//
+//	{"red": {"max_chirp_length": 2000}}
+func Load(path string) (Plans, error) {
+	plans := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, override := range overrides {
+		plan := plans[name]
+		err = json.Unmarshal(override, &plan)
+		if err != nil {
+			return nil, err
+		}
+		plans[name] = plan
+	}
+
+	return plans, nil
+}
+
+// For returns the entitlements of plan. Unknown plans get the free plan's.
+func (p Plans) For(plan string) Entitlements {
+	if entitlements, ok := p[plan]; ok {
+		return entitlements
+	}
+	return p[database.PlanFree]
+}
@@ -0,0 +1,108 @@
+package entitlements
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+func TestLoad(t *testing.T) {
+	defaults := Default()
+
+	tests := []struct {
+		name    string
+		file    string
+		want    Plans
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			file: `{}`,
+			want: defaults,
+		},
+		{
+			name: "override keeps the plan's other defaults",
+			file: `{"red": {"max_chirp_length": 2000}}`,
+			want: func() Plans {
+				plans := Default()
+				red := plans[database.PlanRed]
+				red.MaxChirpLength = 2000
+				plans[database.PlanRed] = red
+				return plans
+			}(),
+		},
+		{
+			name: "turning a perk off",
+			file: `{"red": {"edit_chirps": false}, "free": {"chirps_per_minute": 0}}`,
+			want: func() Plans {
+				plans := Default()
+				red := plans[database.PlanRed]
+				red.EditChirps = false
+				plans[database.PlanRed] = red
+				free := plans[database.PlanFree]
+				free.ChirpsPerMinute = 0
+				plans[database.PlanFree] = free
+				return plans
+			}(),
+		},
+		{
+			name: "new plan",
+			file: `{"team": {"max_chirp_length": 500}}`,
+			want: func() Plans {
+				plans := Default()
+				plans["team"] = Entitlements{MaxChirpLength: 500}
+				return plans
+			}(),
+		},
+		{name: "invalid JSON", file: `{"red": `, wantErr: true},
+		{name: "wrong type", file: `{"red": {"max_chirp_length": "long"}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "entitlements.json")
+			err := os.WriteFile(path, []byte(tt.file), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plans, err := Load(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Load succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plans) != len(tt.want) {
+				t.Errorf("got %d plans, want %d", len(plans), len(tt.want))
+			}
+			for name, want := range tt.want {
+				if got := plans[name]; got != want {
+					t.Errorf("%s = %+v, want %+v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("Load succeeded for a missing file")
+	}
+}
+
+func TestPlansFor(t *testing.T) {
+	plans := Default()
+	if got := plans.For(database.PlanRed); got != plans[database.PlanRed] {
+		t.Errorf("For(red) = %+v", got)
+	}
+	if got := plans.For("enterprise"); got != plans[database.PlanFree] {
+		t.Errorf("unknown plan = %+v, want the free plan's entitlements", got)
+	}
+}
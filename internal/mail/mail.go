@@ -0,0 +1,199 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages to users
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes every message to the default logger instead of sending it
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileMailer writes every message to its own .eml file in Dir
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) Send(ctx context.Context, msg Message) error {
+	err := os.MkdirAll(m.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000000000"), sanitize(msg.To))
+
+	data, err := format("", msg, now)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0600)
+}
+
+// SMTPMailer sends every message through an SMTP relay. The connection is
+// upgraded with STARTTLS when the relay offers it, and credentials are only
+// sent over TLS or to localhost.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.From, msg, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(m.From)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(msg.To)
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// format renders msg as an RFC 5322 message, leaving out From if it's empty
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	if strings.ContainsAny(from+msg.To+msg.Subject, "\r\n") {
+		return nil, errors.New("mail headers must not contain line breaks")
+	}
+
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String()), nil
+}
+
+// sanitize keeps an address safe to use in a file name
+func sanitize(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, address)
+}
+
+// Config selects and configures a Mailer
+type Config struct {
+	// Mailer is "smtp", or "log" or "file" for local development
+	Mailer   string
+	Dir      string
+	SMTPHost string
+	SMTPPort string
+	Username string
+	Password string
+	From     string
+}
+
+// New returns the Mailer described by cfg
+func New(cfg Config) (Mailer, error) {
+	switch cfg.Mailer {
+	case "log":
+		return LogMailer{}, nil
+	case "file":
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("file mailer needs a directory")
+		}
+		return FileMailer{Dir: cfg.Dir}, nil
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.From == "" {
+			return nil, fmt.Errorf("smtp mailer needs a host and a from address")
+		}
+		return SMTPMailer{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			Username: cfg.Username,
+			Password: cfg.Password,
+			From:     cfg.From,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer: %s", cfg.Mailer)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/database"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newLogger logs as text, or as JSON when format is "json". Debug messages
+// are only logged when debug is set.
+func newLogger(w io.Writer, format string, debug bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debug {
+		opts.Level = slog.LevelDebug
+	}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request ID and trace to messages logged with the
+// context of a request
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs err and exits, for problems that keep the server from starting
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo is filled in by handlers while a request is served, so the
+// access log, metrics and trace can say which route served it, who made it
+// and what went wrong
+type requestInfo struct {
+	id     string
+	route  string
+	userId int
+	err    error
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// withRequestInfo returns ctx with a requestInfo, reusing the one an outer
+// middleware already attached
+func withRequestInfo(ctx context.Context) (context.Context, *requestInfo) {
+	if info := requestInfoFrom(ctx); info != nil {
+		return ctx, info
+	}
+	info := &requestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// recordRoute keeps the pattern that matched r once a router has served it.
+// Routers nested in others record theirs first, so the most specific
+// pattern is kept.
+func recordRoute(r *http.Request) {
+	if info := requestInfoFrom(r.Context()); info != nil && info.route == "" {
+		info.route = r.Pattern
+	}
+}
+
+// requestRoute returns the route recorded for the request ctx belongs to
+func requestRoute(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil && info.route != "" {
+		return info.route
+	}
+	return "unmatched"
+}
+
+// logAuthentication records who a request was made by once its token has
+// been checked, and why it was rejected otherwise
+func logAuthentication(ctx context.Context, user *database.User, err *error) {
+	if *err != nil {
+		slog.DebugContext(ctx, "authentication failed", "error", *err)
+		return
+	}
+	if info := requestInfoFrom(ctx); info != nil {
+		info.userId = user.Id
+	}
+	setSpanAttributes(ctx, attribute.Int("user.id", user.Id))
+}
+
+// recordRequestError keeps err for the access log of r, for errors the
+// client isn't told about
+func recordRequestError(r *http.Request, err error) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.err = err
+	}
+	trace.SpanFromContext(r.Context()).RecordError(err)
+}
+
+// respondWithServerError hides err from the client but keeps it for the
+// access log
+func respondWithServerError(w http.ResponseWriter, r *http.Request, err error) {
+	recordRequestError(r, err)
+	respondWithError(w, 500, "Something went wrong")
+}
+
+const maxRequestIDLength = 128
+
+// validRequestID accepts IDs made of printable ASCII without spaces, so a
+// caller's ID can't break up log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// middlewareLogging tags every request with an ID, reusing the caller's
+// X-Request-ID when it sends one, and writes an access log line once the
+// request has been served
+func middlewareLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var err error
+			id, err = randomId(16)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "generate request id", "error", err)
+				respondWithError(w, 500, "Something went wrong")
+				return
+			}
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx, info := withRequestInfo(r.Context())
+		info.id = id
+		logged := r.WithContext(ctx)
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, logged)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", requestRoute(ctx)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if info.userId != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.userId))
+		}
+		level := slog.LevelInfo
+		if info.err != nil {
+			attrs = append(attrs, slog.Any("error", info.err))
+			level = slog.LevelError
+		}
+		slog.LogAttrs(logged.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewaresSeeNestedRoute(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.adminToken = "admin-token"
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	adminMux := http.NewServeMux()
+	adminMux.Handle("GET /admin/things/{id}", cfg.requirePermission(auth.PermViewMetrics, ok))
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", cfg.requireAdmin(adminMux))
+	handler := middlewareTracing(middlewareLogging(cfg.metrics.middleware(mux)))
+
+	req := httptest.NewRequest("GET", "/admin/things/42", nil)
+	req.Header.Set("Authorization", "Apikey admin-token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	const route = "GET /admin/things/{id}"
+	if n := testutil.ToFloat64(cfg.metrics.requests.WithLabelValues(route, "GET", "200")); n != 1 {
+		t.Errorf("metrics counted %v requests for %s, want 1", n, route)
+	}
+
+	var line struct {
+		Msg   string `json:"msg"`
+		Route string `json:"route"`
+	}
+	err := json.Unmarshal(logs.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Msg != "request" || line.Route != route {
+		t.Errorf("access log has route %q, want %q", line.Route, route)
+	}
+	if req.Pattern != "" {
+		t.Errorf("caller's request was changed to pattern %q", req.Pattern)
+	}
+}
@@ -1,85 +1,509 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/config"
 	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/entitlements"
+	"github.com/carsongro/chirpy/internal/mail"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
-	const filePathRoot = "."
-	const port = "8080"
-
 	godotenv.Load()
-	jwtSecret := os.Getenv("JWT_SECRET")
-	polkaKey := os.Getenv("POLKA_KEY")
-
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
 
-	db, err := database.NewDB("database.json", *dbg)
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, usage)
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if len(args) > 0 {
+		err := runCommand(cfg, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	slog.SetDefault(newLogger(os.Stderr, cfg.Log.Format, cfg.Debug))
+
+	// Missing secrets would otherwise only show up once a request needs them
+	err = cfg.Validate()
+	if err != nil {
+		fatal("invalid config", err)
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	spanExporter, err := newSpanExporter(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		fatal("invalid tracing config", err)
+	}
+	var tracerProvider *sdktrace.TracerProvider
+	if spanExporter != nil {
+		tracerProvider, err = newTracerProvider(context.Background(), spanExporter)
+		if err != nil {
+			fatal("invalid tracing config", err)
+		}
+		otel.SetTracerProvider(tracerProvider)
+	}
+
+	// Closed on shutdown to stop the background jobs
+	done := make(chan struct{})
+
+	db, err := database.NewDB(cfg.Database.Path, false)
+	if err != nil {
+		fatal("open database", err)
+	}
+
+	policy := auth.TokenPolicy{
+		AccessTTL:      cfg.Tokens.AccessTTL,
+		RefreshTTL:     cfg.Tokens.RefreshTTL,
+		MFATTL:         cfg.Tokens.MFATTL,
+		Issuer:         cfg.Tokens.Issuer,
+		Audience:       cfg.Tokens.Audience,
+		Leeway:         cfg.Tokens.Leeway,
+		RequiredClaims: cfg.Tokens.RequiredClaims,
+	}
+
+	// Retired keys must outlive the longest token signed with them
+	keys, err := auth.NewKeySet(cfg.Tokens.KeysFile, cfg.Tokens.SigningAlg, policy.RefreshTTL+policy.Leeway, cfg.Tokens.LegacySecret)
+	if err != nil {
+		fatal("load signing keys", err)
+	}
+	keys.StartRotation(cfg.Tokens.KeyRotation, done)
+
+	tokens, err := auth.NewIssuer(keys, policy)
+	if err != nil {
+		fatal("invalid token policy", err)
+	}
+
+	passwords, err := auth.NewPasswordHasher(cfg.Passwords.Hash, cfg.Passwords.BcryptCost)
+	if err != nil {
+		fatal("invalid password hash config", err)
+	}
+
+	passwordPolicy := auth.PasswordPolicy{
+		MinLength:     cfg.Passwords.MinLength,
+		MaxLength:     cfg.Passwords.MaxLength,
+		MinClasses:    cfg.Passwords.MinClasses,
+		DisallowEmail: cfg.Passwords.DisallowEmail,
+	}
+	if cfg.Passwords.Hash == auth.HashBcrypt && (passwordPolicy.MaxLength <= 0 || passwordPolicy.MaxLength > 72) {
+		fatal("invalid password policy", errors.New("passwords.max_length can't exceed 72 bytes with bcrypt"))
+	}
+
+	var breachList *auth.BreachList
+	if cfg.Passwords.BreachedDir != "" {
+		breachList, err = auth.NewBreachList(cfg.Passwords.BreachedDir)
+		if err != nil {
+			fatal("invalid breached password list", err)
+		}
+	}
+
+	polkaWebhooks, err := auth.NewWebhookVerifier(cfg.Polka.WebhookSecrets, cfg.Polka.WebhookTolerance)
+	if err != nil {
+		fatal("invalid polka webhook config", err)
+	}
+
+	mailer, err := mail.New(mail.Config{
+		Mailer:   cfg.Mail.Mailer,
+		Dir:      cfg.Mail.Dir,
+		SMTPHost: cfg.Mail.SMTPHost,
+		SMTPPort: cfg.Mail.SMTPPort,
+		Username: cfg.Mail.Username,
+		Password: cfg.Mail.Password,
+		From:     cfg.Mail.From,
+	})
+	if err != nil {
+		fatal("invalid mailer config", err)
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthn.RPID,
+		RPDisplayName: "Chirpy",
+		RPOrigins:     cfg.WebAuthn.RPOrigins,
+	})
+	if err != nil {
+		fatal("invalid webauthn config", err)
+	}
+
+	deletedChirps := cfg.Accounts.DeletionChirps
+	if deletedChirps != deletedChirpsDelete && deletedChirps != deletedChirpsAnonymize {
+		fatal("invalid accounts.deletion_chirps", fmt.Errorf("unknown mode %q", deletedChirps))
+	}
+	plans := entitlements.Default()
+	if cfg.Chirps.EntitlementsFile != "" {
+		plans, err = entitlements.Load(cfg.Chirps.EntitlementsFile)
+		if err != nil {
+			fatal("invalid entitlements", err)
+		}
+	}
+
+	oidcProviders, err := loadOIDCProviders(cfg.OIDC)
+	if err != nil {
+		fatal("invalid oidc config", err)
+	}
+
+	// Chirps are censored regardless of case
+	bannedWords := make(map[string]bool)
+	for _, word := range cfg.Chirps.BannedWords {
+		bannedWords[strings.ToLower(word)] = true
+	}
+
+	// The observer has to be set before the database is copied into the
+	// config
+	appMetrics := newMetrics()
+	db.SetObserver(appMetrics)
+
 	apiCfg := apiConfig{
-		fileserverHits: 0,
-		db:             *db,
-		jwtSecret:      jwtSecret,
-		polkaKey:       polkaKey,
+		metrics:       appMetrics,
+		db:            *db,
+		keys:          keys,
+		tokens:        tokens,
+		adminToken:    cfg.AdminToken,
+		polkaWebhooks: polkaWebhooks,
+
+		subscriptionPeriod: cfg.Subscriptions.Period,
+		plans:              plans,
+		chirpLimiter:       newRateLimiter(time.Minute),
+		mediaLimiter:       newRateLimiter(time.Hour),
+		mediaDir:           cfg.Chirps.MediaDir,
+		bannedWords:        bannedWords,
+		webhooks: newWebhookSender(
+			cfg.Webhooks.AllowPrivate,
+			cfg.Webhooks.MaxAttempts,
+			cfg.Webhooks.RetryBase,
+			cfg.Webhooks.RetryMax,
+			cfg.Webhooks.HistoryTTL,
+		),
+		devMode: cfg.DevMode,
+
+		passwords:      passwords,
+		passwordPolicy: passwordPolicy,
+		breachList:     breachList,
+
+		mailer:               mailer,
+		passwordResetTTL:     cfg.Passwords.ResetTTL,
+		passwordResetLimit:   cfg.Passwords.ResetLimit,
+		passwordResetIPs:     newRateLimiter(time.Hour),
+		emailVerificationTTL: cfg.Accounts.EmailVerificationTTL,
+		verifiedOnly:         toSet(cfg.Accounts.UnverifiedRestrictions),
+
+		webauthn:   webAuthn,
+		ceremonies: newFlowStore[ceremony](5 * time.Minute),
+
+		oidcProviders: oidcProviders,
+		oidcFlows:     newFlowStore[oidcFlow](oidcFlowTTL),
+
+		authCodes: newFlowStore[authCode](time.Minute),
+
+		loginAccounts: newLoginThrottle(cfg.Login.MaxFailures, cfg.Login.Lockout, cfg.Login.MaxLockout),
+		loginIPs:      newLoginThrottle(cfg.Login.IPMaxFailures, cfg.Login.Lockout, cfg.Login.MaxLockout),
+
+		deletionGrace:  cfg.Accounts.DeletionGrace,
+		deletedChirps:  deletedChirps,
+		exportDir:      cfg.Accounts.ExportDir,
+		exportTTL:      cfg.Accounts.ExportTTL,
+		exportInterval: cfg.Accounts.ExportInterval,
 	}
 
+	err = apiCfg.failUnfinishedExports()
+	if err != nil {
+		fatal("fail unfinished data exports", err)
+	}
+
+	apiCfg.startAccountPurge(cfg.Accounts.PurgeInterval, done)
+	apiCfg.startSubscriptionExpiry(cfg.Subscriptions.ExpiryInterval, done)
+	apiCfg.startWebhookDelivery(cfg.Webhooks.DeliveryInterval, done)
+	apiCfg.startThrottlePruning(time.Minute, done)
+	apiCfg.startMediaSweep(time.Hour, cfg.Chirps.OrphanMediaTTL, done)
+
 	mux := http.NewServeMux()
-	mux.Handle("/app/*", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filePathRoot)))))
+	staticFiles, err := newPrivateFileSystem(cfg.Server.FileRoot,
+		cfg.File,
+		cfg.Database.Path,
+		cfg.Tokens.KeysFile,
+		cfg.Accounts.ExportDir,
+		cfg.Chirps.MediaDir,
+		cfg.Chirps.EntitlementsFile,
+		cfg.Mail.Dir,
+		cfg.Passwords.BreachedDir,
+	)
+	if err != nil {
+		fatal("serve static files", err)
+	}
+	mux.Handle("/app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(staticFiles))))
 
-	mux.HandleFunc("GET /api/healthz", redinessHandler)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.metricsHandler)
-	mux.HandleFunc("/reset", apiCfg.resetHandler)
+	mux.HandleFunc("GET /api/livez", livenessHandler)
+	mux.HandleFunc("GET /api/healthz", apiCfg.readinessHandler)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.JWKSHandler)
+	adminMux := http.NewServeMux()
+	adminMux.Handle("GET /admin/metrics", apiCfg.requirePermission(auth.PermViewMetrics, apiCfg.metricsHandler))
+	adminMux.Handle("POST /admin/reset", apiCfg.requirePermission(auth.PermResetMetrics, apiCfg.resetHandler))
+	adminMux.Handle("POST /reset", apiCfg.requirePermission(auth.PermResetMetrics, apiCfg.resetHandler))
+	adminMux.Handle("POST /admin/users/unlock", apiCfg.requirePermission(auth.PermUnlockUsers, apiCfg.PostAdminUnlockHandler))
+	adminMux.Handle("PUT /admin/users/{userID}/role", apiCfg.requirePermission(auth.PermManageRoles, apiCfg.PutUserRoleHandler))
+	adminMux.Handle("GET /admin/webhooks", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.GetWebhookEventsHandler))
+	adminMux.Handle("POST /admin/webhooks/{eventID}/replay", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.PostWebhookReplayHandler))
+	adminMux.Handle("POST /admin/webhook-endpoints", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.PostAdminWebhookEndpointHandler))
+	adminMux.Handle("GET /admin/webhook-endpoints", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.GetAdminWebhookEndpointsHandler))
+	adminMux.Handle("DELETE /admin/webhook-endpoints/{endpointID}", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.DeleteAdminWebhookEndpointHandler))
+	adminMux.Handle("GET /admin/webhook-endpoints/{endpointID}/deliveries", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.GetAdminWebhookDeliveriesHandler))
+	adminMux.Handle("POST /admin/webhook-endpoints/{endpointID}/deliveries/{deliveryID}/retry", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.PostAdminWebhookDeliveryRetryHandler))
+	adminMux.Handle("GET /admin/webhook-deliveries/dead", apiCfg.requirePermission(auth.PermManageWebhooks, apiCfg.GetAdminDeadLettersHandler))
+	admin := apiCfg.requireAdmin(adminMux)
+	mux.Handle("/admin/", admin)
+	mux.Handle("POST /reset", admin)
 
 	mux.HandleFunc("POST /api/chirps", apiCfg.PostChirpHandler)
 	mux.HandleFunc("GET /api/chirps", apiCfg.GetChirpsHandler)
 	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.GetChirpHandler)
+	mux.HandleFunc("PUT /api/chirps/{chirpID}", apiCfg.PutChirpHandler)
 	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.DeleteChirpHandler)
+	mux.HandleFunc("POST /api/media", apiCfg.PostMediaHandler)
+	mux.HandleFunc("GET /api/media/{mediaID}", apiCfg.GetMediaHandler)
 
 	mux.HandleFunc("POST /api/users", apiCfg.PostUserHandler)
 	mux.HandleFunc("POST /api/login", apiCfg.PostLoginHandler)
-	mux.HandleFunc("PUT /api/users", apiCfg.PutUsersHandler)
+	mux.HandleFunc("POST /api/login/2fa", apiCfg.PostLoginMFAHandler)
+	mux.HandleFunc("POST /api/login/passkey/begin", apiCfg.PostPasskeyLoginBeginHandler)
+	mux.HandleFunc("POST /api/login/passkey/finish", apiCfg.PostPasskeyLoginFinishHandler)
+	mux.HandleFunc("GET /api/oauth/{provider}/start", apiCfg.GetOIDCStartHandler)
+	mux.HandleFunc("GET /api/oauth/{provider}/callback", apiCfg.GetOIDCCallbackHandler)
+
+	mux.HandleFunc("GET /oauth/authorize", apiCfg.GetOAuthAuthorizeHandler)
+	mux.HandleFunc("POST /oauth/token", apiCfg.PostOAuthTokenHandler)
+	mux.HandleFunc("POST /oauth/revoke", apiCfg.PostOAuthRevokeHandler)
+	mux.HandleFunc("POST /oauth/authorize", apiCfg.PostOAuthAuthorizeHandler)
+	mux.HandleFunc("POST /api/apps", apiCfg.PostOAuthClientHandler)
+	mux.HandleFunc("GET /api/apps", apiCfg.GetOAuthClientsHandler)
+	mux.HandleFunc("GET /api/apps/{clientID}", apiCfg.GetOAuthClientHandler)
+	mux.HandleFunc("DELETE /api/apps/{clientID}", apiCfg.DeleteOAuthClientHandler)
+	mux.HandleFunc("GET /api/users/apps", apiCfg.GetOAuthAuthorizationsHandler)
+	mux.HandleFunc("DELETE /api/users/apps/{clientID}", apiCfg.DeleteOAuthAuthorizationHandler)
+	mux.HandleFunc("GET /api/users/tokens", apiCfg.GetPersonalTokensHandler)
+	mux.HandleFunc("POST /api/users/tokens", apiCfg.PostPersonalTokenHandler)
+	mux.HandleFunc("DELETE /api/users/tokens/{tokenID}", apiCfg.DeletePersonalTokenHandler)
+
+	mux.HandleFunc("PUT /api/users", apiCfg.PatchUserHandler)
+	mux.HandleFunc("GET /api/users/me", apiCfg.GetUserMeHandler)
+	mux.HandleFunc("GET /api/users/me/subscription", apiCfg.GetSubscriptionHandler)
+	mux.HandleFunc("POST /api/users/webhooks", apiCfg.PostWebhookEndpointHandler)
+	mux.HandleFunc("GET /api/users/webhooks", apiCfg.GetWebhookEndpointsHandler)
+	mux.HandleFunc("DELETE /api/users/webhooks/{endpointID}", apiCfg.DeleteWebhookEndpointHandler)
+	mux.HandleFunc("GET /api/users/webhooks/{endpointID}/deliveries", apiCfg.GetWebhookDeliveriesHandler)
+	mux.HandleFunc("POST /api/users/webhooks/{endpointID}/deliveries/{deliveryID}/retry", apiCfg.PostWebhookDeliveryRetryHandler)
+	mux.HandleFunc("PATCH /api/users/me", apiCfg.PatchUserHandler)
+	mux.HandleFunc("DELETE /api/users/me", apiCfg.DeleteUserMeHandler)
+	mux.HandleFunc("POST /api/users/me/restore", apiCfg.PostUserRestoreHandler)
+	mux.HandleFunc("POST /api/users/me/export", apiCfg.PostDataExportHandler)
+	mux.HandleFunc("GET /api/users/me/export", apiCfg.GetDataExportHandler)
+	mux.HandleFunc("GET /api/users/me/export/download", apiCfg.GetDataExportDownloadHandler)
+	mux.HandleFunc("POST /api/users/verify", apiCfg.PostEmailVerifyHandler)
+	mux.HandleFunc("POST /api/users/verify/resend", apiCfg.PostEmailVerifyResendHandler)
+	mux.HandleFunc("POST /api/users/2fa/enroll", apiCfg.PostMFAEnrollHandler)
+	mux.HandleFunc("POST /api/users/2fa/confirm", apiCfg.PostMFAConfirmHandler)
+	mux.HandleFunc("POST /api/users/2fa/disable", apiCfg.PostMFADisableHandler)
+	mux.HandleFunc("GET /api/users/passkeys", apiCfg.GetPasskeysHandler)
+	mux.HandleFunc("POST /api/users/passkeys/register/begin", apiCfg.PostPasskeyRegisterBeginHandler)
+	mux.HandleFunc("POST /api/users/passkeys/register/finish", apiCfg.PostPasskeyRegisterFinishHandler)
+	mux.HandleFunc("DELETE /api/users/passkeys/{passkeyID}", apiCfg.DeletePasskeyHandler)
 	mux.HandleFunc("POST /api/refresh", apiCfg.PostRefreshHandler)
 	mux.HandleFunc("POST /api/revoke", apiCfg.PostRevokeHandler)
+	mux.HandleFunc("POST /api/password/forgot", apiCfg.PostPasswordForgotHandler)
+	mux.HandleFunc("POST /api/password/reset", apiCfg.PostPasswordResetHandler)
+
+	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.PostPolkaWebhookHandler)
 
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.PostUserUpgrade)
+	mux.Handle("GET /metrics", apiCfg.requireAdmin(apiCfg.requirePermission(auth.PermViewMetrics, apiCfg.metrics.handler().ServeHTTP)))
 
-	corsMux := middlewareCors(mux)
+	corsMux := middlewareCors(middlewareTracing(middlewareLogging(apiCfg.metrics.middleware(mux))))
 
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: corsMux,
+		Addr:              ":" + cfg.Server.Port,
+		Handler:           corsMux,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	slog.Info("serving", "port", cfg.Server.Port)
+
+	select {
+	case err := <-serveErr:
+		fatal("serve", err)
+	case <-signals.Done():
+	}
+	// A second signal stops the server right away
+	stop()
+
+	// Failing readiness first gives load balancers time to stop sending
+	// requests before the listener closes
+	slog.Info("shutting down", "drain", cfg.Server.ShutdownDrain)
+	apiCfg.draining.Store(true)
+	time.Sleep(cfg.Server.ShutdownDrain)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("shut down server", "error", err)
+	}
+	close(done)
+
+	// Mail and exports that requests started get to finish first
+	waited := make(chan struct{})
+	go func() {
+		apiCfg.background.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-shutdownCtx.Done():
+		slog.Warn("background work still running at shutdown")
+	}
+
+	// Jobs still running can't write anymore once the database is closed
+	err = apiCfg.db.Close()
+	if err != nil {
+		slog.Error("close database", "error", err)
+	}
+	if tracerProvider != nil {
+		err = tracerProvider.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("flush traces", "error", err)
+		}
+	}
+	slog.Info("stopped")
+}
+
+// loadOIDCProviders sets up every configured OIDC provider
+func loadOIDCProviders(configs map[string]config.OIDCProvider) (map[string]*auth.OIDCProvider, error) {
+	providers := make(map[string]*auth.OIDCProvider)
+	for name, c := range configs {
+		provider, err := auth.NewOIDCProvider(auth.OIDCConfig{
+			Name:         name,
+			IssuerURL:    c.Issuer,
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL:  c.RedirectURL,
+			Scopes:       c.Scopes,
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// toSet turns a list of settings into a set
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// livenessHandler only shows that the server is up and answering
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithStatus(w, http.StatusOK)
+}
+
+// readinessHandler reports whether the server should be sent requests, which
+// it shouldn't while shutting down or when the database file can't be read
+// and written
+func (cfg *apiConfig) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.draining.Load() {
+		respondWithStatus(w, http.StatusServiceUnavailable)
+		return
+	}
+
+	err := cfg.db.WithContext(r.Context()).Check()
+	if err != nil {
+		recordRequestError(r, err)
+		respondWithStatus(w, http.StatusServiceUnavailable)
+		return
 	}
 
-	log.Printf("Serving on port: %s\n", port)
-	log.Fatal(srv.ListenAndServe())
+	respondWithStatus(w, http.StatusOK)
 }
 
-func redinessHandler(w http.ResponseWriter, r *http.Request) {
+func respondWithStatus(w http.ResponseWriter, code int) {
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+	w.WriteHeader(code)
+	w.Write([]byte(http.StatusText(code)))
 }
 
+// metricsHandler renders Chirpy's own metrics from the Prometheus registry
+// as a page for admins
 func (a *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	families, err := a.metrics.registry.Gather()
+	if err != nil {
+		respondWithServerError(w, r, err)
+		return
+	}
+
 	w.Header().Add("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", a.fileserverHits)
-}
+	fmt.Fprintf(w, "<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p>", a.metrics.hitsSinceReset())
+	fmt.Fprint(w, "<table><tr><th>Metric</th><th>Labels</th><th>Value</th></tr>")
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "chirpy_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := []string{}
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
 
-func (a *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
-	a.fileserverHits = 0
-	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+			var value string
+			switch {
+			case metric.Counter != nil:
+				value = strconv.FormatFloat(metric.GetCounter().GetValue(), 'f', -1, 64)
+			case metric.Gauge != nil:
+				value = strconv.FormatFloat(metric.GetGauge().GetValue(), 'f', -1, 64)
+			case metric.Histogram != nil:
+				h := metric.GetHistogram()
+				value = fmt.Sprintf("%d observed, %.4fs total", h.GetSampleCount(), h.GetSampleSum())
+			}
+
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td></tr>",
+				html.EscapeString(family.GetName()), html.EscapeString(strings.Join(labels, ", ")), html.EscapeString(value))
+		}
+	}
+	fmt.Fprint(w, "</table></body></html>")
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/entitlements"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testOrigin = "http://localhost:8080"
+
+// newTestConfig returns an apiConfig backed by a fresh database in a
+// temporary directory, with just enough set up to serve the API
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := database.NewDB(filepath.Join(dir, "database.json"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.NewKeySet(filepath.Join(dir, "jwt_keys.json"), auth.AlgEdDSA, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.NewIssuer(keys, auth.DefaultTokenPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords, err := auth.NewPasswordHasher(auth.HashBcrypt, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          "localhost",
+		RPDisplayName: "Chirpy",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{
+		metrics:       newMetrics(),
+		db:            *db,
+		plans:         entitlements.Default(),
+		chirpLimiter:  newRateLimiter(time.Minute),
+		mediaLimiter:  newRateLimiter(time.Hour),
+		mediaDir:      filepath.Join(dir, "media"),
+		keys:          keys,
+		tokens:        tokens,
+		passwords:     passwords,
+		webauthn:      webAuthn,
+		ceremonies:    newFlowStore[ceremony](5 * time.Minute),
+		oidcFlows:     newFlowStore[oidcFlow](oidcFlowTTL),
+		authCodes:     newFlowStore[authCode](time.Minute),
+		loginAccounts: newLoginThrottle(5, time.Minute, time.Hour),
+		loginIPs:      newLoginThrottle(50, time.Minute, time.Hour),
+	}
+}
+
+// createTestUser stores a verified user and returns it with an access token
+func createTestUser(t *testing.T, cfg *apiConfig, email string) (database.User, string) {
+	t.Helper()
+
+	user, err := cfg.db.CreateUser(email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.EmailVerified = true
+	user, err = cfg.db.UpdateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := cfg.tokens.Issue(auth.TokenAccess, strconv.Itoa(user.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+// serveJSON sends body as JSON to handler and decodes the response into out,
+// returning the status code. A nil out skips decoding.
+func serveJSON(t *testing.T, handler http.HandlerFunc, method, target, token string, body, out any) int {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, target, &reqBody)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if out != nil && rec.Code < 300 {
+		err := json.Unmarshal(rec.Body.Bytes(), out)
+		if err != nil {
+			t.Fatalf("decode %s response: %v: %s", target, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Why an authentication attempt failed, as reported by the auth failure
+// counter
+const (
+	authFailureLogin     = "login"
+	authFailureToken     = "token"
+	authFailureAdmin     = "admin_token"
+	authFailureForbidden = "forbidden"
+	authFailureWebhook   = "webhook_signature"
+)
+
+// metrics holds everything Chirpy reports to Prometheus. The admin page
+// reads from the same registry.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	dbDuration      *prometheus.HistogramVec
+	dbFileSize      prometheus.Gauge
+	authFailures    *prometheus.CounterVec
+	fileserverHits  prometheus.Counter
+
+	// hitsAtReset is the fileserver hit count when the admin page was last
+	// reset, as float64 bits. Counters can't go down, so the page shows
+	// hits since then instead.
+	hitsAtReset atomic.Uint64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chirpy_http_requests_total",
+			Help: "HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chirpy_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chirpy_db_operation_duration_seconds",
+			Help:    "Time taken to load or write the database file.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+		}, []string{"operation"}),
+		dbFileSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "chirpy_db_file_size_bytes",
+			Help: "Size of the database file when it was last loaded or written.",
+		}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chirpy_auth_failures_total",
+			Help: "Failed authentication and authorization attempts, by reason.",
+		}, []string{"reason"}),
+		fileserverHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chirpy_fileserver_hits_total",
+			Help: "Requests for the static app files.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.dbDuration,
+		m.dbFileSize,
+		m.authFailures,
+		m.fileserverHits,
+	)
+	// Reasons are known up front, so every series shows up from the start
+	for _, reason := range []string{authFailureLogin, authFailureToken, authFailureAdmin, authFailureForbidden, authFailureWebhook} {
+		m.authFailures.WithLabelValues(reason)
+	}
+
+	return m
+}
+
+// ObserveLoad records a read of the database file, see database.Observer
+func (m *metrics) ObserveLoad(d time.Duration, size int) {
+	m.dbDuration.WithLabelValues("load").Observe(d.Seconds())
+	m.dbFileSize.Set(float64(size))
+}
+
+// ObserveWrite records a write of the database file, see database.Observer
+func (m *metrics) ObserveWrite(d time.Duration, size int) {
+	m.dbDuration.WithLabelValues("write").Observe(d.Seconds())
+	m.dbFileSize.Set(float64(size))
+}
+
+// authFailed counts a failed authentication attempt
+func (m *metrics) authFailed(reason string) {
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+// countAuthFailure counts a failure if *err is set, for deferring in
+// functions that authenticate
+func (m *metrics) countAuthFailure(reason string, err *error) {
+	if *err != nil {
+		m.authFailed(reason)
+	}
+}
+
+// handler serves the registry in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// hitsSinceReset returns fileserver hits since resetHits was last called
+func (m *metrics) hitsSinceReset() int {
+	return int(counterValue(m.fileserverHits) - math.Float64frombits(m.hitsAtReset.Load()))
+}
+
+func (m *metrics) resetHits() {
+	m.hitsAtReset.Store(math.Float64bits(counterValue(m.fileserverHits)))
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	err := c.Write(metric)
+	if err != nil {
+		return 0
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// middleware counts and times requests by the mux pattern that handled
+// them, so paths with IDs in them don't each get their own series
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+		recordRoute(r)
+
+		route := requestRoute(r.Context())
+		method := r.Method
+		if !standardMethods[method] {
+			method = "OTHER"
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	})
+}
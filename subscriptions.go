@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/carsongro/chirpy/internal/entitlements"
+)
+
+// Polka subscription events
+const (
+	eventUserUpgraded      = "user.upgraded"
+	eventUserDowngraded    = "user.downgraded"
+	eventUserRenewed       = "user.renewed"
+	eventUserPaymentFailed = "user.payment_failed"
+	eventUserRefunded      = "user.refunded"
+	eventPeriodExpired     = "period.expired"
+)
+
+// errStaleSubscriptionEvent means the event was already applied, or Polka
+// sent it no later than one that was, so it arrived out of order and no
+// longer says anything
+var errStaleSubscriptionEvent = errors.New("event is no newer than the last change applied")
+
+// applySubscriptionEvent moves a user's subscription on in response to a
+// Polka event. Polka may send the end of the paid period, otherwise a period
+// lasts cfg.subscriptionPeriod. A failed payment keeps Red until the period
+// ends, while a downgrade or refund takes it away straight away. Events
+// that were already applied, or that Polka sent no later than the last one
+// applied, are dropped.
+func (cfg *apiConfig) applySubscriptionEvent(ctx context.Context, event database.WebhookEvent) error {
+	db := cfg.db.WithContext(ctx)
+
+	type parameters struct {
+		Data struct {
+			UserId           int       `json:"user_id"`
+			CurrentPeriodEnd time.Time `json:"current_period_end"`
+		} `json:"data"`
+	}
+
+	params := parameters{}
+	err := json.Unmarshal(event.Payload, &params)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.GetUser(params.Data.UserId)
+	if err != nil {
+		return errWebhookUserNotFound
+	}
+
+	var sub database.Subscription
+	user, err := db.UpdateUserFunc(params.Data.UserId, func(user *database.User) error {
+		sub = user.Subscription
+		if alreadyApplied(sub, event) {
+			return errStaleSubscriptionEvent
+		}
+
+		now := time.Now().UTC()
+		periodEnd := params.Data.CurrentPeriodEnd
+		switch event.Event {
+		case eventUserUpgraded:
+			if periodEnd.IsZero() {
+				periodEnd = now.Add(cfg.subscriptionPeriod)
+			}
+			sub.Plan = database.PlanRed
+			sub.Status = database.SubscriptionActive
+			sub.CurrentPeriodEnd = periodEnd
+		case eventUserRenewed:
+			if periodEnd.IsZero() {
+				periodEnd = sub.CurrentPeriodEnd
+				if periodEnd.Before(now) {
+					periodEnd = now
+				}
+				periodEnd = periodEnd.Add(cfg.subscriptionPeriod)
+			}
+			sub.Plan = database.PlanRed
+			sub.Status = database.SubscriptionActive
+			sub.CurrentPeriodEnd = periodEnd
+		case eventUserPaymentFailed:
+			sub.Status = database.SubscriptionPastDue
+		case eventUserDowngraded:
+			sub.Plan = database.PlanFree
+			sub.Status = database.SubscriptionCanceled
+			sub.CurrentPeriodEnd = now
+		case eventUserRefunded:
+			sub.Plan = database.PlanFree
+			sub.Status = database.SubscriptionRefunded
+			sub.CurrentPeriodEnd = now
+		}
+
+		user.Subscription = recordSubscriptionChange(sub, event.Event, event.Id, event.SentAt, now)
+		user.IsChirpyRed = hasRed(user.Subscription, now)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if event.Event == eventUserUpgraded {
+		type upgradedData struct {
+			userEventData
+			Plan             string    `json:"plan"`
+			CurrentPeriodEnd time.Time `json:"current_period_end"`
+		}
+		cfg.emitEvent(ctx, eventUserUpgraded, user.Id, upgradedData{
+			userEventData:    userEventData{Id: user.Id, Email: user.Email},
+			Plan:             sub.Plan,
+			CurrentPeriodEnd: sub.CurrentPeriodEnd,
+		})
+	}
+	return nil
+}
+
+func recordSubscriptionChange(sub database.Subscription, event, eventId string, sentAt, at time.Time) database.Subscription {
+	sub.History = append(sub.History, database.SubscriptionChange{
+		Event:            event,
+		EventId:          eventId,
+		SentAt:           sentAt,
+		Plan:             sub.Plan,
+		Status:           sub.Status,
+		CurrentPeriodEnd: sub.CurrentPeriodEnd,
+		At:               at,
+	})
+	return sub
+}
+
+// lastPolkaChange returns the latest change Polka sent, or the zero change
+// if there is none
+func lastPolkaChange(sub database.Subscription) database.SubscriptionChange {
+	var last database.SubscriptionChange
+	for _, change := range sub.History {
+		if change.SentAt.After(last.SentAt) {
+			last = change
+		}
+	}
+	return last
+}
+
+// alreadyApplied reports whether event is in sub's history, or was sent no
+// later than the last change Polka sent. Polka timestamps are in seconds, so
+// an event sent in the same second as the last one is taken to be a retry.
+func alreadyApplied(sub database.Subscription, event database.WebhookEvent) bool {
+	for _, change := range sub.History {
+		if change.EventId == event.Id {
+			return true
+		}
+	}
+	last := lastPolkaChange(sub)
+	return !last.SentAt.IsZero() && !event.SentAt.After(last.SentAt)
+}
+
+// hasRed reports whether sub grants Chirpy Red at now
+func hasRed(sub database.Subscription, now time.Time) bool {
+	return sub.Plan == database.PlanRed && now.Before(sub.CurrentPeriodEnd)
+}
+
+// entitlementsFor returns what the user's plan lets them do. Users who got
+// Red before subscriptions were tracked only have IsChirpyRed set.
+func (cfg *apiConfig) entitlementsFor(user database.User) entitlements.Entitlements {
+	if user.IsChirpyRed {
+		return cfg.plans.For(database.PlanRed)
+	}
+	return cfg.plans.For(database.PlanFree)
+}
+
+// startSubscriptionExpiry downgrades users whose paid period has ended
+// without a renewal, every interval until done is closed
+func (cfg *apiConfig) startSubscriptionExpiry(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			cfg.expireSubscriptions(time.Now().UTC())
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (cfg *apiConfig) expireSubscriptions(now time.Time) {
+	ctx, span := startJob("expire_subscriptions")
+	defer span.End()
+	db := cfg.db.WithContext(ctx)
+
+	users, err := db.GetUsers()
+	if err != nil {
+		slog.Error("expire subscriptions", "error", err)
+		return
+	}
+	for _, user := range users {
+		if !periodOver(user.Subscription, now) {
+			continue
+		}
+
+		// The subscription may have been renewed since the users were read
+		_, err = db.UpdateUserFunc(user.Id, func(user *database.User) error {
+			sub := user.Subscription
+			if !periodOver(sub, now) {
+				return errSubscriptionCurrent
+			}
+
+			sub.Plan = database.PlanFree
+			sub.Status = database.SubscriptionExpired
+			user.Subscription = recordSubscriptionChange(sub, eventPeriodExpired, "", time.Time{}, now)
+			user.IsChirpyRed = false
+			return nil
+		})
+		if errors.Is(err, errSubscriptionCurrent) {
+			continue
+		}
+		if err != nil {
+			slog.Error("expire subscription", "user_id", user.Id, "error", err)
+			continue
+		}
+		slog.Info("subscription expired", "user_id", user.Id)
+	}
+}
+
+// errSubscriptionCurrent leaves a subscription that was renewed while the
+// expiry job ran alone
+var errSubscriptionCurrent = errors.New("subscription period has not ended")
+
+// periodOver reports whether sub is a Red subscription whose paid period
+// ended by now. Users who got Red before subscriptions were tracked have no
+// period to run out.
+func periodOver(sub database.Subscription, now time.Time) bool {
+	return sub.Plan == database.PlanRed && !sub.CurrentPeriodEnd.IsZero() && !now.Before(sub.CurrentPeriodEnd)
+}
+
+type subscriptionResponse struct {
+	Plan             string     `json:"plan"`
+	Status           string     `json:"status,omitempty"`
+	IsChirpyRed      bool       `json:"is_chirpy_red"`
+	CurrentPeriodEnd *time.Time `json:"current_period_end"`
+}
+
+func newSubscriptionResponse(user database.User) subscriptionResponse {
+	response := subscriptionResponse{
+		Plan:        user.Subscription.Plan,
+		Status:      user.Subscription.Status,
+		IsChirpyRed: user.IsChirpyRed,
+	}
+	if response.Plan == "" {
+		response.Plan = database.PlanFree
+	}
+	if !user.Subscription.CurrentPeriodEnd.IsZero() {
+		response.CurrentPeriodEnd = &user.Subscription.CurrentPeriodEnd
+	}
+	return response
+}
+
+// GetSubscriptionHandler shows the user's subscription, what it lets them do
+// and how it got there
+func (cfg *apiConfig) GetSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	jwtToken, err := getBearerToken(r)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.authenticateScoped(r.Context(), jwtToken, auth.ScopeProfile)
+	if err != nil {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	type historyResponse struct {
+		subscriptionResponse
+		Entitlements entitlements.Entitlements     `json:"entitlements"`
+		History      []database.SubscriptionChange `json:"history"`
+	}
+
+	response := historyResponse{
+		subscriptionResponse: newSubscriptionResponse(user),
+		Entitlements:         cfg.entitlementsFor(user),
+		History:              user.Subscription.History,
+	}
+	if response.History == nil {
+		response.History = []database.SubscriptionChange{}
+	}
+
+	respondWithJSON(w, 200, response)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// receivePolkaEvent logs and processes an event as if Polka had sent it at
+// sentAt
+func receivePolkaEvent(t *testing.T, cfg *apiConfig, id, event string, userId int, sentAt time.Time) database.WebhookEvent {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]any{"id": id, "event": event, "data": map[string]any{"user_id": userId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, _, err := cfg.db.RecordWebhookEvent(database.WebhookEvent{
+		Id:         id,
+		Source:     webhookSourcePolka,
+		Event:      event,
+		Payload:    payload,
+		SentAt:     sentAt,
+		ReceivedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := cfg.processPolkaEvent(context.Background(), logged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return processed
+}
+
+func TestSubscriptionEventsOutOfOrder(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.subscriptionPeriod = 30 * 24 * time.Hour
+	user, _ := createTestUser(t, cfg, "red@example.com")
+
+	// The user cancels and then subscribes again, but Polka's retry of the
+	// cancellation arrives last
+	sentAt := time.Now().UTC().Truncate(time.Second)
+	receivePolkaEvent(t, cfg, "evt_upgrade", eventUserUpgraded, user.Id, sentAt.Add(-2*time.Minute))
+	receivePolkaEvent(t, cfg, "evt_renew", eventUserRenewed, user.Id, sentAt)
+	stale := receivePolkaEvent(t, cfg, "evt_downgrade", eventUserDowngraded, user.Id, sentAt.Add(-time.Minute))
+
+	if stale.Status != database.WebhookIgnored {
+		t.Errorf("stale event got status %q, want %q", stale.Status, database.WebhookIgnored)
+	}
+	user, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsChirpyRed || user.Subscription.Plan != database.PlanRed {
+		t.Errorf("stale downgrade was applied: %+v", user.Subscription)
+	}
+	if n := len(user.Subscription.History); n != 2 {
+		t.Errorf("got %d changes in the history, want 2", n)
+	}
+}
+
+func TestSubscriptionEventAppliedOnce(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.subscriptionPeriod = 30 * 24 * time.Hour
+	user, _ := createTestUser(t, cfg, "red@example.com")
+
+	sentAt := time.Now().UTC().Truncate(time.Second)
+	receivePolkaEvent(t, cfg, "evt_upgrade", eventUserUpgraded, user.Id, sentAt.Add(-time.Minute))
+	receivePolkaEvent(t, cfg, "evt_renew", eventUserRenewed, user.Id, sentAt)
+	user, err := cfg.db.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	periodEnd := user.Subscription.CurrentPeriodEnd
+
+	// Neither the same renewal processed again nor a second event sent in
+	// the same second may extend the period again
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"replayed event", "evt_renew"},
+		{"event sent at the same time", "evt_renew_again"},
+	}
+	for _, tt := range tests {
+		event := receivePolkaEvent(t, cfg, tt.id, eventUserRenewed, user.Id, sentAt)
+		if event.Status != database.WebhookIgnored {
+			t.Errorf("%s: got status %q, want %q", tt.name, event.Status, database.WebhookIgnored)
+		}
+		user, err := cfg.db.GetUser(user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.Subscription.CurrentPeriodEnd.Equal(periodEnd) {
+			t.Errorf("%s: period moved from %v to %v", tt.name, periodEnd, user.Subscription.CurrentPeriodEnd)
+		}
+	}
+}
+
+func TestExpireSubscriptions(t *testing.T) {
+	cfg := newTestConfig(t)
+	now := time.Now().UTC()
+
+	setSubscription := func(email string, periodEnd time.Time) database.User {
+		user, _ := createTestUser(t, cfg, email)
+		user, err := cfg.db.UpdateUserFunc(user.Id, func(user *database.User) error {
+			user.IsChirpyRed = true
+			user.Subscription = database.Subscription{
+				Plan:             database.PlanRed,
+				Status:           database.SubscriptionActive,
+				CurrentPeriodEnd: periodEnd,
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	lapsed := setSubscription("lapsed@example.com", now.Add(-time.Hour))
+	current := setSubscription("current@example.com", now.Add(time.Hour))
+
+	cfg.expireSubscriptions(now)
+
+	for _, tt := range []struct {
+		user    database.User
+		wantRed bool
+	}{{lapsed, false}, {current, true}} {
+		user, err := cfg.db.GetUser(tt.user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.IsChirpyRed != tt.wantRed {
+			t.Errorf("%s: got Red %v, want %v", user.Email, user.IsChirpyRed, tt.wantRed)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginThrottle counts failed sign in attempts per key, such as an email or
+// a client IP. Once a key reaches maxFailures it is locked out, for twice as
+// long with every further failure, up to maxLockout. Failures are forgotten
+// after a successful sign in or once a key has been quiet for maxLockout.
+type loginThrottle struct {
+	mux         *sync.Mutex
+	maxFailures int
+	lockout     time.Duration
+	maxLockout  time.Duration
+	attempts    map[string]failedAttempts
+}
+
+type failedAttempts struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func newLoginThrottle(maxFailures int, lockout, maxLockout time.Duration) *loginThrottle {
+	return &loginThrottle{
+		mux:         &sync.Mutex{},
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		maxLockout:  maxLockout,
+		attempts:    make(map[string]failedAttempts),
+	}
+}
+
+// retryAfter returns how much longer key is locked out for, or zero
+func (t *loginThrottle) retryAfter(key string) time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	wait := time.Until(t.attempts[key].lockedUntil)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// fail records a failed attempt for key
+func (t *loginThrottle) fail(key string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	now := time.Now()
+	a := t.attempts[key]
+	a.count++
+	a.lastFailure = now
+	if excess := a.count - t.maxFailures; excess >= 0 {
+		lockout := t.maxLockout
+		if excess < 32 && t.lockout<<excess < t.maxLockout {
+			lockout = t.lockout << excess
+		}
+		a.lockedUntil = now.Add(lockout)
+	}
+	t.attempts[key] = a
+}
+
+// reset forgets key's failures, after a successful sign in or an unlock
+func (t *loginThrottle) reset(key string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	delete(t.attempts, key)
+}
+
+// prune forgets keys that are no longer locked out and have been quiet for
+// maxLockout
+func (t *loginThrottle) prune(now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for key, a := range t.attempts {
+		if now.Sub(a.lastFailure) > t.maxLockout && now.After(a.lockedUntil) {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+// startThrottlePruning forgets stale sign in failures, rate limited actions
+// and abandoned flows every interval until done is closed
+func (cfg *apiConfig) startThrottlePruning(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				cfg.loginAccounts.prune(now)
+				cfg.loginIPs.prune(now)
+				cfg.chirpLimiter.prune(now)
+				cfg.mediaLimiter.prune(now)
+				cfg.passwordResetIPs.prune(now)
+				cfg.ceremonies.prune(now)
+				cfg.oidcFlows.prune(now)
+				cfg.authCodes.prune(now)
+			}
+		}
+	}()
+}
+
+// rateLimiter lets each key act a limited number of times in any window
+type rateLimiter struct {
+	mux    *sync.Mutex
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		mux:    &sync.Mutex{},
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// allow records an action by key if it has acted fewer than limit times in
+// the last window, and otherwise returns how long until it may act again.
+// Limits below one don't limit anything.
+func (l *rateLimiter) allow(key string, limit int) time.Duration {
+	if limit < 1 {
+		return 0
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	events := l.events[key]
+	for len(events) > 0 && now.Sub(events[0]) > l.window {
+		events = events[1:]
+	}
+	if len(events) >= limit {
+		l.events[key] = events
+		return events[len(events)-limit].Add(l.window).Sub(now)
+	}
+
+	l.events[key] = append(events, now)
+	return 0
+}
+
+// prune forgets keys that haven't acted in the last window
+func (l *rateLimiter) prune(now time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for key, events := range l.events {
+		if now.Sub(events[len(events)-1]) > l.window {
+			delete(l.events, key)
+		}
+	}
+}
+
+// clientIP returns the address of the peer that sent r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// respondWithLockout tells a client to wait before trying to sign in again
+func respondWithLockout(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	respondWithError(w, 429, "Too many failed attempts, try again later")
+}
+
+// respondWithRateLimit tells a client it is acting too often
+func respondWithRateLimit(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	respondWithError(w, 429, "Slow down, try again later")
+}
+
+// loginLockout returns how long a sign in as email from r has to wait
+func (cfg *apiConfig) loginLockout(r *http.Request, email string) time.Duration {
+	return max(cfg.loginAccounts.retryAfter(strings.ToLower(email)), cfg.loginIPs.retryAfter(clientIP(r)))
+}
+
+// loginFailed counts a failed sign in as email from r against both the
+// account and the client
+func (cfg *apiConfig) loginFailed(r *http.Request, email string) {
+	cfg.metrics.authFailed(authFailureLogin)
+	cfg.loginAccounts.fail(strings.ToLower(email))
+	cfg.loginIPs.fail(clientIP(r))
+}
+
+// loginSucceeded clears the account's failures. The client's are kept, so
+// signing in to one account doesn't excuse guessing at others.
+func (cfg *apiConfig) loginSucceeded(email string) {
+	cfg.loginAccounts.reset(strings.ToLower(email))
+}
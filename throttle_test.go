@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleLockout(t *testing.T) {
+	throttle := newLoginThrottle(3, time.Minute, 5*time.Minute)
+
+	for range 2 {
+		throttle.fail("user@example.com")
+	}
+	if wait := throttle.retryAfter("user@example.com"); wait != 0 {
+		t.Fatalf("locked out for %v before reaching the limit", wait)
+	}
+
+	// The lockout doubles with every failure past the limit, up to the cap
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		throttle.fail("user@example.com")
+		wait := throttle.retryAfter("user@example.com")
+		if wait > want || wait < want-time.Second {
+			t.Errorf("got lockout %v, want %v", wait, want)
+		}
+	}
+
+	if wait := throttle.retryAfter("other@example.com"); wait != 0 {
+		t.Errorf("another key is locked out for %v", wait)
+	}
+
+	throttle.reset("user@example.com")
+	if wait := throttle.retryAfter("user@example.com"); wait != 0 {
+		t.Errorf("locked out for %v after a reset", wait)
+	}
+}
+
+func TestLoginThrottlePrune(t *testing.T) {
+	throttle := newLoginThrottle(1, time.Minute, time.Hour)
+	throttle.fail("locked")
+	throttle.fail("locked")
+
+	now := time.Now()
+	throttle.prune(now)
+	if _, ok := throttle.attempts["locked"]; !ok {
+		t.Fatal("pruned a key that is still locked out")
+	}
+
+	throttle.prune(now.Add(2 * time.Hour))
+	if len(throttle.attempts) != 0 {
+		t.Errorf("kept %d stale keys", len(throttle.attempts))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// getBearerToken extracts the token from an "Authorization: Bearer" header
+func getBearerToken(r *http.Request) (string, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", errors.New("missing bearer token")
+	}
+	return token, nil
+}
+
+func (cfg *apiConfig) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(auth.JWKSMaxAge.Seconds())))
+	respondWithJSON(w, 200, cfg.keys.JWKS())
+}
+
+// authenticateToken verifies a first-party token of the given use and loads
+// the user it was issued to. Tokens issued before the user's sessions were
+// revoked are rejected, as are tokens issued to third-party apps.
+func (cfg *apiConfig) authenticateToken(ctx context.Context, tokenString, tokenUse string) (user database.User, claims auth.Claims, err error) {
+	defer cfg.metrics.countAuthFailure(authFailureToken, &err)
+	defer logAuthentication(ctx, &user, &err)
+
+	user, claims, err = cfg.loadTokenUser(ctx, tokenString, tokenUse)
+	if err != nil {
+		return database.User{}, auth.Claims{}, err
+	}
+
+	if claims.ClientID != "" {
+		return database.User{}, auth.Claims{}, errors.New("token was issued to a third-party app")
+	}
+
+	return user, claims, nil
+}
+
+// authenticateScoped verifies an access token or personal access token
+// that must carry scope. Tokens issued to a third-party app are only valid
+// while the user hasn't revoked the app.
+func (cfg *apiConfig) authenticateScoped(ctx context.Context, tokenString, scope string) (user database.User, err error) {
+	defer cfg.metrics.countAuthFailure(authFailureToken, &err)
+	defer logAuthentication(ctx, &user, &err)
+
+	if auth.IsPersonalToken(tokenString) {
+		return cfg.authenticatePersonalToken(ctx, tokenString, scope)
+	}
+
+	user, claims, err := cfg.loadTokenUser(ctx, tokenString, auth.TokenAccess)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	if claims.ClientID != "" {
+		err = cfg.checkGrant(ctx, user.Id, claims)
+		if err != nil {
+			return database.User{}, err
+		}
+	}
+
+	if !claims.HasScope(scope) {
+		return database.User{}, errors.New("token lacks the required scope")
+	}
+
+	return user, nil
+}
+
+// authenticatePersonalToken looks up a personal access token by its hash
+// and checks it hasn't expired and carries scope
+func (cfg *apiConfig) authenticatePersonalToken(ctx context.Context, tokenString, scope string) (database.User, error) {
+	db := cfg.db.WithContext(ctx)
+
+	hash := auth.HashOpaqueToken(tokenString)
+	token, err := db.GetPersonalToken(hash)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	now := time.Now().UTC()
+	if now.After(token.ExpiresAt) {
+		return database.User{}, errors.New("token has expired")
+	}
+	if !slices.Contains(token.Scopes, scope) {
+		return database.User{}, errors.New("token lacks the required scope")
+	}
+
+	user, err := db.GetUser(token.UserId)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	if token.CreatedAt.Before(user.SessionsRevokedAt) {
+		return database.User{}, errors.New("session has been revoked")
+	}
+
+	// Writing the whole database on every request would be wasteful, so
+	// last use is only tracked to the minute
+	if now.Sub(token.LastUsedAt) > time.Minute {
+		err = db.TouchPersonalToken(hash, now)
+		if err != nil {
+			return database.User{}, err
+		}
+	}
+
+	return user, nil
+}
+
+// checkGrant makes sure a third-party token was issued under the user's
+// current grant to its app, and only for scopes the grant still covers
+func (cfg *apiConfig) checkGrant(ctx context.Context, userId int, claims auth.Claims) error {
+	grant, err := cfg.db.WithContext(ctx).GetOAuthGrant(userId, claims.ClientID)
+	if err != nil {
+		return err
+	}
+
+	if claims.IssuedAt.Time.Before(grant.AuthorizedAt.Truncate(time.Second)) {
+		return errors.New("app authorization has been revoked")
+	}
+	for _, scope := range strings.Fields(claims.Scope) {
+		if !slices.Contains(grant.Scopes, scope) {
+			return errors.New("app is no longer authorized for " + scope)
+		}
+	}
+
+	return nil
+}
+
+// loadTokenUser verifies a token and loads the user it was issued to,
+// rejecting tokens issued before the user's sessions were revoked
+func (cfg *apiConfig) loadTokenUser(ctx context.Context, tokenString, tokenUse string) (database.User, auth.Claims, error) {
+	_, claims, err := cfg.tokens.Parse(tokenString, tokenUse)
+	if err != nil {
+		return database.User{}, auth.Claims{}, err
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return database.User{}, auth.Claims{}, err
+	}
+
+	user, err := cfg.db.WithContext(ctx).GetUser(id)
+	if err != nil {
+		return database.User{}, auth.Claims{}, err
+	}
+
+	if claims.IssuedAt.Time.Before(user.SessionsRevokedAt.Truncate(time.Second)) {
+		return database.User{}, auth.Claims{}, errors.New("session has been revoked")
+	}
+
+	return user, claims, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCheckGrant(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "grant@example.com")
+	_, err := cfg.db.CreateOAuthClient(database.OAuthClient{Id: "app", Name: "App"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.SaveOAuthGrant(user.Id, "app", []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimsFor := func(scope string) auth.Claims {
+		return auth.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+			ClientID:         "app",
+			Scope:            scope,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		claims  auth.Claims
+		wantErr bool
+	}{
+		{"granted scopes", claimsFor(auth.ScopeChirpsRead + " " + auth.ScopeChirpsWrite), false},
+		{"fewer scopes", claimsFor(auth.ScopeChirpsRead), false},
+		{"scope never granted", claimsFor(auth.ScopeChirpsRead + " " + auth.ScopeProfile), true},
+		{"other client", auth.Claims{RegisteredClaims: claimsFor("").RegisteredClaims, ClientID: "other"}, true},
+		{"issued before the grant", auth.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))},
+			ClientID:         "app",
+			Scope:            auth.ScopeChirpsRead,
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cfg.checkGrant(context.Background(), user.Id, tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckGrantAfterNarrowing(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "grant@example.com")
+	_, err := cfg.db.CreateOAuthClient(database.OAuthClient{Id: "app", Name: "App"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant, err := cfg.db.SaveOAuthGrant(user.Id, "app", []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(grant.AuthorizedAt.Add(time.Second))},
+		ClientID:         "app",
+		Scope:            auth.ScopeChirpsRead,
+	}
+
+	// Widening the grant keeps the tokens already issued under it
+	widened, err := cfg.db.SaveOAuthGrant(user.Id, "app", []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite, auth.ScopeProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !widened.AuthorizedAt.Equal(grant.AuthorizedAt) {
+		t.Error("widening the grant restarted it")
+	}
+	err = cfg.checkGrant(context.Background(), user.Id, claims)
+	if err != nil {
+		t.Errorf("token was rejected after widening the grant: %v", err)
+	}
+
+	// Taking a scope away restarts it, even for tokens that only use the
+	// scopes that are left
+	time.Sleep(2 * time.Second)
+	narrowed, err := cfg.db.SaveOAuthGrant(user.Id, "app", []string{auth.ScopeChirpsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !narrowed.AuthorizedAt.After(grant.AuthorizedAt) {
+		t.Error("narrowing the grant did not restart it")
+	}
+	err = cfg.checkGrant(context.Background(), user.Id, claims)
+	if err == nil {
+		t.Error("token issued before the grant was narrowed was accepted")
+	}
+}
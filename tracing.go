@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/carsongro/chirpy")
+
+// newSpanExporter picks where spans are sent. "otlp" is configured with the
+// standard OTEL_EXPORTER_OTLP_* variables and "stdout" prints every span,
+// for trying things out locally. "memory" keeps spans in the process, where
+// tests can look at them. Without an exporter nothing is traced.
+func newSpanExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case "memory":
+		return tracetest.NewInMemoryExporter(), nil
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", name)
+	}
+}
+
+// newTracerProvider batches spans to exporter
+func newTracerProvider(ctx context.Context, exporter sdktrace.SpanExporter) (*sdktrace.TracerProvider, error) {
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "chirpy")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// middlewareTracing starts a span for every request, continuing the trace
+// of a caller that sends a W3C traceparent header
+func middlewareTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		ctx, info := withRequestInfo(ctx)
+		traced := r.WithContext(ctx)
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, traced)
+
+		// Spans are named after the route, so paths with IDs in them are
+		// grouped together
+		if info.route != "" {
+			span.SetName(info.route)
+			span.SetAttributes(attribute.String("http.route", info.route))
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// startJob starts the root span for one run of a background job. Database
+// operations made with its context are traced under it.
+func startJob(name string) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "job."+name)
+}
+
+// setSpanAttributes annotates the span of the request ctx belongs to
+func setSpanAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// hashPassword traces hashing, which is slow on purpose
+func (cfg *apiConfig) hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "password.hash")
+	defer span.End()
+
+	return cfg.passwords.Hash(password)
+}
+
+// verifyPassword traces checking password against hash, which is slow on
+// purpose
+func (cfg *apiConfig) verifyPassword(ctx context.Context, hash, password string) (ok, needsRehash bool) {
+	_, span := tracer.Start(ctx, "password.verify")
+	defer span.End()
+
+	return cfg.passwords.Verify(hash, password)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+	spansTP   *sdktrace.TracerProvider
+)
+
+// recordSpans traces to the "memory" exporter, emptied for each test, and
+// returns a func that flushes and returns what was recorded. Tracers only
+// pick up the first provider set, so it's shared.
+func recordSpans(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+	spansOnce.Do(func() {
+		exporter, err := newSpanExporter(context.Background(), "memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		spans = exporter.(*tracetest.InMemoryExporter)
+		spansTP, err = newTracerProvider(context.Background(), exporter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otel.SetTracerProvider(spansTP)
+	})
+	// Spans from setting up the test may still be batched
+	err := spansTP.ForceFlush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans.Reset()
+
+	return func() tracetest.SpanStubs {
+		err := spansTP.ForceFlush(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spans.GetSpans()
+	}
+}
+
+func findSpan(t *testing.T, stubs tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, stub := range stubs {
+		if stub.Name == name {
+			return stub
+		}
+	}
+	t.Fatalf("no %s span in %d spans", name, len(stubs))
+	return tracetest.SpanStub{}
+}
+
+func TestRequestDatabaseSpans(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, _ := createTestUser(t, cfg, "user@example.com")
+	chirp, err := cfg.db.CreateChirp("hello", user.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := recordSpans(t)
+
+	handler := middlewareTracing(http.HandlerFunc(cfg.GetChirpHandler))
+	req := httptest.NewRequest(http.MethodGet, "/api/chirps/"+strconv.Itoa(chirp.Id), nil)
+	req.SetPathValue("chirpID", strconv.Itoa(chirp.Id))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	stubs := recorded()
+	request := findSpan(t, stubs, http.MethodGet)
+	getChirps := findSpan(t, stubs, "database.GetChirps")
+	if getChirps.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("GetChirps span has parent %s, want the request span", getChirps.Parent.SpanID())
+	}
+}
+
+func TestBackgroundJobSpans(t *testing.T) {
+	cfg := newTestConfig(t)
+	createTestUser(t, cfg, "user@example.com")
+	recorded := recordSpans(t)
+
+	cfg.expireSubscriptions(time.Now().UTC())
+
+	stubs := recorded()
+	job := findSpan(t, stubs, "job.expire_subscriptions")
+	if job.Parent.IsValid() {
+		t.Errorf("job span has parent %s, want a root", job.Parent.SpanID())
+	}
+	getUsers := findSpan(t, stubs, "database.GetUsers")
+	if getUsers.Parent.SpanID() != job.SpanContext.SpanID() {
+		t.Errorf("GetUsers span has parent %s, want the job span", getUsers.Parent.SpanID())
+	}
+	for _, stub := range stubs {
+		if !stub.Parent.IsValid() && stub.Name != job.Name {
+			t.Errorf("%s span is a root of its own", stub.Name)
+		}
+	}
+}
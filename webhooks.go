@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// Events Chirpy sends to webhook endpoints
+const (
+	eventChirpCreated = "chirp.created"
+	eventChirpDeleted = "chirp.deleted"
+	eventUserCreated  = "user.created"
+)
+
+// userEventData is what user events say about the user
+type userEventData struct {
+	Id    int    `json:"id"`
+	Email string `json:"email"`
+}
+
+// chirpDeletedData is what is left to say about a deleted chirp
+type chirpDeletedData struct {
+	Id       int `json:"id"`
+	AuthorId int `json:"author_id"`
+}
+
+var webhookEvents = map[string]bool{
+	eventChirpCreated: true,
+	eventChirpDeleted: true,
+	eventUserCreated:  true,
+	eventUserUpgraded: true,
+}
+
+// webhookSender delivers events to webhook endpoints in the background.
+// Failed deliveries are retried with exponential backoff, from retryBase up
+// to retryMax, until maxAttempts is reached and they are dead.
+type webhookSender struct {
+	client       *http.Client
+	allowPrivate bool
+	maxAttempts  int
+	retryBase    time.Duration
+	retryMax     time.Duration
+	historyTTL   time.Duration
+	wake         chan struct{}
+}
+
+func newWebhookSender(allowPrivate bool, maxAttempts int, retryBase, retryMax, historyTTL time.Duration) *webhookSender {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	// Checking the address actually dialed, rather than the URL, stops
+	// hostnames that resolve to internal services
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		}
+	}
+
+	return &webhookSender{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		allowPrivate: allowPrivate,
+		maxAttempts:  maxAttempts,
+		retryBase:    retryBase,
+		retryMax:     retryMax,
+		historyTTL:   historyTTL,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// backoff returns how long to wait after the given number of failed attempts
+func (s *webhookSender) backoff(attempts int) time.Duration {
+	if excess := attempts - 1; excess < 32 && s.retryBase<<excess < s.retryMax {
+		return s.retryBase << excess
+	}
+	return s.retryMax
+}
+
+func randomId(n int) (string, error) {
+	id := make([]byte, n)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// emitEvent queues event for every endpoint subscribed to it that may hear
+// about userId. Failing to queue it is logged rather than failing the
+// request that caused it.
+func (cfg *apiConfig) emitEvent(ctx context.Context, event string, userId int, data any) {
+	db := cfg.db.WithContext(ctx)
+
+	endpoints, err := db.GetSubscribedEndpoints(event, userId)
+	if err != nil {
+		slog.Error("emit webhook event", "event", event, "error", err)
+		return
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	eventId, err := randomId(16)
+	if err != nil {
+		slog.Error("emit webhook event", "event", event, "error", err)
+		return
+	}
+
+	type envelope struct {
+		Id        string    `json:"id"`
+		Event     string    `json:"event"`
+		CreatedAt time.Time `json:"created_at"`
+		Data      any       `json:"data"`
+	}
+
+	now := time.Now().UTC()
+	payload, err := json.Marshal(envelope{
+		Id:        eventId,
+		Event:     event,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		slog.Error("emit webhook event", "event", event, "error", err)
+		return
+	}
+
+	deliveries := make([]database.WebhookDelivery, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		id, err := randomId(16)
+		if err != nil {
+			slog.Error("emit webhook event", "event", event, "error", err)
+			return
+		}
+		deliveries = append(deliveries, database.WebhookDelivery{
+			Id:            id,
+			EndpointId:    endpoint.Id,
+			EventId:       eventId,
+			Event:         event,
+			Payload:       payload,
+			Status:        database.DeliveryPending,
+			CreatedAt:     now,
+			NextAttemptAt: now,
+		})
+	}
+
+	err = db.CreateWebhookDeliveries(deliveries)
+	if err != nil {
+		slog.Error("emit webhook event", "event", event, "error", err)
+		return
+	}
+	cfg.wakeWebhookSender()
+}
+
+// wakeWebhookSender has the sender look for due deliveries now rather than
+// at its next tick
+func (cfg *apiConfig) wakeWebhookSender() {
+	select {
+	case cfg.webhooks.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startWebhookDelivery sends due deliveries every interval, or sooner when
+// woken, until done is closed
+func (cfg *apiConfig) startWebhookDelivery(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			cfg.deliverWebhooks(time.Now().UTC())
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			case <-cfg.webhooks.wake:
+			}
+		}
+	}()
+}
+
+func (cfg *apiConfig) deliverWebhooks(now time.Time) {
+	ctx, span := startJob("deliver_webhooks")
+	defer span.End()
+	db := cfg.db.WithContext(ctx)
+
+	err := db.PruneWebhookDeliveries(now.Add(-cfg.webhooks.historyTTL))
+	if err != nil {
+		slog.Error("deliver webhooks", "error", err)
+	}
+
+	deliveries, err := db.GetDueWebhookDeliveries(now)
+	if err != nil {
+		slog.Error("deliver webhooks", "error", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		endpoint, err := db.GetWebhookEndpoint(delivery.EndpointId)
+		if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+			// There's nowhere left to send it, so it would otherwise stay
+			// due forever
+			delivery.Status = database.DeliveryDead
+			delivery.LastError = "endpoint was deleted"
+			_, err = db.UpdateWebhookDelivery(delivery)
+			if err != nil {
+				slog.Error("save webhook delivery", "delivery_id", delivery.Id, "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			slog.Error("deliver webhooks", "delivery_id", delivery.Id, "error", err)
+			continue
+		}
+
+		statusCode, err := cfg.webhooks.send(endpoint, delivery)
+
+		attemptedAt := time.Now().UTC()
+		delivery.Attempts++
+		delivery.LastAttemptAt = attemptedAt
+		delivery.LastStatusCode = statusCode
+		delivery.LastError = ""
+		switch {
+		case err == nil:
+			delivery.Status = database.DeliverySucceeded
+			slog.Debug("webhook delivered", "delivery_id", delivery.Id, "url", endpoint.URL, "status", statusCode)
+		case delivery.Attempts >= cfg.webhooks.maxAttempts:
+			delivery.Status = database.DeliveryDead
+			delivery.LastError = err.Error()
+			slog.Warn("webhook delivery is dead", "delivery_id", delivery.Id, "url", endpoint.URL, "attempts", delivery.Attempts, "error", err)
+		default:
+			delivery.LastError = err.Error()
+			delivery.NextAttemptAt = attemptedAt.Add(cfg.webhooks.backoff(delivery.Attempts))
+			slog.Debug("webhook delivery failed", "delivery_id", delivery.Id, "url", endpoint.URL, "attempts", delivery.Attempts, "retry_at", delivery.NextAttemptAt, "error", err)
+		}
+
+		_, err = db.UpdateWebhookDelivery(delivery)
+		if err != nil {
+			slog.Error("save webhook delivery", "delivery_id", delivery.Id, "error", err)
+		}
+	}
+}
+
+// send posts a delivery to its endpoint, signed with the endpoint's secret
+// the same way Polka signs its webhooks, see auth.WebhookVerifier. Any 2xx
+// response counts as delivered.
+func (s *webhookSender) send(endpoint database.WebhookEndpoint, delivery database.WebhookDelivery) (int, error) {
+	now := time.Now()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks")
+	req.Header.Set("Chirpy-Event", delivery.Event)
+	req.Header.Set("Chirpy-Delivery", delivery.Id)
+	req.Header.Set("Chirpy-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("Chirpy-Signature", "v1="+auth.SignWebhook(endpoint.Secret, now, delivery.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("endpoint responded with " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
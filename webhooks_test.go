@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carsongro/chirpy/internal/auth"
+	"github.com/carsongro/chirpy/internal/database"
+)
+
+// webhookReceiver is an endpoint that records what it is sent and answers
+// with status
+type webhookReceiver struct {
+	*httptest.Server
+	mux      *sync.Mutex
+	status   int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	t.Helper()
+
+	receiver := &webhookReceiver{mux: &sync.Mutex{}, status: status}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mux.Lock()
+		receiver.requests = append(receiver.requests, receivedWebhook{header: r.Header, body: body})
+		receiver.mux.Unlock()
+		w.WriteHeader(receiver.status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (receiver *webhookReceiver) received() []receivedWebhook {
+	receiver.mux.Lock()
+	defer receiver.mux.Unlock()
+	return append([]receivedWebhook(nil), receiver.requests...)
+}
+
+// newWebhookTestConfig returns a config whose sender makes at most two
+// attempts per delivery, with the given endpoints registered
+func newWebhookTestConfig(t *testing.T, allowPrivate bool, endpoints ...database.WebhookEndpoint) *apiConfig {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	cfg.webhooks = newWebhookSender(allowPrivate, 2, time.Minute, time.Hour, 24*time.Hour)
+	for _, endpoint := range endpoints {
+		_, err := cfg.db.CreateWebhookEndpoint(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+func onlyDelivery(t *testing.T, cfg *apiConfig, endpointId string) database.WebhookDelivery {
+	t.Helper()
+
+	deliveries, err := cfg.db.GetWebhookDeliveries(endpointId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	cfg := newWebhookTestConfig(t, true, database.WebhookEndpoint{
+		Id:     "endpoint",
+		URL:    receiver.URL,
+		Events: []string{eventUserCreated},
+		Secret: "endpoint-secret",
+	})
+
+	cfg.emitEvent(context.Background(), eventUserCreated, 1, userEventData{Id: 1, Email: "new@example.com"})
+	cfg.deliverWebhooks(time.Now().UTC())
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(requests))
+	}
+	got := requests[0]
+
+	verifier, err := auth.NewWebhookVerifier([]string{"endpoint-secret"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifier.Verify(got.header.Get("Chirpy-Timestamp"), got.header.Get("Chirpy-Signature"), got.body)
+	if err != nil {
+		t.Errorf("delivery signature did not verify: %v", err)
+	}
+
+	var envelope struct {
+		Id    string        `json:"id"`
+		Event string        `json:"event"`
+		Data  userEventData `json:"data"`
+	}
+	err = json.Unmarshal(got.body, &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Event != eventUserCreated || envelope.Data.Email != "new@example.com" || got.header.Get("Chirpy-Event") != eventUserCreated {
+		t.Errorf("got event %q with data %+v", envelope.Event, envelope.Data)
+	}
+
+	delivery := onlyDelivery(t, cfg, "endpoint")
+	if delivery.Status != database.DeliverySucceeded || delivery.LastStatusCode != http.StatusNoContent {
+		t.Errorf("got delivery %s with status code %d", delivery.Status, delivery.LastStatusCode)
+	}
+	if got.header.Get("Chirpy-Delivery") != delivery.Id {
+		t.Errorf("got delivery ID header %q, want %q", got.header.Get("Chirpy-Delivery"), delivery.Id)
+	}
+}
+
+func TestWebhookDeliveryRetriesUntilDead(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	cfg := newWebhookTestConfig(t, true, database.WebhookEndpoint{
+		Id:     "endpoint",
+		URL:    receiver.URL,
+		Events: []string{eventUserCreated},
+		Secret: "endpoint-secret",
+	})
+
+	cfg.emitEvent(context.Background(), eventUserCreated, 1, userEventData{Id: 1})
+	now := time.Now().UTC()
+	cfg.deliverWebhooks(now)
+
+	delivery := onlyDelivery(t, cfg, "endpoint")
+	if delivery.Status != database.DeliveryPending || delivery.Attempts != 1 {
+		t.Fatalf("after a failure: got delivery %s after %d attempts", delivery.Status, delivery.Attempts)
+	}
+	if delivery.NextAttemptAt.Before(now.Add(time.Minute)) {
+		t.Errorf("retry was scheduled for %v, before the backoff", delivery.NextAttemptAt)
+	}
+
+	// Nothing is sent again until the retry is due
+	cfg.deliverWebhooks(now.Add(time.Second))
+	if n := len(receiver.received()); n != 1 {
+		t.Errorf("receiver got %d requests before the retry was due, want 1", n)
+	}
+
+	cfg.deliverWebhooks(delivery.NextAttemptAt)
+	delivery = onlyDelivery(t, cfg, "endpoint")
+	if delivery.Status != database.DeliveryDead || delivery.LastStatusCode != http.StatusInternalServerError {
+		t.Errorf("after the last attempt: got delivery %s with status code %d", delivery.Status, delivery.LastStatusCode)
+	}
+}
+
+func TestWebhookDeliveryOnlyToSubscribedEndpoints(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	cfg := newTestConfig(t)
+	owner, _ := createTestUser(t, cfg, "owner@example.com")
+	other, _ := createTestUser(t, cfg, "other@example.com")
+	cfg.webhooks = newWebhookSender(true, 2, time.Minute, time.Hour, 24*time.Hour)
+
+	for _, endpoint := range []database.WebhookEndpoint{
+		{Id: "owned", OwnerId: owner.Id, URL: receiver.URL, Events: []string{eventChirpCreated}},
+		{Id: "other-events", OwnerId: owner.Id, URL: receiver.URL, Events: []string{eventChirpDeleted}},
+		{Id: "admin", URL: receiver.URL, Events: []string{eventChirpCreated}},
+	} {
+		_, err := cfg.db.CreateWebhookEndpoint(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.emitEvent(context.Background(), eventChirpCreated, other.Id, database.Chirp{Id: 1, AuthorId: other.Id})
+	cfg.deliverWebhooks(time.Now().UTC())
+
+	for endpoint, want := range map[string]int{"owned": 0, "other-events": 0, "admin": 1} {
+		deliveries, err := cfg.db.GetWebhookDeliveries(endpoint, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != want {
+			t.Errorf("%s: got %d deliveries, want %d", endpoint, len(deliveries), want)
+		}
+	}
+	if n := len(receiver.received()); n != 1 {
+		t.Errorf("receiver got %d requests, want 1", n)
+	}
+}
+
+func TestWebhookSenderRefusesPrivateAddresses(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	cfg := newWebhookTestConfig(t, false, database.WebhookEndpoint{
+		Id:     "endpoint",
+		URL:    receiver.URL,
+		Events: []string{eventUserCreated},
+	})
+
+	cfg.emitEvent(context.Background(), eventUserCreated, 1, userEventData{Id: 1})
+	cfg.deliverWebhooks(time.Now().UTC())
+
+	if n := len(receiver.received()); n != 0 {
+		t.Errorf("receiver on a loopback address got %d requests", n)
+	}
+	delivery := onlyDelivery(t, cfg, "endpoint")
+	if !strings.Contains(delivery.LastError, "not a public address") {
+		t.Errorf("got error %q", delivery.LastError)
+	}
+}
+
+func TestWebhookDeliveryToDeletedEndpointIsDead(t *testing.T) {
+	cfg := newWebhookTestConfig(t, true)
+	now := time.Now().UTC()
+	err := cfg.db.CreateWebhookDeliveries([]database.WebhookDelivery{{
+		Id:            "orphan",
+		EndpointId:    "deleted",
+		Event:         eventUserCreated,
+		Payload:       json.RawMessage(`{}`),
+		Status:        database.DeliveryPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.deliverWebhooks(now)
+
+	delivery := onlyDelivery(t, cfg, "deleted")
+	if delivery.Status != database.DeliveryDead {
+		t.Errorf("delivery to a deleted endpoint is %s, want %s", delivery.Status, database.DeliveryDead)
+	}
+	due, err := cfg.db.GetDueWebhookDeliveries(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 0 {
+		t.Errorf("%d deliveries still due", len(due))
+	}
+}